@@ -0,0 +1,193 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/logging"
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+// CheckCmd creates the command that reports container images without
+// digests in manifest files and directories, or in a YAML stream on stdin,
+// without modifying them.
+func CheckCmd(ctx context.Context) *cobra.Command {
+	var verifyDigests bool
+	var format string
+	cmd := &cobra.Command{
+		Use:   "check [PATH...]",
+		Short: "Report container images that are not pinned to digests",
+		Long: "Report container images in Kubernetes manifests in YAML " +
+			"files and directories, recursively, that do not have digests. " +
+			"Optionally verify that the digests of images with tags and " +
+			"digests match the registry. Exit with a non-zero status if " +
+			"there are violations. The manifests are not modified.\n\n" +
+			"With no PATH, or when PATH is -, read a multi-document YAML " +
+			"stream from stdin.",
+		Example: "  digester check deploy/\n" +
+			"  digester check --verify-digests --format sarif deploy/ > digester.sarif",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			log := logging.CreateStdLogger("digester")
+			return printError(cmd, check(ctx, log, cmd.InOrStdin(), cmd.OutOrStdout(), args, verifyDigests, format))
+		},
+	}
+	cmd.Flags().BoolVar(&verifyDigests, "verify-digests", false, "verify that the digests of image references with tags and digests match the registry")
+	cmd.Flags().StringVar(&format, "format", FormatText, "report format, one of text, json, or sarif")
+	addResolverFlags(cmd)
+	return cmd
+}
+
+// check reports the image references in the resources in the paths, or in
+// stdin if there are no paths, that are not pinned to digests, and returns
+// an error if there are any.
+func check(ctx context.Context, log logr.Logger, stdin io.Reader, stdout io.Writer, paths []string, verifyDigests bool, format string) error {
+	if err := validateFormat(format); err != nil {
+		return err
+	}
+	r, err := newResolver(ctx, log, functionConfig{})
+	if err != nil {
+		return err
+	}
+	defer r.close()
+	var findings []finding
+	collect := func(file string, in io.Reader) error {
+		nodes, err := readResources(in)
+		if err != nil {
+			return err
+		}
+		for _, n := range nodes {
+			results, err := r.results(n, resolve.WithCheckOnly(true), resolve.WithVerifyDigests(verifyDigests))
+			findings = append(findings, newFindings(n, file, results, err)...)
+		}
+		return nil
+	}
+	if len(paths) == 0 {
+		paths = []string{"-"}
+	}
+	for _, path := range paths {
+		if path == "-" {
+			if err := collect("", stdin); err != nil {
+				return fmt.Errorf("could not check images in stdin: %w", err)
+			}
+			continue
+		}
+		files, err := manifestFiles(path)
+		if err != nil {
+			return fmt.Errorf("could not check images in %s: %w", path, err)
+		}
+		for _, file := range files {
+			if err := checkFile(file, collect); err != nil {
+				return err
+			}
+		}
+	}
+	if err := writeReport(stdout, format, findings); err != nil {
+		return err
+	}
+	if len(findings) > 0 {
+		return fmt.Errorf("found %d image references that are not pinned to digests, or that could not be verified", len(findings))
+	}
+	return nil
+}
+
+// checkFile opens the file and passes it to collect.
+func checkFile(file string, collect func(string, io.Reader) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", file, err)
+	}
+	defer f.Close()
+	if err := collect(filepath.ToSlash(file), f); err != nil {
+		return fmt.Errorf("could not check images in %s: %w", file, err)
+	}
+	return nil
+}
+
+// manifestFiles returns the path if it is a file, or the YAML files in the
+// directory and its subdirectories.
+func manifestFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	err = filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		for _, pattern := range kio.DefaultMatch {
+			if match, _ := filepath.Match(pattern, d.Name()); match {
+				files = append(files, file)
+				break
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// readResources reads the resources in a multi-document YAML stream, and the
+// items of List and ResourceList resources. Unlike kio.ByteReader, it decodes
+// the stream as a whole, so that line numbers are relative to the start of
+// the stream instead of the start of the document.
+func readResources(in io.Reader) ([]*yaml.RNode, error) {
+	decoder := yaml.NewDecoder(in)
+	var nodes []*yaml.RNode
+	for {
+		node := &yaml.Node{}
+		if err := decoder.Decode(node); err == io.EOF {
+			return nodes, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("could not parse YAML: %w", err)
+		}
+		if yaml.IsYNodeEmptyDoc(node) {
+			continue
+		}
+		n := yaml.NewRNode(node)
+		if kind := n.GetKind(); kind == "List" || kind == kio.ResourceListKind {
+			items, err := n.Pipe(yaml.Lookup("items"))
+			if err != nil {
+				return nil, err
+			}
+			itemNodes, err := items.Elements()
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, itemNodes...)
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+}
+
+// isStdin returns true if the command should read from stdin.
+func isStdin(paths []string) bool {
+	return len(paths) == 0 || (len(paths) == 1 && paths[0] == "-")
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPinnedPod = `apiVersion: v1
+kind: Pod
+metadata:
+  name: pinned
+spec:
+  containers:
+    - name: app
+      image: nginx@` + testDigest + `
+`
+
+func Test_Check_JSON(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "deployment.yaml"), testDeployment)
+	writeTestFile(t, filepath.Join(dir, "nested", "pod.yaml"), testPinnedPod)
+
+	stdout, err := executeCheck(t, "", "--format", "json", dir)
+
+	if err == nil || !strings.Contains(err.Error(), "found 1 image references") {
+		t.Errorf("wanted error for one violation, got %v", err)
+	}
+	var got report
+	if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+		t.Fatalf("could not parse report: %v\n%s", err, stdout)
+	}
+	if got.Violations != 1 || len(got.Findings) != 1 {
+		t.Fatalf("wanted 1 finding, got %+v", got)
+	}
+	want := finding{
+		Rule:       ruleUnpinnedImage,
+		File:       filepath.ToSlash(filepath.Join(dir, "deployment.yaml")),
+		Line:       11,
+		APIVersion: "apps/v1",
+		Kind:       "Deployment",
+		Name:       "app",
+		Field:      "spec.template.spec.containers[name=app].image",
+		Image:      "nginx:1.25",
+		Message:    "image nginx:1.25 does not have a digest",
+	}
+	if got.Findings[0] != want {
+		t.Errorf("wanted %+v, got %+v", want, got.Findings[0])
+	}
+	assertFile(t, filepath.Join(dir, "deployment.yaml"), testDeployment)
+}
+
+func Test_Check_LineNumbersInMultiDocumentStream(t *testing.T) {
+	stdout, _ := executeCheck(t, testService+"---\n"+testDeployment, "--format", "json")
+
+	var got report
+	if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+		t.Fatalf("could not parse report: %v\n%s", err, stdout)
+	}
+	if len(got.Findings) != 1 || got.Findings[0].Line != 19 {
+		t.Errorf("wanted one finding on line 19, got %+v", got.Findings)
+	}
+}
+
+func Test_Check_SARIF(t *testing.T) {
+	stdout, err := executeCheck(t, testDeployment, "--format", "sarif")
+
+	if err == nil {
+		t.Errorf("wanted error for violation")
+	}
+	var got sarifLog
+	if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+		t.Fatalf("could not parse SARIF log: %v\n%s", err, stdout)
+	}
+	if got.Version != sarifVersion || len(got.Runs) != 1 || len(got.Runs[0].Results) != 1 {
+		t.Fatalf("wanted one run with one result, got %+v", got)
+	}
+	result := got.Runs[0].Results[0]
+	if result.RuleID != ruleUnpinnedImage || result.Level != "error" {
+		t.Errorf("wanted error for rule %s, got %+v", ruleUnpinnedImage, result)
+	}
+	if name := result.Locations[0].LogicalLocations[0].FullyQualifiedName; name != "Deployment/app/spec.template.spec.containers[name=app].image" {
+		t.Errorf("unexpected logical location %s", name)
+	}
+}
+
+func Test_Check_NoViolations(t *testing.T) {
+	stdout, err := executeCheck(t, testPinnedPod+"---\n"+testService)
+
+	if err != nil {
+		t.Errorf("wanted no error, got %v", err)
+	}
+	if stdout != "" {
+		t.Errorf("wanted empty text report, got:\n%s", stdout)
+	}
+}
+
+func Test_Check_UnknownFormat(t *testing.T) {
+	if _, err := executeCheck(t, testDeployment, "--format", "xml"); err == nil || !strings.Contains(err.Error(), "unknown format xml") {
+		t.Errorf("wanted unknown format error, got %v", err)
+	}
+}
+
+func executeCheck(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+	cmd := CheckCmd(context.Background())
+	var stdout, stderr bytes.Buffer
+	cmd.SetIn(strings.NewReader(stdin))
+	cmd.SetOut(&stdout)
+	cmd.SetErr(&stderr)
+	cmd.SetArgs(args)
+	err := cmd.Execute()
+	return stdout.String(), err
+}
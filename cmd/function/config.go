@@ -0,0 +1,241 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+	"github.com/google/k8s-digester/pkg/util"
+)
+
+// API version and kind of the typed function config.
+const (
+	DigesterConfigAPIVersion = "digester.k8s.io/v1alpha1"
+	DigesterConfigKind       = "DigesterConfig"
+)
+
+// Lock modes. LockModeUpdate resolves image tags using registries, and adds
+// the digests to the lock file. LockModeFrozen resolves image tags
+// exclusively from the lock file, and fails for image tags that are not in
+// the lock file.
+const (
+	LockModeUpdate = "update"
+	LockModeFrozen = "frozen"
+)
+
+// Keys of the data of a ConfigMap function config. The keys match the flags
+// of the function.
+const (
+	configKeyOffline          = "offline"
+	configKeySkipPrefixes     = "skip-prefixes"
+	configKeyResolutionMode   = "resolution-mode"
+	configKeyPlatform         = "platform"
+	configKeyIgnoreErrors     = "ignore-errors"
+	configKeyFailFast         = "fail-fast"
+	configKeyLockFile         = "lock-file"
+	configKeyLockMode         = "lock-mode"
+	configKeyLocalImages      = "local-images"
+	configKeyRegistryFallback = "registry-fallback"
+	configKeyRegistryMirrors  = "registry-mirrors"
+	configKeyRewriteToMirror  = "rewrite-to-mirror"
+	configKeyVersionRanges    = "version-ranges"
+)
+
+// functionConfig contains the settings from the functionConfig of the
+// ResourceList. Settings that are not set keep the values of the flags and
+// environment variables.
+type functionConfig struct {
+	Offline          *bool    `yaml:"offline,omitempty"`
+	SkipPrefixes     []string `yaml:"skipPrefixes,omitempty"`
+	ResolutionMode   string   `yaml:"resolutionMode,omitempty"`
+	Platform         string   `yaml:"platform,omitempty"`
+	IgnoreErrors     *bool    `yaml:"ignoreErrors,omitempty"`
+	FailFast         *bool    `yaml:"failFast,omitempty"`
+	LockFile         string   `yaml:"lockFile,omitempty"`
+	LockMode         string   `yaml:"lockMode,omitempty"`
+	LocalImages      []string `yaml:"localImages,omitempty"`
+	RegistryFallback *bool    `yaml:"registryFallback,omitempty"`
+	// RegistryMirrorsFile is the path to a registry mirrors file, and
+	// RegistryMirrors are inline registry mirrors, which take precedence.
+	RegistryMirrorsFile string           `yaml:"registryMirrorsFile,omitempty"`
+	RegistryMirrors     []resolve.Mirror `yaml:"registryMirrors,omitempty"`
+	RewriteToMirror     *bool            `yaml:"rewriteToMirror,omitempty"`
+	VersionRanges       *bool            `yaml:"versionRanges,omitempty"`
+}
+
+// digesterConfig is the DigesterConfig kind.
+type digesterConfig struct {
+	yaml.ResourceMeta `yaml:",inline"`
+	functionConfig    `yaml:",inline"`
+}
+
+// parseFunctionConfig reads the function config, which is either a
+// ConfigMap, or a DigesterConfig. An empty function config is valid.
+// Unknown keys and invalid values are errors, so that typos do not go
+// unnoticed.
+func parseFunctionConfig(n *yaml.RNode) (functionConfig, error) {
+	if n == nil || n.IsNilOrEmpty() {
+		return functionConfig{}, nil
+	}
+	switch kind := n.GetKind(); kind {
+	case "ConfigMap":
+		return parseConfigMapData(n.GetDataMap())
+	case DigesterConfigKind:
+		return parseDigesterConfig(n)
+	default:
+		return functionConfig{}, fmt.Errorf("unsupported functionConfig kind %s, must be ConfigMap or %s", kind, DigesterConfigKind)
+	}
+}
+
+// parseConfigMapData reads the function config from the data of a ConfigMap.
+func parseConfigMapData(data map[string]string) (functionConfig, error) {
+	var config functionConfig
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := data[key]
+		var err error
+		switch key {
+		case configKeyOffline:
+			config.Offline, err = parseBool(value)
+		case configKeySkipPrefixes:
+			config.SkipPrefixes = util.StringArray(value)
+		case configKeyResolutionMode:
+			config.ResolutionMode = value
+		case configKeyPlatform:
+			config.Platform = value
+		case configKeyIgnoreErrors:
+			config.IgnoreErrors, err = parseBool(value)
+		case configKeyFailFast:
+			config.FailFast, err = parseBool(value)
+		case configKeyLockFile:
+			config.LockFile = value
+		case configKeyLockMode:
+			config.LockMode = value
+		case configKeyLocalImages:
+			config.LocalImages = util.StringArray(value)
+		case configKeyRegistryFallback:
+			config.RegistryFallback, err = parseBool(value)
+		case configKeyRegistryMirrors:
+			config.RegistryMirrorsFile = value
+		case configKeyRewriteToMirror:
+			config.RewriteToMirror, err = parseBool(value)
+		case configKeyVersionRanges:
+			config.VersionRanges, err = parseBool(value)
+		default:
+			return functionConfig{}, fmt.Errorf("unknown key %s in functionConfig data", key)
+		}
+		if err != nil {
+			return functionConfig{}, fmt.Errorf("invalid value for %s in functionConfig data: %w", key, err)
+		}
+	}
+	return config, config.validate()
+}
+
+// parseDigesterConfig reads the function config from a DigesterConfig.
+func parseDigesterConfig(n *yaml.RNode) (functionConfig, error) {
+	if apiVersion := n.GetApiVersion(); apiVersion != DigesterConfigAPIVersion {
+		return functionConfig{}, fmt.Errorf("unsupported %s apiVersion %s, must be %s", DigesterConfigKind, apiVersion, DigesterConfigAPIVersion)
+	}
+	s, err := n.String()
+	if err != nil {
+		return functionConfig{}, fmt.Errorf("could not serialize %s: %w", DigesterConfigKind, err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewBufferString(s))
+	decoder.KnownFields(true)
+	var config digesterConfig
+	if err := decoder.Decode(&config); err != nil {
+		return functionConfig{}, fmt.Errorf("invalid %s: %w", DigesterConfigKind, err)
+	}
+	return config.functionConfig, config.validate()
+}
+
+// validate checks the values that are not validated by parsing.
+func (c functionConfig) validate() error {
+	switch c.ResolutionMode {
+	case "", resolve.ResolutionModeIndex, resolve.ResolutionModePlatform:
+	default:
+		return fmt.Errorf("unknown resolution mode %s, must be one of %s or %s", c.ResolutionMode, resolve.ResolutionModeIndex, resolve.ResolutionModePlatform)
+	}
+	if c.Platform != "" {
+		if _, err := resolve.TargetPlatform(resolve.ResolutionModePlatform, c.Platform); err != nil {
+			return err
+		}
+	}
+	for _, mirror := range c.RegistryMirrors {
+		if err := mirror.Validate(); err != nil {
+			return fmt.Errorf("invalid registry mirror: %w", err)
+		}
+	}
+	return validateLockMode(c.LockMode)
+}
+
+// validateLockMode returns an error if the lock mode is unknown. Empty means
+// the default lock mode.
+func validateLockMode(mode string) error {
+	switch mode {
+	case "", LockModeUpdate, LockModeFrozen:
+		return nil
+	default:
+		return fmt.Errorf("unknown lock mode %s, must be one of %s or %s", mode, LockModeUpdate, LockModeFrozen)
+	}
+}
+
+// resolutionMode returns the resolution mode of the config, or the default.
+// Setting a platform without a resolution mode implies resolution mode
+// platform.
+func (c functionConfig) resolutionMode(defaultMode string) string {
+	switch {
+	case c.ResolutionMode != "":
+		return c.ResolutionMode
+	case c.Platform != "":
+		return resolve.ResolutionModePlatform
+	default:
+		return defaultMode
+	}
+}
+
+// configResult creates a function result for an invalid function config.
+func configResult(n *yaml.RNode, err error) *framework.Result {
+	result := &framework.Result{
+		Message:  fmt.Sprintf("invalid functionConfig: %v", err),
+		Severity: framework.Error,
+	}
+	if n != nil && !n.IsNilOrEmpty() {
+		result.ResourceRef = &yaml.ResourceIdentifier{
+			TypeMeta: yaml.TypeMeta{APIVersion: n.GetApiVersion(), Kind: n.GetKind()},
+			NameMeta: yaml.NameMeta{Name: n.GetName(), Namespace: n.GetNamespace()},
+		}
+	}
+	return result
+}
+
+func parseBool(value string) (*bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
@@ -0,0 +1,354 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+func Test_parseFunctionConfig(t *testing.T) {
+	offline := false
+	ignoreErrors := true
+	rewriteToMirror := true
+	versionRanges := true
+	tests := []struct {
+		name    string
+		config  string
+		want    functionConfig
+		wantErr string
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "ConfigMap",
+			config: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: digester
+data:
+  offline: "false"
+  skip-prefixes: "gcr.io/a/:gcr.io/b/"
+  platform: linux/arm64
+  ignore-errors: "true"
+`,
+			want: functionConfig{
+				Offline:      &offline,
+				SkipPrefixes: []string{"gcr.io/a/", "gcr.io/b/"},
+				Platform:     "linux/arm64",
+				IgnoreErrors: &ignoreErrors,
+			},
+		},
+		{
+			name: "DigesterConfig",
+			config: `apiVersion: digester.k8s.io/v1alpha1
+kind: DigesterConfig
+metadata:
+  name: digester
+offline: false
+skipPrefixes:
+- gcr.io/a/
+- gcr.io/b/
+resolutionMode: platform
+platform: linux/arm64
+ignoreErrors: true
+lockFile: digester.lock.yaml
+lockMode: frozen
+`,
+			want: functionConfig{
+				Offline:        &offline,
+				SkipPrefixes:   []string{"gcr.io/a/", "gcr.io/b/"},
+				ResolutionMode: resolve.ResolutionModePlatform,
+				Platform:       "linux/arm64",
+				IgnoreErrors:   &ignoreErrors,
+				LockFile:       "digester.lock.yaml",
+				LockMode:       LockModeFrozen,
+			},
+		},
+		{
+			name: "ConfigMap registry mirrors",
+			config: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: digester
+data:
+  registry-mirrors: mirrors.yaml
+  rewrite-to-mirror: "true"
+`,
+			want: functionConfig{
+				RegistryMirrorsFile: "mirrors.yaml",
+				RewriteToMirror:     &rewriteToMirror,
+			},
+		},
+		{
+			name: "DigesterConfig registry mirrors",
+			config: `apiVersion: digester.k8s.io/v1alpha1
+kind: DigesterConfig
+metadata:
+  name: digester
+registryMirrors:
+- source: docker.io
+  mirrors:
+  - mirror.gcr.io
+  mirrorsOnly: true
+rewriteToMirror: true
+`,
+			want: functionConfig{
+				RegistryMirrors: []resolve.Mirror{{Source: "docker.io", Mirrors: []string{"mirror.gcr.io"}, MirrorsOnly: true}},
+				RewriteToMirror: &rewriteToMirror,
+			},
+		},
+		{
+			name: "ConfigMap version ranges",
+			config: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: digester
+data:
+  version-ranges: "true"
+`,
+			want: functionConfig{VersionRanges: &versionRanges},
+		},
+		{
+			name: "DigesterConfig version ranges",
+			config: `apiVersion: digester.k8s.io/v1alpha1
+kind: DigesterConfig
+metadata:
+  name: digester
+versionRanges: true
+`,
+			want: functionConfig{VersionRanges: &versionRanges},
+		},
+		{
+			name: "DigesterConfig registry mirror without mirrors",
+			config: `apiVersion: digester.k8s.io/v1alpha1
+kind: DigesterConfig
+metadata:
+  name: digester
+registryMirrors:
+- source: docker.io
+`,
+			wantErr: "source docker.io has no mirrors",
+		},
+		{
+			name: "ConfigMap unknown key",
+			config: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: digester
+data:
+  skip-prefix: gcr.io/a/
+`,
+			wantErr: "unknown key skip-prefix",
+		},
+		{
+			name: "ConfigMap invalid value",
+			config: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: digester
+data:
+  offline: maybe
+`,
+			wantErr: "invalid value for offline",
+		},
+		{
+			name: "DigesterConfig unknown field",
+			config: `apiVersion: digester.k8s.io/v1alpha1
+kind: DigesterConfig
+metadata:
+  name: digester
+skipPrefix: gcr.io/a/
+`,
+			wantErr: "field skipPrefix not found",
+		},
+		{
+			name: "DigesterConfig wrong apiVersion",
+			config: `apiVersion: digester.k8s.io/v2
+kind: DigesterConfig
+metadata:
+  name: digester
+`,
+			wantErr: "unsupported DigesterConfig apiVersion",
+		},
+		{
+			name: "invalid resolution mode",
+			config: `apiVersion: digester.k8s.io/v1alpha1
+kind: DigesterConfig
+metadata:
+  name: digester
+resolutionMode: manifest
+`,
+			wantErr: "unknown resolution mode manifest",
+		},
+		{
+			name: "invalid lock mode",
+			config: `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: digester
+data:
+  lock-mode: read
+`,
+			wantErr: "unknown lock mode read",
+		},
+		{
+			name: "unsupported kind",
+			config: `apiVersion: v1
+kind: Secret
+metadata:
+  name: digester
+`,
+			wantErr: "unsupported functionConfig kind Secret",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var n *yaml.RNode
+			if tt.config != "" {
+				n = yaml.MustParse(tt.config)
+			}
+			got, err := parseFunctionConfig(n)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("wanted error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("wanted %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_functionConfig_resolutionMode(t *testing.T) {
+	if got := (functionConfig{}).resolutionMode(resolve.ResolutionModeIndex); got != resolve.ResolutionModeIndex {
+		t.Errorf("wanted default mode, got %s", got)
+	}
+	if got := (functionConfig{Platform: "linux/arm64"}).resolutionMode(resolve.ResolutionModeIndex); got != resolve.ResolutionModePlatform {
+		t.Errorf("wanted platform mode when platform is set, got %s", got)
+	}
+}
+
+func Test_Function_ConfigSkipPrefixesAndIgnoreErrors(t *testing.T) {
+	var gotSkipPrefixes []string
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, skipPrefixes []string, _ ...resolve.Option) error {
+		gotSkipPrefixes = skipPrefixes
+		return errors.New("registry unavailable")
+	}
+	t.Cleanup(func() { resolveImageTags = resolve.ImageTags })
+
+	_, err := executeFunction(t, `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: app
+  spec:
+    containers:
+    - name: app
+      image: nginx:1.25
+functionConfig:
+  apiVersion: digester.k8s.io/v1alpha1
+  kind: DigesterConfig
+  metadata:
+    name: digester
+  skipPrefixes:
+  - gcr.io/a/
+  ignoreErrors: true
+`)
+	if err != nil {
+		t.Fatalf("wanted error to be ignored, got %v", err)
+	}
+	if !reflect.DeepEqual(gotSkipPrefixes, []string{"gcr.io/a/"}) {
+		t.Errorf("wanted skip prefixes from functionConfig, got %v", gotSkipPrefixes)
+	}
+}
+
+func Test_Function_InvalidConfigResult(t *testing.T) {
+	stdout, err := executeFunction(t, `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+items: []
+functionConfig:
+  apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: digester
+  data:
+    offline: maybe
+`)
+	var results framework.Results
+	if !errors.As(err, &results) || results.ExitCode() != 1 {
+		t.Fatalf("wanted error results, got %v", err)
+	}
+	if !strings.Contains(stdout, "results:") || !strings.Contains(stdout, "invalid value for offline") {
+		t.Errorf("wanted result in output, got:\n%s", stdout)
+	}
+}
+
+func executeFunction(t *testing.T, stdin string) (string, error) {
+	t.Helper()
+	cmd := Cmd(context.Background())
+	var stdout, stderr bytes.Buffer
+	cmd.SetIn(strings.NewReader(stdin))
+	cmd.SetOut(&stdout)
+	cmd.SetErr(&stderr)
+	cmd.SetArgs([]string{})
+	err := cmd.Execute()
+	return stdout.String(), err
+}
+
+func Test_resolver_resultsDoesNotShareOptions(t *testing.T) {
+	var gotOpts [][]resolve.Option
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, _ []string, opts ...resolve.Option) error {
+		gotOpts = append(gotOpts, opts)
+		return nil
+	}
+	t.Cleanup(func() { resolveImageTags = resolve.ImageTags })
+	r := &resolver{opts: make([]resolve.Option, 0, 10)}
+	n := yaml.MustParse("kind: Pod")
+
+	if _, err := r.results(n, resolve.WithCheckOnly(true)); err != nil {
+		t.Fatalf("problem resolving: %v", err)
+	}
+	if _, err := r.results(n, resolve.WithVerifyDigests(true)); err != nil {
+		t.Fatalf("problem resolving: %v", err)
+	}
+
+	var f resolve.ImageTagFilter
+	for _, opt := range gotOpts[0] {
+		opt(&f)
+	}
+	if !f.CheckOnly || f.VerifyDigests {
+		t.Errorf("wanted options of the first call unchanged by the second call, got CheckOnly=%t VerifyDigests=%t", f.CheckOnly, f.VerifyDigests)
+	}
+}
@@ -17,13 +17,11 @@ package function
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/go-logr/logr"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
@@ -31,8 +29,6 @@ import (
 	"sigs.k8s.io/kustomize/kyaml/fn/framework/command"
 
 	"github.com/google/k8s-digester/pkg/logging"
-	"github.com/google/k8s-digester/pkg/resolve"
-	"github.com/google/k8s-digester/pkg/util"
 )
 
 // Cmd creates the KRM function command. This is the root command.
@@ -45,30 +41,29 @@ func Cmd(ctx context.Context) *cobra.Command {
 }
 
 // createResourceFn returns a function that iterates over the items in the
-// resource list.
+// resource list, and records the outcome as results. The function fails
+// only if there are error results.
 func createResourceFn(ctx context.Context, log logr.Logger) framework.ResourceListProcessorFunc {
 	return func(resourceList *framework.ResourceList) error {
-		log.V(2).Info("kubeconfig", "kubeconfig", viper.GetString("kubeconfig"))
-		log.V(2).Info("offline", "offline", viper.GetBool("offline"))
-		log.V(2).Info("skip-prefixes", "skip-prefixes", util.StringArray(viper.GetString("skip-prefixes")))
-		var config *rest.Config
-		if !viper.GetBool("offline") {
-			var kubeconfig string
-			var err error
-			kubeconfigs := util.StringArray(viper.GetString("kubeconfig"))
-			if len(kubeconfigs) > 0 {
-				kubeconfig = kubeconfigs[0]
-			}
-
-			config, err = createConfig(log, kubeconfig)
-			if err != nil {
-				return fmt.Errorf("could not create k8s client config: %w", err)
-			}
+		fnConfig, err := parseFunctionConfig(resourceList.FunctionConfig)
+		if err != nil {
+			resourceList.Results = append(resourceList.Results, configResult(resourceList.FunctionConfig, err))
+			return resourceList.Results
+		}
+		r, err := newResolver(ctx, log, fnConfig)
+		if err != nil {
+			return err
+		}
+		defer r.close()
+		resourceList.Results = append(resourceList.Results, r.resolveAll(resourceList.Items)...)
+		if err := r.saveLock(); err != nil {
+			resourceList.Results = append(resourceList.Results, &framework.Result{
+				Message:  err.Error(),
+				Severity: framework.Error,
+			})
 		}
-		for _, r := range resourceList.Items {
-			if err := resolve.ImageTags(ctx, log, config, r, util.StringArray(viper.GetString("skip-prefixes"))); err != nil {
-				return err
-			}
+		if resourceList.Results.ExitCode() != 0 {
+			return resourceList.Results
 		}
 		return nil
 	}
@@ -79,21 +74,13 @@ func createResourceFn(ctx context.Context, log logr.Logger) framework.ResourceLi
 func customizeCmd(cmd *cobra.Command) {
 	cmd.Use = "digester"
 	cmd.Short = "Resolve container image tags to digests"
-	cmd.Long = "Digester adds digests to container and " +
-		"init container images in Kubernetes pod and pod template " +
-		"specs.\n\nUse either as a mutating admission webhook, " +
-		"or as a client-side KRM function with kpt or kustomize."
-	cmd.Flags().String("kubeconfig", getKubeconfigDefault(),
-		"(optional) absolute path to the kubeconfig file. Requires offline=false.")
-	viper.BindPFlag("kubeconfig", cmd.Flags().Lookup("kubeconfig"))
-	viper.BindEnv("kubeconfig")
-	cmd.Flags().Bool("offline", true,
-		"do not connect to Kubernetes API server to retrieve imagePullSecrets")
-	viper.BindPFlag("offline", cmd.Flags().Lookup("offline"))
-	viper.BindEnv("offline")
-	cmd.Flags().String("skip-prefixes", "", "(optional) image prefixes that should not be resolved to digests, colon separated")
-	viper.BindPFlag("skip-prefixes", cmd.Flags().Lookup("skip-prefixes"))
-	viper.BindEnv("skip-prefixes", "SKIP_PREFIXES")
+	cmd.Long = "Digester adds digests to the images of containers, " +
+		"init containers, ephemeral containers, and image volumes in " +
+		"Kubernetes pod and pod template specs, and to image references " +
+		"in other fields configured using field specs.\n\nUse either as " +
+		"a mutating admission webhook, as a client-side KRM function " +
+		"with kpt or kustomize, or with the pin and check commands."
+	addResolverFlags(cmd)
 }
 
 // getKubeconfigDefault determines the default value of the --kubeconfig flag.
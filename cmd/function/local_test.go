@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func Test_Pin_LocalImages(t *testing.T) {
+	dir := t.TempDir()
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatalf("could not create OCI image layout: %v", err)
+	}
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("could not create image: %v", err)
+	}
+	if err := p.AppendImage(img, layout.WithAnnotations(map[string]string{
+		"org.opencontainers.image.ref.name": "docker.io/library/nginx:1.25",
+	})); err != nil {
+		t.Fatalf("could not append image: %v", err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("could not get digest: %v", err)
+	}
+
+	stdout, err := executePin(t, testDeployment, "--local-images", dir, "--registry-fallback=false")
+	if err != nil {
+		t.Fatalf("pin failed: %v", err)
+	}
+	if want := strings.Replace(testDeployment, "nginx:1.25", "nginx:1.25@"+digest.String(), 1); stdout != want {
+		t.Errorf("wanted:\n%s\ngot:\n%s", want, stdout)
+	}
+
+	_, err = executePin(t, strings.Replace(testDeployment, "nginx:1.25", "nginx:1.24", 1), "--local-images", dir, "--registry-fallback=false")
+	if err == nil || !strings.Contains(err.Error(), "could not resolve 1 image references") {
+		t.Errorf("wanted error for image that is not in the local images, got %v", err)
+	}
+}
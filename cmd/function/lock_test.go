@@ -0,0 +1,75 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+func Test_Pin_LockFileFrozen(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), "digester.lock.yaml")
+	writeTestFile(t, lockFile, `apiVersion: digester.k8s.io/v1alpha1
+kind: ImageLock
+images:
+- image: nginx:1.25
+  digest: `+testDigest+`
+  registry: index.docker.io
+  resolvedAt: 2021-06-01T12:00:00Z
+`)
+
+	stdout, err := executePin(t, testDeployment, "--lock-file", lockFile, "--lock-mode", LockModeFrozen)
+	if err != nil {
+		t.Fatalf("pin failed: %v", err)
+	}
+	if want := strings.Replace(testDeployment, "nginx:1.25", "nginx:1.25@"+testDigest, 1); stdout != want {
+		t.Errorf("wanted:\n%s\ngot:\n%s", want, stdout)
+	}
+
+	_, err = executePin(t, strings.Replace(testDeployment, "nginx:1.25", "nginx:1.24", 1), "--lock-file", lockFile, "--lock-mode", LockModeFrozen)
+	if err == nil || !strings.Contains(err.Error(), "could not resolve 1 image references") {
+		t.Errorf("wanted error for image that is not in the lock file, got %v", err)
+	}
+}
+
+func Test_Pin_LockFileFrozenMissing(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), "missing.yaml")
+	if _, err := executePin(t, testDeployment, "--lock-file", lockFile, "--lock-mode", LockModeFrozen); err == nil {
+		t.Errorf("wanted error for missing lock file")
+	}
+}
+
+func Test_Pin_LockFileUpdateWritesFile(t *testing.T) {
+	stubResolveImageTags(t)
+	lockFile := filepath.Join(t.TempDir(), "digester.lock.yaml")
+
+	if _, err := executePin(t, testDeployment, "--lock-file", lockFile); err != nil {
+		t.Fatalf("pin failed: %v", err)
+	}
+
+	if _, err := resolve.LoadLock(lockFile, true); err != nil {
+		t.Errorf("wanted lock file to be written: %v", err)
+	}
+}
+
+func Test_Pin_UnknownLockMode(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), "digester.lock.yaml")
+	if _, err := executePin(t, testDeployment, "--lock-file", lockFile, "--lock-mode", "read"); err == nil || !strings.Contains(err.Error(), "unknown lock mode read") {
+		t.Errorf("wanted unknown lock mode error, got %v", err)
+	}
+}
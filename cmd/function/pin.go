@@ -0,0 +1,182 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/logging"
+)
+
+// PinCmd creates the command that resolves image tags to digests in
+// manifest files and directories, or in a YAML stream on stdin, without
+// kpt or kustomize.
+func PinCmd(ctx context.Context) *cobra.Command {
+	var outputDir string
+	cmd := &cobra.Command{
+		Use:   "pin [PATH...]",
+		Short: "Resolve image tags to digests in manifest files",
+		Long: "Resolve image tags to digests in Kubernetes manifests in " +
+			"YAML files and directories, recursively. Files are rewritten " +
+			"in place, or written to the output directory, preserving " +
+			"comments and formatting. Files from different PATHs must " +
+			"not have the same path relative to their PATH in the output " +
+			"directory.\n\nWith no PATH, or when PATH is -, " +
+			"read a multi-document YAML stream from stdin and write the " +
+			"result to stdout.",
+		Example: "  digester pin deploy/\n" +
+			"  digester pin --output-dir pinned/ deployment.yaml service.yaml\n" +
+			"  kubectl create deployment app --image nginx --dry-run=client -o yaml | digester pin",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			log := logging.CreateStdLogger("digester")
+			return printError(cmd, pin(ctx, log, cmd.InOrStdin(), cmd.OutOrStdout(), cmd.ErrOrStderr(), args, outputDir))
+		},
+	}
+	cmd.Flags().StringVar(&outputDir, "output-dir", "", "(optional) directory where the resolved manifests are written, instead of rewriting the files in place")
+	addResolverFlags(cmd)
+	return cmd
+}
+
+// pin resolves the image tags in the resources in the paths, or in stdin if
+// there are no paths. Resources are written even if some image tags could
+// not be resolved. Warnings and errors are written to stderr, and pin fails
+// if there are errors.
+func pin(ctx context.Context, log logr.Logger, stdin io.Reader, stdout io.Writer, stderr io.Writer, paths []string, outputDir string) error {
+	r, err := newResolver(ctx, log, functionConfig{})
+	if err != nil {
+		return err
+	}
+	defer r.close()
+	var results framework.Results
+	filter := kio.FilterFunc(func(nodes []*yaml.RNode) ([]*yaml.RNode, error) {
+		results = append(results, r.resolveAll(nodes)...)
+		return nodes, nil
+	})
+	if isStdin(paths) {
+		err := kio.Pipeline{
+			Inputs:  []kio.Reader{&kio.ByteReader{Reader: stdin, PreserveSeqIndent: true}},
+			Filters: []kio.Filter{filter},
+			Outputs: []kio.Writer{kio.ByteWriter{Writer: stdout}},
+		}.Execute()
+		if err != nil {
+			return err
+		}
+		if err := r.saveLock(); err != nil {
+			return err
+		}
+		return reportResults(stderr, results)
+	}
+	if outputDir != "" {
+		if err := checkOutputPaths(paths); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(outputDir, 0o755); err != nil {
+			return fmt.Errorf("could not create output directory %s: %w", outputDir, err)
+		}
+	}
+	for _, path := range paths {
+		writePath := path
+		if outputDir != "" {
+			writePath = outputDir
+		}
+		err := kio.Pipeline{
+			Inputs: []kio.Reader{kio.LocalPackageReader{
+				PackagePath:        path,
+				IncludeSubpackages: true,
+				PreserveSeqIndent:  true,
+			}},
+			Filters: []kio.Filter{filter},
+			Outputs: []kio.Writer{kio.LocalPackageWriter{PackagePath: writePath}},
+		}.Execute()
+		if err != nil {
+			return fmt.Errorf("could not pin images in %s: %w", path, err)
+		}
+		log.V(1).Info("pinned images", "path", path, "output", filepath.Clean(writePath))
+		if r.failFast && results.ExitCode() != 0 {
+			break
+		}
+	}
+	if err := r.saveLock(); err != nil {
+		return err
+	}
+	return reportResults(stderr, results)
+}
+
+// checkOutputPaths returns an error if files from different paths would be
+// written to the same file in the output directory, e.g., `a/deploy.yaml`
+// and `b/deploy.yaml`, because the last file would silently win.
+func checkOutputPaths(paths []string) error {
+	if len(paths) < 2 {
+		return nil
+	}
+	sources := map[string]string{}
+	for _, path := range paths {
+		nodes, err := kio.LocalPackageReader{PackagePath: path, IncludeSubpackages: true}.Read()
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", path, err)
+		}
+		for _, n := range nodes {
+			file, _, err := kioutil.GetFileAnnotations(n)
+			if err != nil {
+				return fmt.Errorf("could not read path annotation in %s: %w", path, err)
+			}
+			if source, exists := sources[file]; exists && source != path {
+				return fmt.Errorf("%s and %s both contain %s, and would be written to the same file in the output directory", source, path, file)
+			}
+			sources[file] = path
+		}
+	}
+	return nil
+}
+
+// printError writes the error to stderr, and returns it. The root command
+// silences errors, because the KRM function reports errors in results.
+func printError(cmd *cobra.Command, err error) error {
+	if err != nil {
+		fmt.Fprintf(cmd.ErrOrStderr(), "Error: %v\n", err)
+	}
+	return err
+}
+
+// reportResults writes the warning and error results, and returns an error
+// if there are error results.
+func reportResults(w io.Writer, results framework.Results) error {
+	var errorCount int
+	for _, result := range results {
+		if result.Severity == framework.Info {
+			continue
+		}
+		if result.Severity == framework.Error {
+			errorCount++
+		}
+		fmt.Fprintln(w, result.String())
+	}
+	if errorCount > 0 {
+		return fmt.Errorf("could not resolve %d image references", errorCount)
+	}
+	return nil
+}
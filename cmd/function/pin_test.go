@@ -0,0 +1,173 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+const (
+	testDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+	testDeployment = `# Deployment of the app
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: nginx:1.25 # pinned by CI
+`
+
+	testService = `apiVersion: v1
+kind: Service
+metadata:
+  name: app
+spec:
+  ports:
+    - port: 80
+`
+)
+
+func Test_Pin_Directory(t *testing.T) {
+	stubResolveImageTags(t)
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "deployment.yaml"), testDeployment)
+	writeTestFile(t, filepath.Join(dir, "nested", "service.yaml"), testService)
+
+	if _, err := executePin(t, "", dir); err != nil {
+		t.Fatalf("pin failed: %v", err)
+	}
+
+	want := strings.Replace(testDeployment, "nginx:1.25", "nginx:1.25@"+testDigest, 1)
+	assertFile(t, filepath.Join(dir, "deployment.yaml"), want)
+	assertFile(t, filepath.Join(dir, "nested", "service.yaml"), testService)
+}
+
+func Test_Pin_OutputDir(t *testing.T) {
+	stubResolveImageTags(t)
+	dir := t.TempDir()
+	input := filepath.Join(dir, "deployment.yaml")
+	writeTestFile(t, input, testDeployment)
+	outputDir := filepath.Join(dir, "out")
+
+	if _, err := executePin(t, "", "--output-dir", outputDir, input); err != nil {
+		t.Fatalf("pin failed: %v", err)
+	}
+
+	assertFile(t, input, testDeployment)
+	want := strings.Replace(testDeployment, "nginx:1.25", "nginx:1.25@"+testDigest, 1)
+	assertFile(t, filepath.Join(outputDir, "deployment.yaml"), want)
+}
+
+func Test_Pin_OutputDir_Collision(t *testing.T) {
+	stubResolveImageTags(t)
+	dir := t.TempDir()
+	inputA := filepath.Join(dir, "a")
+	inputB := filepath.Join(dir, "b")
+	writeTestFile(t, filepath.Join(inputA, "deployment.yaml"), testDeployment)
+	writeTestFile(t, filepath.Join(inputB, "deployment.yaml"), testDeployment)
+	outputDir := filepath.Join(dir, "out")
+
+	_, err := executePin(t, "", "--output-dir", outputDir, inputA, inputB)
+
+	if err == nil || !strings.Contains(err.Error(), "would be written to the same file") {
+		t.Errorf("wanted collision error, got %v", err)
+	}
+	if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+		t.Errorf("wanted no output directory, got %v", err)
+	}
+}
+
+func Test_Pin_Stdin(t *testing.T) {
+	stubResolveImageTags(t)
+
+	stdout, err := executePin(t, testDeployment+"---\n"+testService)
+	if err != nil {
+		t.Fatalf("pin failed: %v", err)
+	}
+
+	want := strings.Replace(testDeployment, "nginx:1.25", "nginx:1.25@"+testDigest, 1) + "---\n" + testService
+	if stdout != want {
+		t.Errorf("wanted:\n%s\ngot:\n%s", want, stdout)
+	}
+}
+
+// stubResolveImageTags appends a digest to the container images of
+// Deployments, without calling a registry.
+func stubResolveImageTags(t *testing.T) {
+	t.Helper()
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, n *yaml.RNode, _ []string, _ ...resolve.Option) error {
+		containers, err := n.Pipe(yaml.Lookup("spec", "template", "spec", "containers"))
+		if err != nil || containers == nil {
+			return err
+		}
+		return containers.VisitElements(func(container *yaml.RNode) error {
+			image := container.Field("image")
+			if image == nil {
+				return nil
+			}
+			image.Value.YNode().Value += "@" + testDigest
+			return nil
+		})
+	}
+	t.Cleanup(func() { resolveImageTags = resolve.ImageTags })
+}
+
+func executePin(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+	cmd := PinCmd(context.Background())
+	var stdout bytes.Buffer
+	cmd.SetIn(strings.NewReader(stdin))
+	cmd.SetOut(&stdout)
+	cmd.SetArgs(args)
+	err := cmd.Execute()
+	return stdout.String(), err
+}
+
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("could not create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+}
+
+func assertFile(t *testing.T, path string, want string) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read file: %v", err)
+	}
+	if string(got) != want {
+		t.Errorf("%s: wanted:\n%s\ngot:\n%s", path, want, string(got))
+	}
+}
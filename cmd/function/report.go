@@ -0,0 +1,284 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+	"github.com/google/k8s-digester/pkg/version"
+)
+
+// Formats of the check report.
+const (
+	FormatText  = "text"
+	FormatJSON  = "json"
+	FormatSARIF = "sarif"
+)
+
+// Rules of the check report, one for every kind of violation.
+const (
+	ruleUnpinnedImage    = "unpinned-image"
+	ruleDigestMismatch   = "digest-mismatch"
+	ruleResolutionFailed = "resolution-failed"
+)
+
+var ruleDescriptions = map[string]string{
+	ruleUnpinnedImage:    "Container image reference does not have a digest",
+	ruleDigestMismatch:   "Container image digest does not match the digest of the tag in the registry",
+	ruleResolutionFailed: "Container image tag could not be resolved to a digest",
+}
+
+// finding is a violation of the check for one image reference.
+type finding struct {
+	Rule       string `json:"rule"`
+	File       string `json:"file,omitempty"`
+	Line       int    `json:"line,omitempty"`
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Field      string `json:"field,omitempty"`
+	Image      string `json:"image,omitempty"`
+	// Digest is the digest of the tag in the registry, for digest mismatches.
+	Digest  string `json:"digest,omitempty"`
+	Message string `json:"message"`
+}
+
+// report is the JSON check report.
+type report struct {
+	Violations int       `json:"violations"`
+	Findings   []finding `json:"findings"`
+}
+
+// newFindings creates findings for the image references in the resource that
+// are not pinned, do not match the registry, or could not be checked.
+func newFindings(n *yaml.RNode, file string, results []resolve.Result, err error) []finding {
+	resource := finding{
+		File:       file,
+		APIVersion: n.GetApiVersion(),
+		Kind:       n.GetKind(),
+		Namespace:  n.GetNamespace(),
+		Name:       n.GetName(),
+	}
+	var findings []finding
+	if err != nil {
+		f := resource
+		f.Rule = ruleResolutionFailed
+		f.Message = err.Error()
+		findings = append(findings, f)
+	}
+	for _, result := range results {
+		f := resource
+		f.Line = result.Line
+		f.Field = result.Field
+		f.Image = result.Image
+		switch result.Status {
+		case resolve.StatusUnpinned:
+			f.Rule = ruleUnpinnedImage
+			f.Message = fmt.Sprintf("image %s does not have a digest", result.Image)
+		case resolve.StatusMismatch:
+			f.Rule = ruleDigestMismatch
+			f.Digest = result.Digest
+			f.Message = fmt.Sprintf("image %s does not match the digest %s of the tag in the registry", result.Image, result.Digest)
+		case resolve.StatusFailed:
+			f.Rule = ruleResolutionFailed
+			f.Message = result.Err.Error()
+		default:
+			continue
+		}
+		findings = append(findings, f)
+	}
+	return findings
+}
+
+// validateFormat returns an error if the report format is unknown.
+func validateFormat(format string) error {
+	switch format {
+	case FormatText, FormatJSON, FormatSARIF:
+		return nil
+	default:
+		return fmt.Errorf("unknown format %s, must be one of %s, %s, or %s", format, FormatText, FormatJSON, FormatSARIF)
+	}
+}
+
+// writeReport writes the findings in the format.
+func writeReport(w io.Writer, format string, findings []finding) error {
+	if err := validateFormat(format); err != nil {
+		return err
+	}
+	switch format {
+	case FormatText:
+		return writeTextReport(w, findings)
+	case FormatJSON:
+		if findings == nil {
+			findings = []finding{}
+		}
+		return writeJSON(w, report{Violations: len(findings), Findings: findings})
+	default:
+		return writeJSON(w, newSARIFLog(findings))
+	}
+}
+
+// writeTextReport writes one line per finding.
+func writeTextReport(w io.Writer, findings []finding) error {
+	for _, f := range findings {
+		var prefix string
+		if f.File != "" {
+			prefix = f.File + ": "
+			if f.Line > 0 {
+				prefix = fmt.Sprintf("%s:%d: ", f.File, f.Line)
+			}
+		}
+		resource := strings.Join(nonEmpty(f.Kind, f.Namespace, f.Name), "/")
+		if _, err := fmt.Fprintf(w, "%s%s %s: %s\n", prefix, resource, f.Field, f.Message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("could not write report: %w", err)
+	}
+	return nil
+}
+
+func nonEmpty(values ...string) []string {
+	var result []string
+	for _, value := range values {
+		if value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// SARIF 2.1.0 types, limited to the properties used by the check report.
+// Ref: https://docs.oasis-open.org/sarif/sarif/v2.1.0/sarif-v2.1.0.html
+
+const (
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	sarifVersion = "2.1.0"
+)
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version,omitempty"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation *sarifPhysicalLocation `json:"physicalLocation,omitempty"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+type sarifLogicalLocation struct {
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind,omitempty"`
+}
+
+// newSARIFLog creates a SARIF log with one result per finding.
+func newSARIFLog(findings []finding) sarifLog {
+	driver := sarifDriver{
+		Name:           "digester",
+		Version:        version.Version,
+		InformationURI: "https://github.com/google/k8s-digester",
+	}
+	for _, id := range []string{ruleUnpinnedImage, ruleDigestMismatch, ruleResolutionFailed} {
+		driver.Rules = append(driver.Rules, sarifRule{ID: id, ShortDescription: sarifMessage{Text: ruleDescriptions[id]}})
+	}
+	results := []sarifResult{}
+	for _, f := range findings {
+		location := sarifLocation{
+			LogicalLocations: []sarifLogicalLocation{{
+				FullyQualifiedName: strings.Join(nonEmpty(f.Kind, f.Namespace, f.Name, f.Field), "/"),
+				Kind:               "resource",
+			}},
+		}
+		if f.File != "" {
+			location.PhysicalLocation = &sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: f.File},
+			}
+			if f.Line > 0 {
+				location.PhysicalLocation.Region = &sarifRegion{StartLine: f.Line}
+			}
+		}
+		results = append(results, sarifResult{
+			RuleID:    f.Rule,
+			Level:     "error",
+			Message:   sarifMessage{Text: f.Message},
+			Locations: []sarifLocation{location},
+		})
+	}
+	return sarifLog{
+		Schema:  sarifSchema,
+		Version: sarifVersion,
+		Runs:    []sarifRun{{Tool: sarifTool{Driver: driver}, Results: results}},
+	}
+}
@@ -0,0 +1,414 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/metrics"
+	"github.com/google/k8s-digester/pkg/resolve"
+	"github.com/google/k8s-digester/pkg/tracing"
+	"github.com/google/k8s-digester/pkg/util"
+)
+
+var resolveImageTags = resolve.ImageTags // override for unit testing
+
+// resolver resolves image tags in resources, using the settings from the
+// function config, flags, and environment variables.
+type resolver struct {
+	ctx          context.Context
+	log          logr.Logger
+	config       *rest.Config
+	skipPrefixes []string
+	ignoreErrors bool
+	failFast     bool
+	lock         *resolve.Lock // nil if there is no lock file to update
+	lockFile     string
+	lkg          *resolve.LastKnownGood // nil if there is no last-known-good file
+	lkgFile      string
+	opts         []resolve.Option
+	cleanup      []func()
+}
+
+// newResolver reads the settings. Settings in the function config take
+// precedence over flags and environment variables. Call close when done.
+func newResolver(ctx context.Context, log logr.Logger, fnConfig functionConfig) (*resolver, error) {
+	offline := viper.GetBool("offline")
+	if fnConfig.Offline != nil {
+		offline = *fnConfig.Offline
+	}
+	skipPrefixes := util.StringArray(viper.GetString("skip-prefixes"))
+	if fnConfig.SkipPrefixes != nil {
+		skipPrefixes = fnConfig.SkipPrefixes
+	}
+	resolutionMode := fnConfig.resolutionMode(viper.GetString("resolution-mode"))
+	platformValue := viper.GetString("platform")
+	if fnConfig.Platform != "" {
+		platformValue = fnConfig.Platform
+	}
+	ignoreErrors := viper.GetBool("ignore-errors")
+	if fnConfig.IgnoreErrors != nil {
+		ignoreErrors = *fnConfig.IgnoreErrors
+	}
+	failFast := viper.GetBool("fail-fast")
+	if fnConfig.FailFast != nil {
+		failFast = *fnConfig.FailFast
+	}
+	lockFile := viper.GetString("lock-file")
+	if fnConfig.LockFile != "" {
+		lockFile = fnConfig.LockFile
+	}
+	lockMode := viper.GetString("lock-mode")
+	if fnConfig.LockMode != "" {
+		lockMode = fnConfig.LockMode
+	}
+	localImages := util.StringArray(viper.GetString("local-images"))
+	if fnConfig.LocalImages != nil {
+		localImages = fnConfig.LocalImages
+	}
+	registryFallback := viper.GetBool("registry-fallback")
+	if fnConfig.RegistryFallback != nil {
+		registryFallback = *fnConfig.RegistryFallback
+	}
+	registryMirrors := viper.GetString("registry-mirrors")
+	if fnConfig.RegistryMirrorsFile != "" {
+		registryMirrors = fnConfig.RegistryMirrorsFile
+	}
+	rewriteToMirror := viper.GetBool("rewrite-to-mirror")
+	if fnConfig.RewriteToMirror != nil {
+		rewriteToMirror = *fnConfig.RewriteToMirror
+	}
+	versionRanges := viper.GetBool("version-ranges")
+	if fnConfig.VersionRanges != nil {
+		versionRanges = *fnConfig.VersionRanges
+	}
+	log.V(2).Info("kubeconfig", "kubeconfig", viper.GetString("kubeconfig"))
+	log.V(2).Info("offline", "offline", offline)
+	log.V(2).Info("skip-prefixes", "skip-prefixes", skipPrefixes)
+	log.V(2).Info("field-specs", "field-specs", viper.GetString("field-specs"))
+	log.V(2).Info("resolution-mode", "resolution-mode", resolutionMode, "platform", platformValue)
+	log.V(2).Info("ignore-errors", "ignore-errors", ignoreErrors, "fail-fast", failFast)
+	log.V(2).Info("lock", "lock-file", lockFile, "lock-mode", lockMode)
+	log.V(2).Info("local-images", "local-images", localImages, "registry-fallback", registryFallback)
+	log.V(2).Info("registry-mirrors", "registry-mirrors", registryMirrors, "rewrite-to-mirror", rewriteToMirror)
+	log.V(2).Info("version-ranges", "version-ranges", versionRanges)
+	log.V(2).Info("retry", "max-retries", viper.GetInt("max-retries"), "retry-initial-backoff", viper.GetDuration("retry-initial-backoff"), "retry-max-backoff", viper.GetDuration("retry-max-backoff"))
+	log.V(2).Info("timeouts", "resolve-timeout", viper.GetDuration("resolve-timeout"), "registry-timeout", viper.GetDuration("registry-timeout"), "registry-timeouts", viper.GetString("registry-timeouts"))
+	log.V(2).Info("circuit-breaker", "circuit-breaker-threshold", viper.GetInt("circuit-breaker-threshold"), "circuit-breaker-open-duration", viper.GetDuration("circuit-breaker-open-duration"))
+	log.V(2).Info("last-known-good", "last-known-good-file", viper.GetString("last-known-good-file"), "last-known-good-max-age", viper.GetDuration("last-known-good-max-age"))
+	log.V(2).Info("concurrency", "concurrency", viper.GetInt("concurrency"))
+	log.V(2).Info("annotations", "annotations", viper.GetBool("annotations"))
+	log.V(2).Info("cache", "cache-size", viper.GetInt("cache-size"), "cache-ttl", viper.GetDuration("cache-ttl"))
+	r := &resolver{
+		ctx:          ctx,
+		log:          log,
+		skipPrefixes: skipPrefixes,
+		ignoreErrors: ignoreErrors,
+		failFast:     failFast,
+	}
+	shutdownTracing, err := tracing.Setup(ctx, "digester-function", viper.GetString("trace-exporter"), viper.GetString("trace-file"))
+	if err != nil {
+		return nil, err
+	}
+	r.cleanup = append(r.cleanup, func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Error(err, "could not shut down tracing")
+		}
+	})
+	if !offline {
+		var kubeconfig string
+		kubeconfigs := util.StringArray(viper.GetString("kubeconfig"))
+		if len(kubeconfigs) > 0 {
+			kubeconfig = kubeconfigs[0]
+		}
+		r.config, err = createConfig(log, kubeconfig)
+		if err != nil {
+			r.close()
+			return nil, fmt.Errorf("could not create k8s client config: %w", err)
+		}
+	}
+	platform, err := resolve.TargetPlatform(resolutionMode, platformValue)
+	if err != nil {
+		r.close()
+		return nil, err
+	}
+	var fieldSpecs []resolve.FieldSpec
+	if viper.GetString("field-specs") != "" {
+		fieldSpecs, err = resolve.LoadFieldSpecs(viper.GetString("field-specs"))
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+	}
+	mirrors := fnConfig.RegistryMirrors
+	if mirrors == nil && registryMirrors != "" {
+		mirrors, err = resolve.LoadMirrors(registryMirrors)
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+	}
+	var registryTimeouts map[string]time.Duration
+	if viper.GetString("registry-timeouts") != "" {
+		registryTimeouts, err = resolve.ParseRegistryTimeouts(viper.GetString("registry-timeouts"))
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+	}
+	var cache resolve.Cache
+	if viper.GetDuration("cache-ttl") > 0 {
+		cache = resolve.NewLRUCache(viper.GetInt("cache-size"), viper.GetDuration("cache-ttl"))
+	}
+	r.opts = []resolve.Option{
+		resolve.WithCache(cache),
+		resolve.WithConcurrency(viper.GetInt("concurrency")),
+		resolve.WithFieldSpecs(fieldSpecs),
+		resolve.WithPlatform(platform),
+		resolve.WithAnnotations(viper.GetBool("annotations")),
+		resolve.WithMirrors(mirrors),
+		resolve.WithRewriteToMirror(rewriteToMirror),
+		resolve.WithVersionRanges(versionRanges),
+		resolve.WithRetry(resolve.RetryPolicy{
+			MaxRetries:     viper.GetInt("max-retries"),
+			InitialBackoff: viper.GetDuration("retry-initial-backoff"),
+			MaxBackoff:     viper.GetDuration("retry-max-backoff"),
+		}),
+		resolve.WithTimeout(viper.GetDuration("resolve-timeout")),
+		resolve.WithRegistryTimeouts(viper.GetDuration("registry-timeout"), registryTimeouts),
+		resolve.WithCircuitBreaker(resolve.NewCircuitBreaker(viper.GetInt("circuit-breaker-threshold"), viper.GetDuration("circuit-breaker-open-duration"))),
+	}
+	if len(localImages) > 0 {
+		resolver, err := resolve.NewLocalResolver(localImages)
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+		if registryFallback {
+			resolver = resolve.ChainResolvers(resolver, resolve.RegistryResolver)
+		}
+		r.opts = append(r.opts, resolve.WithResolver(resolver))
+	}
+	if lockFile != "" {
+		if err := validateLockMode(lockMode); err != nil {
+			r.close()
+			return nil, err
+		}
+		frozen := lockMode == LockModeFrozen
+		lock, err := resolve.LoadLock(lockFile, frozen)
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+		r.opts = append(r.opts, resolve.WithLock(lock, frozen))
+		if !frozen {
+			r.lock = lock
+			r.lockFile = lockFile
+		}
+	}
+	if lkgFile := viper.GetString("last-known-good-file"); lkgFile != "" {
+		lkg := resolve.NewLastKnownGood(viper.GetDuration("last-known-good-max-age"))
+		if err := lkg.LoadFile(lkgFile); err != nil {
+			r.close()
+			return nil, err
+		}
+		r.opts = append(r.opts, resolve.WithLastKnownGood(lkg))
+		r.lkg = lkg
+		r.lkgFile = lkgFile
+	}
+	if viper.GetBool("stats") {
+		registry := prometheus.NewRegistry()
+		if err := metrics.Register(registry); err != nil {
+			r.close()
+			return nil, err
+		}
+		r.cleanup = append(r.cleanup, func() {
+			if err := metrics.WriteSummary(os.Stderr, registry); err != nil {
+				log.Error(err, "could not write stats")
+			}
+		})
+	}
+	return r, nil
+}
+
+// resolve resolves the image tags in the resource, and returns the function
+// results. Image references that cannot be resolved keep their tags.
+func (r *resolver) resolve(n *yaml.RNode, opts ...resolve.Option) framework.Results {
+	results, err := r.results(n, opts...)
+	return functionResults(n, results, err, r.ignoreErrors)
+}
+
+// results resolves the image tags in the resource, and returns a result for
+// every image reference.
+func (r *resolver) results(n *yaml.RNode, opts ...resolve.Option) ([]resolve.Result, error) {
+	var results []resolve.Result
+	// Concatenate into a new slice, because r.opts can have spare capacity
+	// that calls for other resources would share.
+	opts = slices.Concat(r.opts, []resolve.Option{resolve.WithResults(&results), resolve.WithContinueOnError(true)}, opts)
+	err := resolveImageTags(r.ctx, r.log, r.config, n, r.skipPrefixes, opts...)
+	return results, err
+}
+
+// resolveAll resolves the image tags in the resources, and returns the
+// function results. If failFast is set, it stops at the first resource with
+// an error result.
+func (r *resolver) resolveAll(nodes []*yaml.RNode) framework.Results {
+	var results framework.Results
+	for _, n := range nodes {
+		nodeResults := r.resolve(n)
+		results = append(results, nodeResults...)
+		if r.failFast && nodeResults.ExitCode() != 0 {
+			r.log.V(1).Info("stopping at first error", "kind", n.GetKind(), "name", n.GetName())
+			break
+		}
+	}
+	return results
+}
+
+// saveLock writes the lock file, if the lock mode is update, and the
+// last-known-good file, if digests were recorded.
+func (r *resolver) saveLock() error {
+	if r.lock != nil {
+		r.log.V(1).Info("writing lock file", "lock-file", r.lockFile)
+		if err := r.lock.Save(r.lockFile); err != nil {
+			return err
+		}
+	}
+	if r.lkg != nil && r.lkg.TakeChanged() {
+		r.log.V(1).Info("writing last-known-good file", "last-known-good-file", r.lkgFile)
+		return r.lkg.SaveFile(r.lkgFile)
+	}
+	return nil
+}
+
+// close writes stats, if enabled, and flushes traces.
+func (r *resolver) close() {
+	for i := len(r.cleanup) - 1; i >= 0; i-- {
+		r.cleanup[i]()
+	}
+}
+
+// addResolverFlags adds the flags that configure the resolver to the
+// command. The flags are bound to viper keys when the command runs, so that
+// several commands can define the same flags.
+func addResolverFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.String("kubeconfig", getKubeconfigDefault(),
+		"(optional) absolute path to the kubeconfig file. Requires offline=false.")
+	flags.Bool("offline", true,
+		"do not connect to Kubernetes API server to retrieve imagePullSecrets")
+	flags.String("skip-prefixes", "", "(optional) image prefixes that should not be resolved to digests, colon separated")
+	flags.String("field-specs", "", "(optional) path to a YAML file with additional field specs for image references")
+	flags.String("resolution-mode", resolve.ResolutionModeIndex, "resolve tags of multi-platform images to the digest of the image index (index) or of the image manifest for the target platform (platform)")
+	flags.String("platform", "linux/amd64", "target platform for resolution-mode=platform, e.g., linux/arm64")
+	flags.Bool("ignore-errors", false, "report errors as warnings and leave image tags unresolved, instead of failing")
+	flags.Bool("fail-fast", false, "stop at the first resource with an error, instead of resolving the images in all resources")
+	flags.String("lock-file", "", "(optional) path to a lock file that records the digests of the resolved image tags")
+	flags.String("lock-mode", LockModeUpdate, "with a lock file, resolve image tags using registries and add the digests to the lock file (update), or resolve image tags exclusively from the lock file (frozen)")
+	flags.String("local-images", "", "(optional) OCI image layout directories, image tarballs, or directories of image tarballs to resolve image tags from, colon separated")
+	flags.Bool("registry-fallback", true, "with local-images, resolve image tags that are not in the local images using the registry")
+	flags.String("registry-mirrors", "", "(optional) path to a YAML file with registry mirrors to try before the source registries")
+	flags.Bool("rewrite-to-mirror", false, "replace the registry of resolved image references with the mirror that resolved the tag")
+	flags.Bool("version-ranges", false, "resolve image tags that are semantic version ranges, such as ~1.4 or ^2, to the highest matching tag in the registry")
+	flags.Int("max-retries", resolve.DefaultRetryPolicy.MaxRetries, "maximum number of retries of registry requests that fail with HTTP status 408, 429, or 5xx")
+	flags.Duration("retry-initial-backoff", resolve.DefaultRetryPolicy.InitialBackoff, "wait time before the first retry of a registry request, doubled for every retry")
+	flags.Duration("retry-max-backoff", resolve.DefaultRetryPolicy.MaxBackoff, "maximum wait time between retries of registry requests, also if the registry sends a longer Retry-After header")
+	flags.Duration("resolve-timeout", 0, "how long resolving the image tags in a resource may take, 0 means no limit")
+	flags.Duration("registry-timeout", 0, "how long every attempt to resolve an image tag using a registry may take, 0 means no limit")
+	flags.String("registry-timeouts", "", "(optional) registry timeouts for specific registry hosts, e.g., gcr.io=3s,docker.io=5s")
+	flags.Int("circuit-breaker-threshold", 0, "number of consecutive failures after which image tags from a registry fail fast, 0 disables the circuit breaker")
+	flags.Duration("circuit-breaker-open-duration", 30*time.Second, "how long image tags from a registry fail fast before a request probes the registry again")
+	flags.String("last-known-good-file", "", "(optional) path to a file that records resolved digests, and provides them when registries are unavailable")
+	flags.Duration("last-known-good-max-age", 24*time.Hour, "maximum age of last-known-good digests, 0 means no limit")
+	flags.Int("concurrency", 8, "maximum number of image tags to resolve in parallel for each resource")
+	flags.Int("cache-size", 1000, "maximum number of resolved digests and repository tag lists to cache")
+	flags.Duration("cache-ttl", 0, "how long to cache resolved digests and repository tag lists, 0 disables the cache")
+	flags.Bool("annotations", false, "record the original image references and the resolution time as annotations on resources")
+	flags.Bool("stats", false, "print resolution, registry latency, and cache statistics to stderr")
+	flags.String("trace-exporter", tracing.ExporterNone, "OpenTelemetry trace exporter, one of none, otlp, or file. Configure otlp using the OTEL_EXPORTER_OTLP_* environment variables")
+	flags.String("trace-file", "", "path to the file where the file trace exporter writes spans")
+	preRunE := cmd.PreRunE
+	cmd.PreRunE = func(cmd *cobra.Command, args []string) error {
+		if err := bindResolverFlags(cmd); err != nil {
+			return err
+		}
+		if preRunE != nil {
+			return preRunE(cmd, args)
+		}
+		return nil
+	}
+}
+
+// resolverEnvVars are the environment variables of the resolver flags.
+var resolverEnvVars = map[string]string{
+	"kubeconfig":                    "KUBECONFIG",
+	"offline":                       "OFFLINE",
+	"skip-prefixes":                 "SKIP_PREFIXES",
+	"field-specs":                   "FIELD_SPECS",
+	"resolution-mode":               "RESOLUTION_MODE",
+	"platform":                      "PLATFORM",
+	"ignore-errors":                 "IGNORE_ERRORS",
+	"fail-fast":                     "FAIL_FAST",
+	"lock-file":                     "LOCK_FILE",
+	"lock-mode":                     "LOCK_MODE",
+	"local-images":                  "LOCAL_IMAGES",
+	"registry-fallback":             "REGISTRY_FALLBACK",
+	"registry-mirrors":              "REGISTRY_MIRRORS",
+	"rewrite-to-mirror":             "REWRITE_TO_MIRROR",
+	"version-ranges":                "VERSION_RANGES",
+	"max-retries":                   "MAX_RETRIES",
+	"retry-initial-backoff":         "RETRY_INITIAL_BACKOFF",
+	"retry-max-backoff":             "RETRY_MAX_BACKOFF",
+	"resolve-timeout":               "RESOLVE_TIMEOUT",
+	"registry-timeout":              "REGISTRY_TIMEOUT",
+	"registry-timeouts":             "REGISTRY_TIMEOUTS",
+	"circuit-breaker-threshold":     "CIRCUIT_BREAKER_THRESHOLD",
+	"circuit-breaker-open-duration": "CIRCUIT_BREAKER_OPEN_DURATION",
+	"last-known-good-file":          "LAST_KNOWN_GOOD_FILE",
+	"last-known-good-max-age":       "LAST_KNOWN_GOOD_MAX_AGE",
+	"concurrency":                   "CONCURRENCY",
+	"cache-size":                    "CACHE_SIZE",
+	"cache-ttl":                     "CACHE_TTL",
+	"annotations":                   "ANNOTATIONS",
+	"stats":                         "STATS",
+	"trace-exporter":                "TRACE_EXPORTER",
+	"trace-file":                    "TRACE_FILE",
+}
+
+// bindResolverFlags binds the resolver flags of the command to viper keys
+// of the same name, and to environment variables.
+func bindResolverFlags(cmd *cobra.Command) error {
+	for key, envVar := range resolverEnvVars {
+		if err := viper.BindPFlag(key, cmd.Flags().Lookup(key)); err != nil {
+			return fmt.Errorf("could not bind flag %s: %w", key, err)
+		}
+		if err := viper.BindEnv(key, envVar); err != nil {
+			return fmt.Errorf("could not bind environment variable %s: %w", envVar, err)
+		}
+	}
+	return nil
+}
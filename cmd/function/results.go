@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+// functionResults creates function results for the resolution results of the
+// resource. Resolved image references are info results, or warning results
+// if they were resolved to last-known-good digests. Image references that
+// could not be resolved, and other errors, are error results, or warning
+// results if errors are ignored. Pinned and skipped image references
+// have no results.
+func functionResults(n *yaml.RNode, results []resolve.Result, err error, ignoreErrors bool) framework.Results {
+	failureSeverity := framework.Error
+	if ignoreErrors {
+		failureSeverity = framework.Warning
+	}
+	ref := resourceRef(n)
+	file := fileRef(n)
+	var fnResults framework.Results
+	if err != nil {
+		fnResults = append(fnResults, &framework.Result{
+			Message:     err.Error(),
+			Severity:    failureSeverity,
+			ResourceRef: ref,
+			File:        file,
+		})
+	}
+	for _, result := range results {
+		fnResult := &framework.Result{
+			ResourceRef: ref,
+			File:        file,
+			Field: &framework.Field{
+				Path:         result.Field,
+				CurrentValue: result.Image,
+			},
+		}
+		switch result.Status {
+		case resolve.StatusResolved:
+			pinned := result.Digest
+			if result.Selected != "" {
+				pinned = result.Selected + "@" + result.Digest
+			}
+			fnResult.Field.ProposedValue = result.Resolved
+			if result.Stale {
+				fnResult.Message = fmt.Sprintf("resolved image %s to last-known-good digest %s resolved at %s, because the registry is unavailable: %v", result.Image, pinned, result.ResolvedAt.UTC().Format(time.RFC3339), result.Err)
+				fnResult.Severity = framework.Warning
+				break
+			}
+			fnResult.Message = fmt.Sprintf("resolved image %s to digest %s", result.Image, result.Digest)
+			if result.Selected != "" {
+				fnResult.Message = fmt.Sprintf("resolved image %s to %s, the highest matching tag, with digest %s", result.Image, result.Selected, result.Digest)
+			}
+			fnResult.Severity = framework.Info
+		case resolve.StatusFailed:
+			fnResult.Message = result.Err.Error()
+			fnResult.Severity = failureSeverity
+		default:
+			continue
+		}
+		fnResults = append(fnResults, fnResult)
+	}
+	return fnResults
+}
+
+// resourceRef creates a reference to the resource.
+func resourceRef(n *yaml.RNode) *yaml.ResourceIdentifier {
+	return &yaml.ResourceIdentifier{
+		TypeMeta: yaml.TypeMeta{APIVersion: n.GetApiVersion(), Kind: n.GetKind()},
+		NameMeta: yaml.NameMeta{Name: n.GetName(), Namespace: n.GetNamespace()},
+	}
+}
+
+// fileRef creates a reference to the file that contains the resource, or
+// nil if the resource does not have a path annotation.
+func fileRef(n *yaml.RNode) *framework.File {
+	path, index, err := kioutil.GetFileAnnotations(n)
+	if err != nil || path == "" {
+		return nil
+	}
+	file := &framework.File{Path: path}
+	file.Index, _ = strconv.Atoi(index)
+	return file
+}
@@ -0,0 +1,221 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package function
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/kustomize/kyaml/fn/framework"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+const testResourceList = `apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+items:
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: broken
+    annotations:
+      config.kubernetes.io/path: pods/broken.yaml
+      config.kubernetes.io/index: "0"
+  spec:
+    containers:
+    - name: app
+      image: bad:1.0
+- apiVersion: v1
+  kind: Pod
+  metadata:
+    name: ok
+    annotations:
+      config.kubernetes.io/path: pods/ok.yaml
+  spec:
+    containers:
+    - name: app
+      image: nginx:1.25
+`
+
+func Test_Function_KeepGoing(t *testing.T) {
+	stubResolveImageTagsWithResults(t)
+
+	stdout, err := executeFunction(t, testResourceList)
+
+	var results framework.Results
+	if !errors.As(err, &results) {
+		t.Fatalf("wanted error results, got %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("wanted 2 results, got %d: %v", len(results), results)
+	}
+	failed := results[0]
+	if failed.Severity != framework.Error || failed.ResourceRef.Name != "broken" ||
+		failed.File == nil || failed.File.Path != "pods/broken.yaml" ||
+		failed.Field == nil || failed.Field.Path != "spec.containers[name=app].image" {
+		t.Errorf("wanted error result for broken pod with file and field path, got %+v", failed)
+	}
+	resolved := results[1]
+	if resolved.Severity != framework.Info || resolved.ResourceRef.Name != "ok" || resolved.Field.ProposedValue != "nginx:1.25@"+testDigest {
+		t.Errorf("wanted info result for ok pod, got %+v", resolved)
+	}
+	if !strings.Contains(stdout, "nginx:1.25@"+testDigest) {
+		t.Errorf("wanted resolved image in output, got:\n%s", stdout)
+	}
+}
+
+func Test_Function_FailFast(t *testing.T) {
+	stubResolveImageTagsWithResults(t)
+	t.Setenv("FAIL_FAST", "true")
+
+	_, err := executeFunction(t, testResourceList)
+
+	var results framework.Results
+	if !errors.As(err, &results) {
+		t.Fatalf("wanted error results, got %v", err)
+	}
+	if len(results) != 1 || results[0].ResourceRef.Name != "broken" {
+		t.Errorf("wanted only the result for the broken pod, got %v", results)
+	}
+}
+
+func Test_Function_NoErrors(t *testing.T) {
+	stubResolveImageTagsWithResults(t)
+
+	stdout, err := executeFunction(t, strings.Replace(testResourceList, "bad:1.0", "nginx:1.24", 1))
+	if err != nil {
+		t.Fatalf("wanted no error, got %v", err)
+	}
+	if !strings.Contains(stdout, "severity: info") {
+		t.Errorf("wanted info results in output, got:\n%s", stdout)
+	}
+}
+
+func Test_Pin_ErrorsWriteResolvedFiles(t *testing.T) {
+	stubResolveImageTagsWithResults(t)
+	input := testDeployment + "---\n" + strings.Replace(testDeployment, "nginx:1.25", "bad:1.0", 1)
+
+	stdout, err := executePin(t, input)
+
+	if err == nil || !strings.Contains(err.Error(), "could not resolve 1 image references") {
+		t.Errorf("wanted error for one image reference, got %v", err)
+	}
+	if !strings.Contains(stdout, "nginx:1.25@"+testDigest) {
+		t.Errorf("wanted resolved image in output, got:\n%s", stdout)
+	}
+}
+
+// stubResolveImageTagsWithResults resolves the images in containers to
+// testDigest, except images that start with `bad`, and reports the results
+// like resolve.ImageTags.
+func stubResolveImageTagsWithResults(t *testing.T) {
+	t.Helper()
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, n *yaml.RNode, _ []string, opts ...resolve.Option) error {
+		f := &resolve.ImageTagFilter{}
+		for _, opt := range opts {
+			opt(f)
+		}
+		containers, err := n.Pipe(yaml.LookupFirstMatch([][]string{{"spec", "containers"}, {"spec", "template", "spec", "containers"}}))
+		if err != nil || containers == nil {
+			return err
+		}
+		return containers.VisitElements(func(container *yaml.RNode) error {
+			name := yaml.GetValue(container.Field("name").Value)
+			image := container.Field("image").Value
+			result := resolve.Result{
+				Field: "spec.containers[name=" + name + "].image",
+				List:  "containers",
+				Name:  name,
+				Image: image.YNode().Value,
+			}
+			if strings.HasPrefix(result.Image, "bad") {
+				result.Status = resolve.StatusFailed
+				result.Err = &resolve.ResolveError{Image: result.Image, Err: errors.New("not found")}
+			} else {
+				result.Status = resolve.StatusResolved
+				result.Digest = testDigest
+				result.Resolved = result.Image + "@" + testDigest
+				image.YNode().Value = result.Resolved
+			}
+			*f.Results = append(*f.Results, result)
+			return nil
+		})
+	}
+	t.Cleanup(func() { resolveImageTags = resolve.ImageTags })
+}
+
+func Test_functionResults_Stale(t *testing.T) {
+	n := yaml.MustParse("apiVersion: v1\nkind: Pod\nmetadata:\n  name: ok\n")
+	results := functionResults(n, []resolve.Result{{
+		Field:      "spec.containers[name=app].image",
+		Image:      "nginx:1.25",
+		Digest:     testDigest,
+		Status:     resolve.StatusResolved,
+		Resolved:   "nginx:1.25@" + testDigest,
+		Err:        errors.New("unavailable"),
+		Stale:      true,
+		ResolvedAt: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+	}}, nil, false)
+
+	if len(results) != 1 || results[0].Severity != framework.Warning || results[0].Field.ProposedValue != "nginx:1.25@"+testDigest {
+		t.Fatalf("wanted warning result with proposed value, got %v", results)
+	}
+	if !strings.Contains(results[0].Message, "last-known-good digest "+testDigest+" resolved at 2021-06-01T12:00:00Z") {
+		t.Errorf("wanted last-known-good message, got %s", results[0].Message)
+	}
+	if results.ExitCode() != 0 {
+		t.Errorf("wanted exit code 0 for stale digest, got %d", results.ExitCode())
+	}
+}
+
+func Test_functionResults_VersionRange(t *testing.T) {
+	n := yaml.MustParse("apiVersion: v1\nkind: Pod\nmetadata:\n  name: ok\n")
+	results := functionResults(n, []resolve.Result{{
+		Field:    "spec.containers[name=app].image",
+		Image:    "myapp:~1.4",
+		Digest:   testDigest,
+		Status:   resolve.StatusResolved,
+		Selected: "myapp:1.4.7",
+		Resolved: "myapp:1.4.7@" + testDigest,
+	}}, nil, false)
+
+	if len(results) != 1 || results[0].Severity != framework.Info || results[0].Field.ProposedValue != "myapp:1.4.7@"+testDigest {
+		t.Fatalf("wanted info result with selected tag, got %v", results)
+	}
+	if want := "resolved image myapp:~1.4 to myapp:1.4.7, the highest matching tag, with digest " + testDigest; results[0].Message != want {
+		t.Errorf("wanted message %q, got %q", want, results[0].Message)
+	}
+}
+
+func Test_functionResults_RewriteToMirror(t *testing.T) {
+	n := yaml.MustParse("apiVersion: v1\nkind: Pod\nmetadata:\n  name: ok\n")
+	results := functionResults(n, []resolve.Result{{
+		Field:    "spec.containers[name=app].image",
+		Image:    "nginx:1.25",
+		Digest:   testDigest,
+		Status:   resolve.StatusResolved,
+		Resolved: "mirror.gcr.io/library/nginx:1.25@" + testDigest,
+	}}, nil, false)
+
+	if len(results) != 1 || results[0].Field.ProposedValue != "mirror.gcr.io/library/nginx:1.25@"+testDigest {
+		t.Fatalf("wanted info result with mirror reference as proposed value, got %v", results)
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/open-policy-agent/cert-controller/pkg/rotator"
@@ -26,30 +28,60 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
-	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	"github.com/google/k8s-digester/pkg/handler"
 	"github.com/google/k8s-digester/pkg/logging"
+	"github.com/google/k8s-digester/pkg/metrics"
+	"github.com/google/k8s-digester/pkg/resolve"
+	"github.com/google/k8s-digester/pkg/tracing"
 	"github.com/google/k8s-digester/pkg/util"
 )
 
+// Default timeouts for resolving image tags. The admission webhooks have
+// timeoutSeconds: 15, and the timeouts leave time to respond, and to try a
+// second registry mirror.
 const (
-	caName             = "digester-ca"
-	caOrganization     = "digester"
-	defaultCertDir     = "/certs"
-	defaultMetricsAddr = ":8888"
-	defaultHealthAddr  = ":9090"
-	defaultPort        = 8443
-	secretName         = "digester-webhook-server-cert"            // matches the Secret name
-	serviceName        = "digester-webhook-service"                // matches the Service name
-	webhookName        = "digester-mutating-webhook-configuration" // matches the MutatingWebhookConfiguration name
-	webhookPath        = "/v1/mutate"                              // matches the MutatingWebhookConfiguration clientConfig path
+	defaultRegistryTimeout = 5 * time.Second
+	defaultResolveTimeout  = 12 * time.Second
+)
+
+// Default circuit breaker settings. The circuit breaker is disabled by
+// default, so that upgrades do not change how the webhook fails.
+const (
+	defaultCircuitThreshold    = 0
+	defaultCircuitOpenDuration = 30 * time.Second
+)
+
+// defaultLastKnownGoodMaxAge is the maximum age of last-known-good digests
+// that are used when registries are unavailable.
+const defaultLastKnownGoodMaxAge = 24 * time.Hour
+
+const (
+	caName               = "digester-ca"
+	caOrganization       = "digester"
+	defaultCacheSize     = 1000
+	defaultCertDir       = "/certs"
+	defaultConcurrency   = 8
+	defaultConfigMapName = "digester-config"
+	defaultMetricsAddr   = ":8888"
+	defaultPlatform      = "linux/amd64"
+	defaultHealthAddr    = ":9090"
+	defaultPort          = 8443
+	secretName           = "digester-webhook-server-cert"            // matches the Secret name
+	serviceName          = "digester-webhook-service"                // matches the Service name
+	webhookName          = "digester-mutating-webhook-configuration" // matches the MutatingWebhookConfiguration name
+	webhookPath          = "/v1/mutate"                              // matches the MutatingWebhookConfiguration clientConfig path
+
+	validatingWebhookName = "digester-validating-webhook-configuration" // matches the ValidatingWebhookConfiguration name
+	validatingWebhookPath = "/v1/validate"                              // matches the ValidatingWebhookConfiguration clientConfig path
 )
 
 // Cmd is the webhook controller manager sub-command
@@ -68,31 +100,91 @@ var (
 			Name: webhookName,
 			Type: rotator.Mutating,
 		},
+		{
+			Name: validatingWebhookName,
+			Type: rotator.Validating,
+		},
 	}
 )
 
 var (
+	admissionWarnings   bool
+	configMapName       string
+	annotations         bool
+	auditAnnotations    bool
+	cacheSize           int
+	cacheTTL            time.Duration
 	certDir             string
+	circuitThreshold    int
+	circuitOpenDuration time.Duration
+	concurrency         int
 	disableCertRotation bool
 	dryRun              bool
+	fieldSpecsFile      string
 	healthAddr          string
 	metricsAddr         string
 	offline             bool
+	platform            string
+	policyFile          string
+	platformFromPod     bool
 	port                int
+	maxRetries          int
+	registryMirrorsFile string
+	registryTimeout     time.Duration
+	registryTimeouts    string
+	resolveTimeout      time.Duration
+	retryInitialBackoff time.Duration
+	retryMaxBackoff     time.Duration
+	resolutionMode      string
+	rewriteToMirror     bool
+	versionRanges       bool
 	ignoreErrors        bool
+	lastKnownGood       bool
+	lastKnownGoodMaxAge time.Duration
+	lastKnownGoodCM     string
 	skipPrefixes        string
+	traceExporter       string
+	traceFile           string
 )
 
 func init() {
+	Cmd.Flags().BoolVar(&admissionWarnings, "admission-warnings", false, "return an admission warning for every image tag resolved to a digest")
+	Cmd.Flags().BoolVar(&annotations, "annotations", false, "record the original image references and the resolution time as annotations on mutated resources")
+	Cmd.Flags().BoolVar(&auditAnnotations, "audit-annotations", false, "add an audit annotation for every image tag resolved to a digest")
+	Cmd.Flags().IntVar(&cacheSize, "cache-size", defaultCacheSize, "maximum number of resolved digests and repository tag lists to cache")
+	Cmd.Flags().DurationVar(&cacheTTL, "cache-ttl", 0, "how long to cache resolved digests and repository tag lists, 0 disables the cache")
+	Cmd.Flags().IntVar(&circuitThreshold, "circuit-breaker-threshold", defaultCircuitThreshold, "number of consecutive failures after which image tags from a registry fail fast, 0 disables the circuit breaker")
+	Cmd.Flags().DurationVar(&circuitOpenDuration, "circuit-breaker-open-duration", defaultCircuitOpenDuration, "how long image tags from a registry fail fast before a request probes the registry again")
+	Cmd.Flags().StringVar(&configMapName, "config-map", defaultConfigMapName, "name of a ConfigMap in the digester namespace with settings that override flags at runtime, empty disables")
 	Cmd.Flags().StringVar(&certDir, "cert-dir", defaultCertDir, "directory where TLS certificates and keys are stored")
+	Cmd.Flags().IntVar(&concurrency, "concurrency", defaultConcurrency, "maximum number of image tags to resolve in parallel for each request")
 	Cmd.Flags().BoolVar(&disableCertRotation, "disable-cert-rotation", false, "disable automatic generation and rotation of webhook TLS certificates/keys")
 	Cmd.Flags().BoolVar(&dryRun, "dry-run", false, "if true, do not mutate any resources")
+	Cmd.Flags().StringVar(&fieldSpecsFile, "field-specs", "", "(optional) path to a YAML file with additional field specs for image references")
 	Cmd.Flags().StringVar(&healthAddr, "health-addr", defaultHealthAddr, "health endpoint address")
 	Cmd.Flags().AddGoFlag(flag.Lookup("kubeconfig"))
+	Cmd.Flags().BoolVar(&lastKnownGood, "last-known-good", false, "pin image tags to their last-known-good digests when registries are unavailable")
+	Cmd.Flags().StringVar(&lastKnownGoodCM, "last-known-good-configmap", "", "name of a ConfigMap in the digester namespace that persists last-known-good digests, empty keeps them in memory only")
+	Cmd.Flags().DurationVar(&lastKnownGoodMaxAge, "last-known-good-max-age", defaultLastKnownGoodMaxAge, "maximum age of last-known-good digests, 0 means no limit")
+	Cmd.Flags().IntVar(&maxRetries, "max-retries", resolve.DefaultRetryPolicy.MaxRetries, "maximum number of retries of registry requests that fail with HTTP status 408, 429, or 5xx")
 	Cmd.Flags().StringVar(&metricsAddr, "metrics-addr", defaultMetricsAddr, "metrics endpoint address")
 	Cmd.Flags().BoolVar(&offline, "offline", false, "do not connect to API server to retrieve imagePullSecrets")
+	Cmd.Flags().StringVar(&platform, "platform", defaultPlatform, "target platform for resolution-mode=platform, e.g., linux/arm64")
+	Cmd.Flags().BoolVar(&platformFromPod, "platform-from-node-selector", false, "derive the target platform from the kubernetes.io/os and kubernetes.io/arch nodeSelector or node affinity of the pod spec, requires resolution-mode=platform")
+	Cmd.Flags().StringVar(&policyFile, "policy", "", "(optional) path to a YAML file with a policy that denies admission of resources with images that cannot be pinned")
 	Cmd.Flags().IntVar(&port, "port", defaultPort, "webhook server port")
+	Cmd.Flags().StringVar(&registryMirrorsFile, "registry-mirrors", "", "(optional) path to a YAML file with registry mirrors to try before the source registries")
+	Cmd.Flags().DurationVar(&registryTimeout, "registry-timeout", defaultRegistryTimeout, "how long every attempt to resolve an image tag using a registry may take, 0 means no limit")
+	Cmd.Flags().StringVar(&registryTimeouts, "registry-timeouts", "", "(optional) registry timeouts for specific registry hosts, e.g., gcr.io=3s,docker.io=5s")
+	Cmd.Flags().StringVar(&resolutionMode, "resolution-mode", resolve.ResolutionModeIndex, "resolve tags of multi-platform images to the digest of the image index (index) or of the image manifest for the target platform (platform)")
+	Cmd.Flags().DurationVar(&resolveTimeout, "resolve-timeout", defaultResolveTimeout, "how long resolving the image tags in a resource may take, in addition to the deadline of the admission request, 0 means no limit")
+	Cmd.Flags().DurationVar(&retryInitialBackoff, "retry-initial-backoff", resolve.DefaultRetryPolicy.InitialBackoff, "wait time before the first retry of a registry request, doubled for every retry")
+	Cmd.Flags().DurationVar(&retryMaxBackoff, "retry-max-backoff", resolve.DefaultRetryPolicy.MaxBackoff, "maximum wait time between retries of registry requests, also if the registry sends a longer Retry-After header")
+	Cmd.Flags().BoolVar(&versionRanges, "version-ranges", false, "resolve image tags that are semantic version ranges, such as ~1.4 or ^2, to the highest matching tag in the registry")
+	Cmd.Flags().BoolVar(&rewriteToMirror, "rewrite-to-mirror", false, "replace the registry of resolved image references with the mirror that resolved the tag")
 	Cmd.Flags().BoolVar(&ignoreErrors, "ignore-errors", false, "do not fail on webhook admission errors, just log them")
+	Cmd.Flags().StringVar(&traceExporter, "trace-exporter", tracing.ExporterNone, "OpenTelemetry trace exporter, one of none, otlp, or file. Configure otlp using the OTEL_EXPORTER_OTLP_* environment variables")
+	Cmd.Flags().StringVar(&traceFile, "trace-file", "", "path to the file where the file trace exporter writes spans")
 	Cmd.Flags().StringVar(&skipPrefixes, "skip-prefixes", "", "(optional) image prefixes that should not be resolved to digests, colon separated")
 }
 
@@ -104,6 +196,55 @@ func run(ctx context.Context) error {
 	defer syncLogger.Sync()
 	log := syncLogger.Log
 
+	targetPlatform, err := resolve.TargetPlatform(resolutionMode, platform)
+	if err != nil {
+		return err
+	}
+	var fieldSpecs []resolve.FieldSpec
+	if fieldSpecsFile != "" {
+		fieldSpecs, err = resolve.LoadFieldSpecs(fieldSpecsFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var mirrors []resolve.Mirror
+	if registryMirrorsFile != "" {
+		mirrors, err = resolve.LoadMirrors(registryMirrorsFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	var timeouts map[string]time.Duration
+	if registryTimeouts != "" {
+		timeouts, err = resolve.ParseRegistryTimeouts(registryTimeouts)
+		if err != nil {
+			return err
+		}
+	}
+
+	var policy *handler.Policy
+	if policyFile != "" {
+		policy, err = handler.LoadPolicy(policyFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := metrics.Register(ctrlmetrics.Registry); err != nil {
+		return err
+	}
+	shutdownTracing, err := tracing.Setup(ctx, "digester-webhook", traceExporter, traceFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Error(err, "could not shut down tracing")
+		}
+	}()
+
 	cfg, err := config.GetConfig()
 	if err != nil {
 		return fmt.Errorf("unable to get kubeconfig: %w", err)
@@ -113,13 +254,23 @@ func run(ctx context.Context) error {
 		return fmt.Errorf("could not add core/v1 Kubernetes resources to scheme: %w", err)
 	}
 	mgr, err := manager.New(cfg, manager.Options{
-		Scheme:         scheme,
+		Scheme: scheme,
+		// The webhook only reads its own ConfigMaps, so only cache ConfigMaps
+		// in the digester namespace.
+		Cache: cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				&corev1.ConfigMap{}: {
+					Namespaces: map[string]cache.Config{util.GetNamespace(): {}},
+				},
+			},
+		},
 		Logger:         log,
 		LeaderElection: false,
 		Metrics: metricsserver.Options{
 			BindAddress: metricsAddr,
 		},
-		HealthProbeBindAddress: healthAddr,
+		// The health endpoint is served by the health probe server below.
+		HealthProbeBindAddress: "0",
 		WebhookServer: webhook.NewServer(webhook.Options{
 			Port:    port,
 			CertDir: certDir,
@@ -128,11 +279,16 @@ func run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("unable to set up manager: %w", err)
 	}
-	if err := mgr.AddReadyzCheck("default", healthz.Ping); err != nil {
-		return fmt.Errorf("unable to create readyz check: %w", err)
-	}
-	if err := mgr.AddHealthzCheck("default", healthz.Ping); err != nil {
-		return fmt.Errorf("unable to create healthz check: %w", err)
+	breaker := resolve.NewCircuitBreaker(circuitThreshold, circuitOpenDuration)
+	if err := mgr.Add(&manager.Server{
+		Name: "health probe",
+		Server: &http.Server{
+			Addr:              healthAddr,
+			Handler:           handler.NewHealthHandler(breaker),
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}); err != nil {
+		return fmt.Errorf("unable to create health probe server: %w", err)
 	}
 	certSetupFinished := make(chan struct{})
 	if !disableCertRotation {
@@ -156,7 +312,78 @@ func run(ctx context.Context) error {
 		close(certSetupFinished)
 	}
 
-	go setupControllers(mgr, log, dryRun, ignoreErrors, certSetupFinished, util.StringArray(skipPrefixes))
+	var digestCache resolve.Cache
+	if cacheTTL > 0 {
+		log.Info("caching resolved digests", "size", cacheSize, "ttl", cacheTTL)
+		digestCache = resolve.NewLRUCache(cacheSize, cacheTTL)
+	}
+	var lkg *resolve.LastKnownGood
+	if lastKnownGood {
+		log.Info("using last-known-good digests when registries are unavailable", "maxAge", lastKnownGoodMaxAge)
+		lkg = resolve.NewLastKnownGood(lastKnownGoodMaxAge)
+		if lastKnownGoodCM != "" {
+			if err := mgr.Add(&handler.LastKnownGoodPersister{
+				Log:    log.WithName("last-known-good"),
+				Client: mgr.GetClient(),
+				Store:  lkg,
+				Key: types.NamespacedName{
+					Namespace: util.GetNamespace(),
+					Name:      lastKnownGoodCM,
+				},
+			}); err != nil {
+				return fmt.Errorf("unable to set up last-known-good persistence: %w", err)
+			}
+		}
+	}
+	whh := &handler.Handler{
+		Log:                      log.WithName("webhook"),
+		DryRun:                   dryRun,
+		IgnoreErrors:             ignoreErrors,
+		Config:                   mgr.GetConfig(),
+		Offline:                  offline,
+		SkipPrefixes:             util.StringArray(skipPrefixes),
+		Cache:                    digestCache,
+		Concurrency:              concurrency,
+		FieldSpecs:               fieldSpecs,
+		Platform:                 targetPlatform,
+		PlatformFromNodeSelector: platformFromPod,
+		Policy:                   policy,
+		Warnings:                 admissionWarnings,
+		AuditAnnotations:         auditAnnotations,
+		Annotations:              annotations,
+		Mirrors:                  mirrors,
+		RewriteToMirror:          rewriteToMirror,
+		VersionRanges:            versionRanges,
+		Retry: resolve.RetryPolicy{
+			MaxRetries:     maxRetries,
+			InitialBackoff: retryInitialBackoff,
+			MaxBackoff:     retryMaxBackoff,
+		},
+		Timeout:          resolveTimeout,
+		RegistryTimeout:  registryTimeout,
+		RegistryTimeouts: timeouts,
+		CircuitBreaker:   breaker,
+		LastKnownGood:    lkg,
+		Client:           mgr.GetClient(),
+		Recorder:         mgr.GetEventRecorderFor("digester"),
+	}
+	if configMapName != "" {
+		log.Info("watching config", "namespace", util.GetNamespace(), "configmap", configMapName)
+		if err := (&handler.ConfigReconciler{
+			Log:      log.WithName("config"),
+			Client:   mgr.GetClient(),
+			Recorder: mgr.GetEventRecorderFor("digester"),
+			Handler:  whh,
+			Key: types.NamespacedName{
+				Namespace: util.GetNamespace(),
+				Name:      configMapName,
+			},
+		}).SetupWithManager(mgr); err != nil {
+			return fmt.Errorf("unable to set up config controller: %w", err)
+		}
+	}
+
+	go setupControllers(mgr, log, whh, certSetupFinished)
 
 	log.Info("starting manager")
 	if err := mgr.Start(ctx); err != nil {
@@ -165,22 +392,14 @@ func run(ctx context.Context) error {
 	return nil
 }
 
-func setupControllers(mgr manager.Manager, log logr.Logger, dryRun bool, ignoreErrors bool, certSetupFinished chan struct{}, skipPrefixes []string) {
+func setupControllers(mgr manager.Manager, log logr.Logger, whh *handler.Handler, certSetupFinished chan struct{}) {
 	log.Info("waiting for cert rotation setup")
 	<-certSetupFinished
 	log.Info("done waiting for cert rotation setup")
-	var k8sClientConfig *rest.Config
-	if !offline {
-		k8sClientConfig = mgr.GetConfig()
-	}
-	whh := &handler.Handler{
-		Log:          log.WithName("webhook"),
-		DryRun:       dryRun,
-		IgnoreErrors: ignoreErrors,
-		Config:       k8sClientConfig,
-		SkipPrefixes: skipPrefixes,
-	}
 	mwh := &admission.Webhook{Handler: whh}
 	log.Info("starting webhook server", "path", webhookPath)
-	mgr.GetWebhookServer().Register(webhookPath, mwh)
+	mgr.GetWebhookServer().Register(webhookPath, tracing.Handler(mwh, webhookPath))
+	vwh := &admission.Webhook{Handler: &handler.Validator{Handler: whh}}
+	log.Info("starting webhook server", "path", validatingWebhookPath)
+	mgr.GetWebhookServer().Register(validatingWebhookPath, tracing.Handler(vwh, validatingWebhookPath))
 }
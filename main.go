@@ -40,6 +40,8 @@ func run() error {
 	cmd := function.Cmd(ctx)
 	cmd.AddCommand(
 		webhook.Cmd,
+		function.PinCmd(ctx),
+		function.CheckCmd(ctx),
 		version.Cmd,
 	)
 	return cmd.ExecuteContext(ctx)
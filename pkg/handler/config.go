@@ -0,0 +1,108 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"k8s.io/client-go/rest"
+
+	"github.com/google/k8s-digester/pkg/util"
+)
+
+// Keys of the DigesterConfig ConfigMap. The keys match the webhook flags.
+const (
+	configKeyDryRun       = "dry-run"
+	configKeyIgnoreErrors = "ignore-errors"
+	configKeyOffline      = "offline"
+	configKeySkipPrefixes = "skip-prefixes"
+)
+
+// Settings are the settings of the Handler that can be changed at runtime,
+// without restarting the webhook.
+type Settings struct {
+	DryRun       bool
+	IgnoreErrors bool
+	Offline      bool
+	SkipPrefixes []string
+}
+
+// SetSettings atomically replaces the settings of the Handler. Requests that
+// are in progress continue to use the previous settings. A nil value reverts
+// to the settings from the Handler fields.
+func (h *Handler) SetSettings(settings *Settings) {
+	h.settingsOverride.Store(settings)
+}
+
+// settings returns the current settings of the Handler.
+func (h *Handler) settings() Settings {
+	if settings := h.settingsOverride.Load(); settings != nil {
+		return *settings
+	}
+	return h.defaultSettings()
+}
+
+// defaultSettings returns the settings from the Handler fields, typically
+// set from command-line flags.
+func (h *Handler) defaultSettings() Settings {
+	return Settings{
+		DryRun:       h.DryRun,
+		IgnoreErrors: h.IgnoreErrors,
+		Offline:      h.Offline,
+		SkipPrefixes: h.SkipPrefixes,
+	}
+}
+
+// config returns the config, or nil if the settings are offline.
+func (s Settings) config(config *rest.Config) *rest.Config {
+	if s.Offline {
+		return nil
+	}
+	return config
+}
+
+// ParseSettings reads settings from the data of a DigesterConfig ConfigMap.
+// Keys that are not present keep their default values. Unknown keys and
+// invalid values are errors, so that typos do not go unnoticed.
+func ParseSettings(data map[string]string, defaults Settings) (Settings, error) {
+	settings := defaults
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := data[key]
+		var err error
+		switch key {
+		case configKeyDryRun:
+			settings.DryRun, err = strconv.ParseBool(value)
+		case configKeyIgnoreErrors:
+			settings.IgnoreErrors, err = strconv.ParseBool(value)
+		case configKeyOffline:
+			settings.Offline, err = strconv.ParseBool(value)
+		case configKeySkipPrefixes:
+			settings.SkipPrefixes = util.StringArray(value)
+		default:
+			return defaults, fmt.Errorf("unknown key %s", key)
+		}
+		if err != nil {
+			return defaults, fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+	}
+	return settings, nil
+}
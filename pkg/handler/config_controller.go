@@ -0,0 +1,86 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Reasons of the Events recorded on the DigesterConfig ConfigMap.
+const (
+	reasonConfigLoaded  = "ConfigLoaded"
+	reasonConfigInvalid = "ConfigInvalid"
+)
+
+// ConfigReconciler watches the DigesterConfig ConfigMap, and swaps its
+// settings into the Handler. If the ConfigMap is invalid, the Handler keeps
+// its previous settings, and the reconciler records a warning Event on the
+// ConfigMap. If the ConfigMap is deleted, the Handler reverts to the settings
+// from its fields.
+type ConfigReconciler struct {
+	Log      logr.Logger
+	Client   client.Client
+	Recorder record.EventRecorder
+	Handler  *Handler
+	Key      types.NamespacedName // namespace and name of the ConfigMap
+}
+
+var _ reconcile.Reconciler = &ConfigReconciler{}
+
+// Reconcile loads the settings from the ConfigMap.
+func (r *ConfigReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	configMap := &corev1.ConfigMap{}
+	if err := r.Client.Get(ctx, req.NamespacedName, configMap); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.Log.Info("config not found, using default settings", "configmap", req.NamespacedName)
+			r.Handler.SetSettings(nil)
+			return reconcile.Result{}, nil
+		}
+		return reconcile.Result{}, fmt.Errorf("could not get config %s: %w", req.NamespacedName, err)
+	}
+	settings, err := ParseSettings(configMap.Data, r.Handler.defaultSettings())
+	if err != nil {
+		r.Log.Error(err, "invalid config, keeping previous settings", "configmap", req.NamespacedName)
+		r.Recorder.Eventf(configMap, corev1.EventTypeWarning, reasonConfigInvalid, "Keeping previous settings: %v", err)
+		return reconcile.Result{}, nil // retrying will not fix the config
+	}
+	r.Log.Info("loaded config", "configmap", req.NamespacedName, "settings", settings)
+	r.Handler.SetSettings(&settings)
+	r.Recorder.Eventf(configMap, corev1.EventTypeNormal, reasonConfigLoaded, "Loaded settings from resourceVersion %s", configMap.ResourceVersion)
+	return reconcile.Result{}, nil
+}
+
+// SetupWithManager registers the reconciler with the manager, watching only
+// the ConfigMap identified by Key.
+func (r *ConfigReconciler) SetupWithManager(mgr manager.Manager) error {
+	return builder.ControllerManagedBy(mgr).
+		Named("digester-config").
+		For(&corev1.ConfigMap{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(o client.Object) bool {
+			return o.GetNamespace() == r.Key.Namespace && o.GetName() == r.Key.Name
+		}))).
+		Complete(r)
+}
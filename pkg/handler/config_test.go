@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+func Test_ParseSettings(t *testing.T) {
+	defaults := Settings{IgnoreErrors: true, SkipPrefixes: []string{"default/"}}
+
+	got, err := ParseSettings(map[string]string{
+		"dry-run":       "true",
+		"offline":       "true",
+		"skip-prefixes": "a/:b/",
+	}, defaults)
+
+	if err != nil {
+		t.Fatalf("could not parse settings: %v", err)
+	}
+	want := Settings{DryRun: true, IgnoreErrors: true, Offline: true, SkipPrefixes: []string{"a/", "b/"}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("settings mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_ParseSettings_Invalid(t *testing.T) {
+	for _, data := range []map[string]string{
+		{"dry-run": "maybe"},
+		{"dryRun": "true"},
+	} {
+		if _, err := ParseSettings(data, Settings{}); err == nil {
+			t.Errorf("wanted error for %v, got nil", data)
+		}
+	}
+}
+
+func Test_Handle_SettingsOverride(t *testing.T) {
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: "test",
+			Operation: admissionv1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"spec": {"containers": [{"image": "registry.example.com/repository/image:tag"}]}}`),
+			},
+		},
+	}
+	var gotSkipPrefixes []string
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, n *yaml.RNode, skipPrefixes []string, _ ...resolve.Option) error {
+		gotSkipPrefixes = skipPrefixes
+		return n.PipeE(yaml.Lookup("spec", "containers", "0", "image"), yaml.FieldSetter{StringValue: "registry.example.com/repository/image:tag@sha256:digest"})
+	}
+	h := &Handler{Log: log, SkipPrefixes: []string{"flag/"}}
+	h.SetSettings(&Settings{DryRun: true, SkipPrefixes: []string{"config/"}})
+
+	resp := h.Handle(ctx, req)
+
+	assertAdmissionAllowed(t, resp)
+	assertNoPatches(t, resp)
+	if diff := cmp.Diff([]string{"config/"}, gotSkipPrefixes); diff != "" {
+		t.Errorf("skip prefixes mismatch (-want +got):\n%s", diff)
+	}
+
+	h.SetSettings(nil)
+
+	resp = h.Handle(ctx, req)
+
+	assertMessage(t, resp, reasonPatched)
+	if diff := cmp.Diff([]string{"flag/"}, gotSkipPrefixes); diff != "" {
+		t.Errorf("skip prefixes mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_ConfigReconciler(t *testing.T) {
+	key := types.NamespacedName{Namespace: "digester-system", Name: "digester-config"}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+		Data:       map[string]string{"dry-run": "true"},
+	}
+	c := fake.NewClientBuilder().WithObjects(configMap).Build()
+	recorder := record.NewFakeRecorder(10)
+	h := &Handler{Log: log}
+	r := &ConfigReconciler{Log: log, Client: c, Recorder: recorder, Handler: h, Key: key}
+	req := reconcile.Request{NamespacedName: key}
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("could not reconcile: %v", err)
+	}
+	if !h.settings().DryRun {
+		t.Errorf("wanted dry-run from config")
+	}
+	assertEvent(t, recorder, reasonConfigLoaded)
+
+	configMap.Data = map[string]string{"dry-run": "maybe"}
+	if err := c.Update(ctx, configMap); err != nil {
+		t.Fatalf("could not update config map: %v", err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("could not reconcile: %v", err)
+	}
+	if !h.settings().DryRun {
+		t.Errorf("wanted previous settings to be kept for invalid config")
+	}
+	assertEvent(t, recorder, reasonConfigInvalid)
+
+	if err := c.Delete(ctx, configMap); err != nil {
+		t.Fatalf("could not delete config map: %v", err)
+	}
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("could not reconcile: %v", err)
+	}
+	if h.settings().DryRun {
+		t.Errorf("wanted default settings after config deletion")
+	}
+}
+
+func assertEvent(t *testing.T, recorder *record.FakeRecorder, wantReason string) {
+	t.Helper()
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, wantReason) {
+			t.Errorf("wanted event with reason %s, got %s", wantReason, event)
+		}
+	default:
+		t.Errorf("wanted event with reason %s, got none", wantReason)
+	}
+}
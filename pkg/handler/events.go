@@ -0,0 +1,120 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+// Reasons of the Events recorded on the objects in admission requests.
+const (
+	reasonDigestResolutionFailed = "DigestResolutionFailed"
+	reasonAdmissionErrorIgnored  = "AdmissionErrorIgnored"
+)
+
+// eventInterval is the minimum time between Events with the same reason for
+// the same object. Pods created by a crash-looping ReplicaSet share the
+// generateName, so they count as the same object.
+const eventInterval = time.Minute
+
+// eventLimiter drops Events for objects that recently had an Event with the
+// same reason. The zero value is ready to use.
+type eventLimiter struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// allow returns true if an Event with the key can be recorded now.
+func (l *eventLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last == nil {
+		l.last = map[string]time.Time{}
+	}
+	if last, exists := l.last[key]; exists && now.Sub(last) < eventInterval {
+		return false
+	}
+	if len(l.last) > 1000 {
+		for k, last := range l.last {
+			if now.Sub(last) >= eventInterval {
+				delete(l.last, k)
+			}
+		}
+	}
+	l.last[key] = now
+	return true
+}
+
+// recordError records a warning Event for the error on the object in the
+// admission request, if the error is a resolution failure, or if it is
+// ignored.
+func (h *Handler) recordError(settings Settings, req admission.Request, err error) {
+	var resolveErr *resolve.ResolveError
+	switch {
+	case errors.As(err, &resolveErr):
+		h.recordEvent(req, reasonDigestResolutionFailed, "Could not resolve image %s to a digest: %v", resolveErr.Image, resolveErr.Err)
+	case settings.IgnoreErrors:
+		h.recordEvent(req, reasonAdmissionErrorIgnored, "Digester ignored an error: %v", err)
+	}
+}
+
+// recordEvent records a warning Event on the object in the admission
+// request, unless there is no Recorder, the Event is rate-limited, or the
+// request is a dry run. The webhooks declare that they have no side effects,
+// so dry-run requests must not create Events.
+func (h *Handler) recordEvent(req admission.Request, reason string, messageFmt string, args ...interface{}) {
+	if h.Recorder == nil || (req.DryRun != nil && *req.DryRun) {
+		return
+	}
+	ref := involvedObject(req)
+	key := ref.Namespace + "/" + ref.Kind + "/" + ref.Name + "/" + reason
+	if !h.events.allow(key, time.Now()) {
+		h.Log.V(1).Info("dropped rate-limited event", "object", key)
+		return
+	}
+	h.Recorder.Eventf(ref, corev1.EventTypeWarning, reason, messageFmt, args...)
+}
+
+// involvedObject creates a reference to the object in the admission
+// request. If the object does not have a name yet, the reference uses the
+// generateName, such as the prefix of the names of Pods of a ReplicaSet.
+func involvedObject(req admission.Request) *corev1.ObjectReference {
+	ref := &corev1.ObjectReference{
+		APIVersion: metav1.GroupVersion{Group: req.Kind.Group, Version: req.Kind.Version}.String(),
+		Kind:       req.Kind.Kind,
+		Namespace:  req.Namespace,
+		Name:       req.Name,
+	}
+	var object metav1.PartialObjectMetadata
+	if err := json.Unmarshal(req.Object.Raw, &object); err == nil {
+		ref.UID = object.UID
+		if ref.Name == "" {
+			ref.Name = object.Name
+		}
+		if ref.Name == "" {
+			ref.Name = object.GenerateName
+		}
+	}
+	return ref
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+func createReplicaSetPodRequest() admission.Request {
+	return admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: "test",
+			Operation: admissionv1.Create,
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"kind": "Pod", "metadata": {"generateName": "app-7d4b9c8f5-"}, "spec": {"containers": [{"image": "registry.example.com/repository/image:tag"}]}}`),
+			},
+		},
+	}
+}
+
+func Test_Handle_EventOnResolutionFailure(t *testing.T) {
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, _ []string, _ ...resolve.Option) error {
+		return &resolve.ResolveError{Image: "registry.example.com/repository/image:tag", Err: fmt.Errorf("intentional error")}
+	}
+	recorder := record.NewFakeRecorder(10)
+	h := &Handler{Log: nullLog, IgnoreErrors: true, Recorder: recorder}
+
+	resp := h.Handle(ctx, createReplicaSetPodRequest())
+
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonErrorIgnored)
+	select {
+	case event := <-recorder.Events:
+		for _, want := range []string{reasonDigestResolutionFailed, "registry.example.com/repository/image:tag", "intentional error"} {
+			if !strings.Contains(event, want) {
+				t.Errorf("wanted event to contain %s, got %s", want, event)
+			}
+		}
+	default:
+		t.Fatalf("wanted event, got none")
+	}
+
+	h.Handle(ctx, createReplicaSetPodRequest())
+
+	if len(recorder.Events) > 0 {
+		t.Errorf("wanted second event to be rate-limited, got %s", <-recorder.Events)
+	}
+}
+
+func Test_Handle_EventOnIgnoredError(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	h := &Handler{Log: nullLog, IgnoreErrors: true, Recorder: recorder}
+
+	h.Handle(ctx, createAnnotatedPodRequest("test", `"digester.k8s.io/mode": "sometimes"`))
+
+	assertEvent(t, recorder, reasonAdmissionErrorIgnored)
+}
+
+func Test_Handle_NoEventForDryRun(t *testing.T) {
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, _ []string, _ ...resolve.Option) error {
+		return &resolve.ResolveError{Image: "registry.example.com/repository/image:tag", Err: fmt.Errorf("intentional error")}
+	}
+	recorder := record.NewFakeRecorder(10)
+	h := &Handler{Log: nullLog, IgnoreErrors: true, Recorder: recorder}
+	req := createReplicaSetPodRequest()
+	dryRun := true
+	req.DryRun = &dryRun
+
+	resp := h.Handle(ctx, req)
+
+	assertAdmissionAllowed(t, resp)
+	if len(recorder.Events) > 0 {
+		t.Errorf("wanted no event for dry-run request, got %s", <-recorder.Events)
+	}
+}
+
+func Test_eventLimiter(t *testing.T) {
+	var l eventLimiter
+	now := time.Now()
+
+	if !l.allow("a", now) {
+		t.Errorf("wanted first event allowed")
+	}
+	if l.allow("a", now.Add(eventInterval/2)) {
+		t.Errorf("wanted event within interval to be dropped")
+	}
+	if !l.allow("b", now) {
+		t.Errorf("wanted event for other key allowed")
+	}
+	if !l.allow("a", now.Add(eventInterval)) {
+		t.Errorf("wanted event after interval allowed")
+	}
+}
+
+func Test_involvedObject(t *testing.T) {
+	ref := involvedObject(createReplicaSetPodRequest())
+
+	if ref.APIVersion != "v1" || ref.Kind != "Pod" || ref.Namespace != "test" || ref.Name != "app-7d4b9c8f5-" {
+		t.Errorf("wanted reference to v1 Pod test/app-7d4b9c8f5-, got %+v", ref)
+	}
+}
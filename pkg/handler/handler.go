@@ -17,25 +17,54 @@ package handler
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-logr/logr"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gomodules.xyz/jsonpatch/v2"
 	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 
+	"github.com/google/k8s-digester/pkg/metrics"
 	"github.com/google/k8s-digester/pkg/resolve"
+	"github.com/google/k8s-digester/pkg/tracing"
 	"github.com/google/k8s-digester/pkg/util"
 )
 
+// ephemeralContainersSubResource is the subresource used by `kubectl debug` to
+// add ephemeral containers to a running Pod.
+const ephemeralContainersSubResource = "ephemeralcontainers"
+
+// ephemeralContainersFieldSpecs are the locations of the image references
+// that requests to the ephemeralcontainers subresource can change.
+var ephemeralContainersFieldSpecs = []resolve.FieldSpec{{Path: "spec/ephemeralContainers[]/image"}}
+
 const (
 	reasonNoMutationForOperation = "NoMutationForOperation"
 	reasonNoSelfManagement       = "NoSelfManagement"
 	reasonErrorIgnored           = "ErrorIgnored"
 	reasonNotPatched             = "NotPatched"
 	reasonPatched                = "Patched"
+	reasonDenied                 = "Denied" // used in metrics only
+	reasonError                  = "Error"  // used in metrics only
+)
+
+// Names of the webhooks, used in metrics.
+const (
+	webhookMutate   = "mutate"
+	webhookValidate = "validate"
 )
 
 // Handler implements admission.Handler
@@ -44,20 +73,84 @@ type Handler struct {
 	DryRun       bool
 	IgnoreErrors bool
 	Config       *rest.Config
+	Offline      bool // do not use Config to retrieve imagePullSecrets
 	SkipPrefixes []string
+	Cache        resolve.Cache       // optional, shared across requests
+	Concurrency  int                 // maximum number of tags resolved in parallel per request
+	FieldSpecs   []resolve.FieldSpec // optional, locations of image references
+	Platform     *v1.Platform        // optional, target platform for multi-platform images
+	// PlatformFromNodeSelector derives the target platform from the
+	// nodeSelector or node affinity of the Pod spec. Requires Platform.
+	PlatformFromNodeSelector bool
+	// Policy optionally denies admission of resources with images that
+	// cannot be pinned.
+	Policy *Policy
+	// Warnings adds an admission warning for every image reference that was
+	// pinned to a digest.
+	Warnings bool
+	// AuditAnnotations adds an audit annotation for every image reference
+	// that was pinned to a digest.
+	AuditAnnotations bool
+	// Annotations records the original image references and the resolution
+	// time as annotations on mutated resources.
+	Annotations bool
+	// Mirrors optionally resolves image tags using registry mirrors. With
+	// RewriteToMirror, mutated image references point to the mirror that
+	// resolved the tag.
+	Mirrors         []resolve.Mirror
+	RewriteToMirror bool
+	// Retry configures retries of registry requests. Timeout limits the
+	// time of resolving the image tags in a resource, in addition to the
+	// deadline of the admission request. RegistryTimeout limits every
+	// attempt to resolve a tag, unless the registry host has a timeout in
+	// RegistryTimeouts. Zero timeouts mean no limit.
+	Retry            resolve.RetryPolicy
+	Timeout          time.Duration
+	RegistryTimeout  time.Duration
+	RegistryTimeouts map[string]time.Duration
+	// CircuitBreaker optionally fails fast for unavailable registries. It is
+	// shared across requests.
+	CircuitBreaker *resolve.CircuitBreaker
+	// LastKnownGood optionally provides the last-known-good digests of image
+	// tags when registries are unavailable. It is shared across requests.
+	LastKnownGood *resolve.LastKnownGood
+	// VersionRanges resolves image references with semantic version ranges
+	// as tags, such as `myapp:~1.4`, to the highest matching tag.
+	VersionRanges bool
+	// Recorder optionally records Events on the objects in admission
+	// requests, for resolution failures and ignored errors.
+	Recorder record.EventRecorder
+	// Client optionally reads namespaces to look up the AnnotationMode and
+	// AnnotationSkipContainers annotations. Use a cached client.
+	Client client.Reader
+
+	// settingsOverride replaces DryRun, IgnoreErrors, Offline, and
+	// SkipPrefixes at runtime, see SetSettings.
+	settingsOverride atomic.Pointer[Settings]
+	events           eventLimiter
 }
 
 var resolveImageTags = resolve.ImageTags // override for testing
 
 // Handle processes the AdmissionRequest by invoking the underlying function.
 func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.Response {
+	ctx, span := startSpan(ctx, "Handler.Handle", req)
+	resp := h.handle(ctx, req)
+	reason := responseReason(resp)
+	metrics.AdmissionResponses.WithLabelValues(webhookMutate, reason).Inc()
+	endSpan(span, resp, reason)
+	return resp
+}
+
+func (h *Handler) handle(ctx context.Context, req admission.Request) admission.Response {
 	h.Log.Info("received request", "name", req.Name, "namespace", req.Namespace, "gvk", req.Kind)
 	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
 		return admission.Allowed(reasonNoMutationForOperation)
 	}
+	settings := h.settings()
 	r, err := yaml.Parse(string(req.Object.Raw))
 	if err != nil {
-		return h.admissionError(err)
+		return h.admissionError(settings, req, err)
 	}
 	h.Log.V(1).Info("parsed resource", "resource", r)
 	if req.Namespace == util.GetNamespace() {
@@ -68,39 +161,203 @@ func (h *Handler) Handle(ctx context.Context, req admission.Request) admission.R
 	// request to the resource. This handles situations such as when the
 	// ReplicaSetController creates a new pod.
 	if err := r.SetNamespace(req.Namespace); err != nil {
-		h.admissionError(err)
+		h.admissionError(settings, req, err)
+	}
+	fieldSpecs := h.fieldSpecs(req.SubResource)
+	rule := h.Policy.match(req.Namespace, r.GetLabels())
+	if rule != nil {
+		images, err := resolve.Images(r, fieldSpecs)
+		if err != nil {
+			return h.admissionError(settings, req, err)
+		}
+		if violations := rule.check(images); len(violations) > 0 {
+			h.Log.Info("denied by policy", "rule", rule.Name, "violations", violations)
+			return rule.denied(violations)
+		}
+	}
+	s, err := h.scope(ctx, req.Namespace, r)
+	if err != nil {
+		return h.admissionError(settings, req, err)
+	}
+	denyUnresolvable := rule != nil && rule.DenyUnresolvable
+	if s.mode == ModeOff {
+		if denyUnresolvable {
+			// Resolve the image tags in a copy of the resource, so that the
+			// policy rule applies without mutating the images.
+			opts := h.resolveOptions(r, s, fieldSpecs)
+			if err := resolveImageTags(ctx, h.Log, settings.config(h.Config), r.Copy(), settings.SkipPrefixes, opts...); err != nil {
+				return h.denyUnresolvable(settings, req, rule, err)
+			}
+		}
+		return admission.Allowed(reasonModeOff)
 	}
 	before, err := r.MarshalJSON()
 	if err != nil {
-		return h.admissionError(err)
+		return h.admissionError(settings, req, err)
 	}
 
-	if err = resolveImageTags(ctx, h.Log, h.Config, r, h.SkipPrefixes); err != nil {
-		return h.admissionError(err)
+	var results []resolve.Result
+	// The policy rule also applies to the images of skipped containers, so
+	// their tags are resolved, but their images are not mutated.
+	opts := append(h.resolveOptions(r, s, fieldSpecs), resolve.WithResults(&results), resolve.WithResolveSkippedContainers(denyUnresolvable))
+	if err = resolveImageTags(ctx, h.Log, settings.config(h.Config), r, settings.SkipPrefixes, opts...); err != nil {
+		if denyUnresolvable {
+			return h.denyUnresolvable(settings, req, rule, err)
+		}
+		return h.admissionError(settings, req, err)
 	}
 
 	after, err := r.MarshalJSON()
 	if err != nil {
-		return h.admissionError(err)
+		return h.admissionError(settings, req, err)
 	}
 	patches, err := jsonpatch.CreatePatch(before, after)
 	if err != nil {
-		return h.admissionError(err)
+		return h.admissionError(settings, req, err)
+	}
+	if req.SubResource == ephemeralContainersSubResource {
+		// Requests to this subresource can only change ephemeral containers.
+		patches = filterPatches(patches, "/spec/ephemeralContainers/")
 	}
 	h.Log.V(1).Info("patched resource", "patches", patches)
-	if h.DryRun {
-		h.Log.Info("not mutating resource, because dry-run=true")
+	if s.dryRun(settings) {
+		h.Log.Info("not mutating resource, because of dry-run")
 		patches = []jsonpatch.JsonPatchOperation{}
 	}
 	reason := reasonPatched
 	if len(patches) == 0 {
 		reason = reasonNotPatched
 	}
-	return admission.Patched(reason, patches...)
+	resp := admission.Patched(reason, patches...)
+	if len(patches) > 0 {
+		h.describePatches(&resp, results, req.SubResource)
+	}
+	return resp
+}
+
+// describePatches adds warnings and audit annotations for the image
+// references that were pinned to digests, as configured. Image references
+// that were pinned to last-known-good digests always get a warning.
+func (h *Handler) describePatches(resp *admission.Response, results []resolve.Result, subResource string) {
+	for i, result := range results {
+		if result.Status != resolve.StatusResolved {
+			continue
+		}
+		if subResource == ephemeralContainersSubResource && result.List != "ephemeralContainers" {
+			continue
+		}
+		pinned := result.Digest
+		if result.Selected != "" {
+			pinned = result.Selected + "@" + result.Digest
+		}
+		if result.Stale {
+			// Always warn, because the digest may be outdated.
+			message := fmt.Sprintf("image %s in %s pinned to last-known-good digest %s resolved at %s, because the registry is unavailable: %v", result.Image, result.Field, pinned, result.ResolvedAt.UTC().Format(time.RFC3339), result.Err)
+			addResult(resp, auditAnnotationKey(result, i), message, true, h.AuditAnnotations)
+			continue
+		}
+		message := fmt.Sprintf("image %s in %s pinned to %s", result.Image, result.Field, pinned)
+		addResult(resp, auditAnnotationKey(result, i), message, h.Warnings, h.AuditAnnotations)
+	}
+}
+
+// fieldSpecs returns the locations of the image references to resolve and
+// check. Requests to the ephemeralcontainers subresource can only change
+// ephemeral containers, so the images of other containers are ignored, even
+// if they cannot be resolved.
+func (h *Handler) fieldSpecs(subResource string) []resolve.FieldSpec {
+	if subResource == ephemeralContainersSubResource {
+		return ephemeralContainersFieldSpecs
+	}
+	return h.FieldSpecs
+}
+
+// resolveOptions returns the options for resolving image tags in the resource,
+// at the locations identified by the field specs.
+func (h *Handler) resolveOptions(r *yaml.RNode, s scope, fieldSpecs []resolve.FieldSpec) []resolve.Option {
+	platform := h.Platform
+	if platform != nil && h.PlatformFromNodeSelector {
+		platform = resolve.PodPlatform(r, platform)
+		h.Log.V(1).Info("derived platform from pod spec", "platform", platform.String())
+	}
+	return []resolve.Option{
+		resolve.WithCache(h.Cache),
+		resolve.WithConcurrency(h.Concurrency),
+		resolve.WithFieldSpecs(fieldSpecs),
+		resolve.WithPlatform(platform),
+		resolve.WithAnnotations(h.Annotations),
+		resolve.WithSkipContainers(s.skipContainers),
+		resolve.WithMirrors(h.Mirrors),
+		resolve.WithRewriteToMirror(h.RewriteToMirror),
+		resolve.WithRetry(h.Retry),
+		resolve.WithTimeout(h.Timeout),
+		resolve.WithRegistryTimeouts(h.RegistryTimeout, h.RegistryTimeouts),
+		resolve.WithCircuitBreaker(h.CircuitBreaker),
+		resolve.WithLastKnownGood(h.LastKnownGood),
+		resolve.WithVersionRanges(h.VersionRanges),
+	}
+}
+
+// filterPatches returns the patches that apply to paths with the prefix.
+func filterPatches(patches []jsonpatch.JsonPatchOperation, pathPrefix string) []jsonpatch.JsonPatchOperation {
+	var filtered []jsonpatch.JsonPatchOperation
+	for _, patch := range patches {
+		if strings.HasPrefix(patch.Path, pathPrefix) {
+			filtered = append(filtered, patch)
+		}
+	}
+	return filtered
+}
+
+// responseReason returns a value with low cardinality that describes the
+// response, for use as a metric label. The message of allowed responses is
+// one of the reason constants.
+func responseReason(resp admission.Response) string {
+	switch {
+	case resp.Allowed && resp.Result != nil:
+		return resp.Result.Message
+	case resp.Result != nil && resp.Result.Code == http.StatusForbidden:
+		return reasonDenied
+	default:
+		return reasonError
+	}
+}
+
+// startSpan starts a span for the admission request. The context contains
+// the trace context propagated by the API server, if any.
+func startSpan(ctx context.Context, spanName string, req admission.Request) (context.Context, trace.Span) {
+	return tracing.Start(ctx, spanName, trace.WithAttributes(
+		attribute.String("namespace", req.Namespace),
+		attribute.String("name", req.Name),
+		attribute.String("kind", req.Kind.Kind),
+		attribute.String("operation", string(req.Operation)),
+	))
+}
+
+// endSpan records the reason of the response on the span, and ends the span.
+func endSpan(span trace.Span, resp admission.Response, reason string) {
+	span.SetAttributes(attribute.String("reason", reason))
+	var err error
+	if reason == reasonError {
+		err = errors.New(resp.Result.Message)
+	}
+	tracing.End(span, err)
+}
+
+// denyUnresolvable denies admission, because the policy rule denies images
+// that cannot be resolved, and resolving failed with the error.
+func (h *Handler) denyUnresolvable(settings Settings, req admission.Request, rule *PolicyRule, err error) admission.Response {
+	h.Log.Info("denied by policy", "rule", rule.Name, "error", err.Error())
+	h.recordError(settings, req, err)
+	return rule.denied([]metav1.StatusCause{{
+		Type:    causeUnresolvable,
+		Message: err.Error(),
+	}})
 }
 
-func (h *Handler) admissionError(err error) admission.Response {
-	if h.IgnoreErrors {
+func (h *Handler) admissionError(settings Settings, req admission.Request, err error) admission.Response {
+	h.recordError(settings, req, err)
+	if settings.IgnoreErrors {
 		h.Log.Error(err, "ignored admission error")
 		return admission.Allowed(reasonErrorIgnored)
 	}
@@ -16,11 +16,15 @@ package handler
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/authn"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"gomodules.xyz/jsonpatch/v2"
 	admissionv1 "k8s.io/api/admission/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -29,6 +33,7 @@ import (
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 
 	"github.com/google/k8s-digester/pkg/logging"
+	"github.com/google/k8s-digester/pkg/resolve"
 )
 
 var (
@@ -37,6 +42,25 @@ var (
 	log     = logging.CreateStdLogger("handler_test").V(2)
 )
 
+// fakeResolver resolves the image tags in the map to digests, and fails for
+// other image tags.
+type fakeResolver map[string]string
+
+func (r fakeResolver) Resolve(_ context.Context, image string, _ authn.Keychain, _ *v1.Platform) (string, error) {
+	if digest, exists := r[image]; exists {
+		return digest, nil
+	}
+	return "", fmt.Errorf("intentional error for %s", image)
+}
+
+// resolveImageTagsWithResolver returns an implementation of resolveImageTags
+// that uses resolve.ImageTags with the resolver, instead of the registry.
+func resolveImageTagsWithResolver(resolver resolve.Resolver) func(context.Context, logr.Logger, *rest.Config, *yaml.RNode, []string, ...resolve.Option) error {
+	return func(ctx context.Context, log logr.Logger, _ *rest.Config, n *yaml.RNode, skipPrefixes []string, opts ...resolve.Option) error {
+		return resolve.ImageTags(ctx, log, nil, n, skipPrefixes, append(opts, resolve.WithResolver(resolver))...)
+	}
+}
+
 func Test_Handle_NoPatchesForDelete(t *testing.T) {
 	req := admission.Request{
 		AdmissionRequest: admissionv1.AdmissionRequest{
@@ -122,7 +146,7 @@ func Test_Handle_NotPatchedWhenNoChange(t *testing.T) {
 			},
 		},
 	}
-	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, _ []string) error {
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, _ []string, _ ...resolve.Option) error {
 		return nil
 	}
 	h := &Handler{Log: log}
@@ -145,7 +169,7 @@ func Test_Handle_Patch(t *testing.T) {
 		},
 	}
 	imageWithDigest := "registry.example.com/repository/image:tag@sha256:digest"
-	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, n *yaml.RNode, _ []string) error {
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, n *yaml.RNode, _ []string, _ ...resolve.Option) error {
 		return n.PipeE(yaml.Lookup("spec", "containers", "0", "image"), yaml.FieldSetter{StringValue: imageWithDigest})
 	}
 	h := &Handler{Log: log}
@@ -164,6 +188,202 @@ func Test_Handle_Patch(t *testing.T) {
 	}
 }
 
+func Test_Handle_PatchWarningsAndAuditAnnotations(t *testing.T) {
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: "test",
+			Operation: admissionv1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"spec": {"containers": [{"name": "app", "image": "registry.example.com/repository/image:tag"}]}}`),
+			},
+		},
+	}
+	resolveImageTags = func(ctx context.Context, log logr.Logger, config *rest.Config, n *yaml.RNode, skipPrefixes []string, opts ...resolve.Option) error {
+		if err := n.PipeE(yaml.Lookup("spec", "containers", "0", "image"), yaml.FieldSetter{StringValue: "registry.example.com/repository/image:tag@sha256:digest"}); err != nil {
+			return err
+		}
+		return resolveImageTagsWithResults(resolve.Result{
+			Field:  "spec.containers[name=app].image",
+			List:   "containers",
+			Name:   "app",
+			Image:  "registry.example.com/repository/image:tag",
+			Digest: "sha256:digest",
+			Status: resolve.StatusResolved,
+		})(ctx, log, config, n, skipPrefixes, opts...)
+	}
+	h := &Handler{Log: log, Warnings: true, AuditAnnotations: true}
+
+	resp := h.Handle(ctx, req)
+
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonPatched)
+	wantMessage := "image registry.example.com/repository/image:tag in spec.containers[name=app].image pinned to sha256:digest"
+	if diff := cmp.Diff([]string{wantMessage}, resp.Warnings); diff != "" {
+		t.Errorf("warnings mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{"containers.app": wantMessage}, resp.AuditAnnotations); diff != "" {
+		t.Errorf("audit annotations mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_Handle_PatchVersionRangeWarning(t *testing.T) {
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: "test",
+			Operation: admissionv1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"spec": {"containers": [{"name": "app", "image": "registry.example.com/repository/image:~1.4"}]}}`),
+			},
+		},
+	}
+	resolveImageTags = func(ctx context.Context, log logr.Logger, config *rest.Config, n *yaml.RNode, skipPrefixes []string, opts ...resolve.Option) error {
+		if err := n.PipeE(yaml.Lookup("spec", "containers", "0", "image"), yaml.FieldSetter{StringValue: "registry.example.com/repository/image:1.4.7@sha256:digest"}); err != nil {
+			return err
+		}
+		return resolveImageTagsWithResults(resolve.Result{
+			Field:    "spec.containers[name=app].image",
+			List:     "containers",
+			Name:     "app",
+			Image:    "registry.example.com/repository/image:~1.4",
+			Digest:   "sha256:digest",
+			Status:   resolve.StatusResolved,
+			Selected: "registry.example.com/repository/image:1.4.7",
+		})(ctx, log, config, n, skipPrefixes, opts...)
+	}
+	h := &Handler{Log: log, Warnings: true}
+
+	resp := h.Handle(ctx, req)
+
+	assertAdmissionAllowed(t, resp)
+	wantMessage := "image registry.example.com/repository/image:~1.4 in spec.containers[name=app].image pinned to registry.example.com/repository/image:1.4.7@sha256:digest"
+	if diff := cmp.Diff([]string{wantMessage}, resp.Warnings); diff != "" {
+		t.Errorf("warnings mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_Handle_PatchStaleWarning(t *testing.T) {
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: "test",
+			Operation: admissionv1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"spec": {"containers": [{"name": "app", "image": "registry.example.com/repository/image:tag"}]}}`),
+			},
+		},
+	}
+	resolveImageTags = func(ctx context.Context, log logr.Logger, config *rest.Config, n *yaml.RNode, skipPrefixes []string, opts ...resolve.Option) error {
+		if err := n.PipeE(yaml.Lookup("spec", "containers", "0", "image"), yaml.FieldSetter{StringValue: "registry.example.com/repository/image:tag@sha256:digest"}); err != nil {
+			return err
+		}
+		return resolveImageTagsWithResults(resolve.Result{
+			Field:      "spec.containers[name=app].image",
+			List:       "containers",
+			Name:       "app",
+			Image:      "registry.example.com/repository/image:tag",
+			Digest:     "sha256:digest",
+			Status:     resolve.StatusResolved,
+			Err:        fmt.Errorf("unavailable"),
+			Stale:      true,
+			ResolvedAt: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		})(ctx, log, config, n, skipPrefixes, opts...)
+	}
+	h := &Handler{Log: log, Warnings: false, AuditAnnotations: true}
+
+	resp := h.Handle(ctx, req)
+
+	assertAdmissionAllowed(t, resp)
+	wantMessage := "image registry.example.com/repository/image:tag in spec.containers[name=app].image pinned to last-known-good digest sha256:digest resolved at 2021-06-01T12:00:00Z, because the registry is unavailable: unavailable"
+	if diff := cmp.Diff([]string{wantMessage}, resp.Warnings); diff != "" {
+		t.Errorf("warnings mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]string{"containers.app": wantMessage}, resp.AuditAnnotations); diff != "" {
+		t.Errorf("audit annotations mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_Handle_EphemeralContainersSubResource(t *testing.T) {
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace:   "test",
+			Operation:   admissionv1.Update,
+			SubResource: "ephemeralcontainers",
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"spec": {"containers": [{"image": "registry.example.com/repository/image:tag"}], "ephemeralContainers": [{"image": "registry.example.com/repository/debug:tag"}]}}`),
+			},
+		},
+	}
+	imageWithDigest := "registry.example.com/repository/image:tag@sha256:digest"
+	debugImageWithDigest := "registry.example.com/repository/debug:tag@sha256:digest"
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, n *yaml.RNode, _ []string, _ ...resolve.Option) error {
+		if err := n.PipeE(yaml.Lookup("spec", "containers", "0", "image"), yaml.FieldSetter{StringValue: imageWithDigest}); err != nil {
+			return err
+		}
+		return n.PipeE(yaml.Lookup("spec", "ephemeralContainers", "0", "image"), yaml.FieldSetter{StringValue: debugImageWithDigest})
+	}
+	h := &Handler{Log: log}
+
+	resp := h.Handle(ctx, req)
+
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonPatched)
+	if diff := cmp.Diff(resp.Patches, []jsonpatch.Operation{
+		jsonpatch.NewOperation("replace", "/spec/ephemeralContainers/0/image", debugImageWithDigest),
+	}); diff != "" {
+		t.Errorf("patch mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_Handle_EphemeralContainersSubResourceIgnoresOtherContainers(t *testing.T) {
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace:   "test",
+			Operation:   admissionv1.Update,
+			SubResource: "ephemeralcontainers",
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"kind": "Pod", "spec": {"containers": [{"name": "app", "image": "registry.example.com/repository/unresolvable:tag"}], "ephemeralContainers": [{"name": "debugger", "image": "registry.example.com/repository/debug:tag"}]}}`),
+			},
+		},
+	}
+	resolveImageTags = resolveImageTagsWithResolver(fakeResolver{
+		"registry.example.com/repository/debug:tag": "sha256:digest",
+	})
+	h := &Handler{
+		Log: log,
+		Policy: &Policy{Rules: []PolicyRule{{
+			Name:              "pinned",
+			DenyUnresolvable:  true,
+			AllowedRegistries: []string{"registry.example.com/repository/debug"},
+		}}},
+	}
+
+	resp := h.Handle(ctx, req)
+
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonPatched)
+	if diff := cmp.Diff(resp.Patches, []jsonpatch.Operation{
+		jsonpatch.NewOperation("replace", "/spec/ephemeralContainers/0/image", "registry.example.com/repository/debug:tag@sha256:digest"),
+	}); diff != "" {
+		t.Errorf("patch mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_responseReason(t *testing.T) {
+	tests := []struct {
+		resp admission.Response
+		want string
+	}{
+		{resp: admission.Allowed(reasonNotPatched), want: reasonNotPatched},
+		{resp: admission.Patched(reasonPatched), want: reasonPatched},
+		{resp: admission.Denied("image is not allowed"), want: reasonDenied},
+		{resp: admission.Errored(http.StatusInternalServerError, fmt.Errorf("intentional error")), want: reasonError},
+	}
+	for _, test := range tests {
+		if got := responseReason(test.resp); got != test.want {
+			t.Errorf("wanted %s, got %s", test.want, got)
+		}
+	}
+}
+
 func assertAdmissionAllowed(t *testing.T, resp admission.Response) {
 	if !resp.Allowed {
 		t.Errorf("wanted allowed, got disallowed")
@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+// Paths of the health endpoint.
+const (
+	HealthzPath    = "/healthz"
+	ReadyzPath     = "/readyz"
+	RegistriesPath = "/registries"
+)
+
+// registriesResponse is the body of responses from the registries path.
+type registriesResponse struct {
+	Registries []resolve.CircuitStatus `json:"registries"`
+}
+
+// NewHealthHandler serves the liveness and readiness probes, and the
+// circuit breaker state of the registries as JSON. Open circuits do not fail
+// the probes, because restarting the webhook does not help when a registry
+// is unavailable. A nil circuit breaker reports no registries.
+func NewHealthHandler(breaker *resolve.CircuitBreaker) http.Handler {
+	mux := http.NewServeMux()
+	for _, path := range []string{HealthzPath, ReadyzPath} {
+		probe := http.StripPrefix(path, &healthz.Handler{Checks: map[string]healthz.Checker{"default": healthz.Ping}})
+		mux.Handle(path, probe)
+		mux.Handle(path+"/", probe)
+	}
+	mux.HandleFunc(RegistriesPath, func(w http.ResponseWriter, _ *http.Request) {
+		response := registriesResponse{Registries: []resolve.CircuitStatus{}}
+		if breaker != nil {
+			response.Registries = breaker.Statuses()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(response)
+	})
+	return mux
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+// unavailableResolver fails with HTTP status 503 for all image references.
+type unavailableResolver struct{}
+
+func (unavailableResolver) Resolve(_ context.Context, _ string, _ authn.Keychain, _ *v1.Platform) (string, error) {
+	return "", &transport.Error{StatusCode: http.StatusServiceUnavailable}
+}
+
+func Test_NewHealthHandler(t *testing.T) {
+	breaker := resolve.NewCircuitBreaker(1, time.Minute)
+	node := yaml.MustParse("apiVersion: v1\nkind: Pod\nspec:\n  containers:\n  - name: app\n    image: gcr.io/project/app:v1\n")
+	if err := resolve.ImageTags(ctx, nullLog, nil, node, nil, resolve.WithResolver(unavailableResolver{}), resolve.WithRetry(resolve.RetryPolicy{}), resolve.WithCircuitBreaker(breaker)); err == nil {
+		t.Fatalf("wanted error from unavailable registry")
+	}
+	h := NewHealthHandler(breaker)
+
+	for _, path := range []string{HealthzPath, ReadyzPath, HealthzPath + "/default"} {
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, path, nil))
+		if resp.Code != http.StatusOK {
+			t.Errorf("wanted status 200 for %s with open circuit, got %d", path, resp.Code)
+		}
+	}
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, RegistriesPath, nil))
+	var body registriesResponse
+	if err := json.Unmarshal(resp.Body.Bytes(), &body); err != nil {
+		t.Fatalf("could not parse response %s: %v", resp.Body.String(), err)
+	}
+	if len(body.Registries) != 1 || body.Registries[0].Registry != "gcr.io" || body.Registries[0].State != resolve.CircuitOpen || body.Registries[0].OpenedAt == nil {
+		t.Errorf("wanted open circuit for gcr.io, got %s", resp.Body.String())
+	}
+
+	resp = httptest.NewRecorder()
+	NewHealthHandler(nil).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, RegistriesPath, nil))
+	if got := resp.Body.String(); got != "{\"registries\":[]}\n" {
+		t.Errorf("wanted no registries without circuit breaker, got %s", got)
+	}
+}
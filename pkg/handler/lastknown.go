@@ -0,0 +1,147 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+// LastKnownGoodDataKey is the key of the last-known-good digests in the
+// ConfigMap, in the lock file format.
+const LastKnownGoodDataKey = "images.yaml"
+
+// defaultLastKnownGoodInterval is how often the last-known-good digests are
+// written to the ConfigMap, if they changed.
+const defaultLastKnownGoodInterval = time.Minute
+
+// LastKnownGoodPersister loads the last-known-good digests from a ConfigMap
+// on start, and writes them to the ConfigMap periodically, if they changed.
+// Webhook replicas that share the ConfigMap merge their digests, and the
+// more recently resolved digest wins.
+type LastKnownGoodPersister struct {
+	Log    logr.Logger
+	Client client.Client
+	Store  *resolve.LastKnownGood
+	Key    types.NamespacedName // namespace and name of the ConfigMap
+	// Interval between writes. Zero means one minute.
+	Interval time.Duration
+}
+
+var _ manager.Runnable = &LastKnownGoodPersister{}
+
+// Start loads the digests, and writes them until the context is done. It
+// writes the digests one last time on shutdown.
+func (p *LastKnownGoodPersister) Start(ctx context.Context) error {
+	if _, err := p.load(ctx); err != nil {
+		// The webhook works without last-known-good digests.
+		p.Log.Error(err, "could not load last-known-good digests", "configmap", p.Key)
+	}
+	interval := p.Interval
+	if interval == 0 {
+		interval = defaultLastKnownGoodInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	pending := false
+	for {
+		select {
+		case <-ctx.Done():
+			if pending || p.Store.TakeChanged() {
+				saveCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				if err := p.save(saveCtx); err != nil {
+					p.Log.Error(err, "could not save last-known-good digests on shutdown", "configmap", p.Key)
+				}
+				cancel()
+			}
+			return nil
+		case <-ticker.C:
+			pending = p.Store.TakeChanged() || pending
+			if !pending {
+				continue
+			}
+			if err := p.save(ctx); err != nil {
+				p.Log.Error(err, "could not save last-known-good digests, retrying later", "configmap", p.Key)
+				continue
+			}
+			pending = false
+		}
+	}
+}
+
+// load merges the digests from the ConfigMap into the store, and returns
+// the ConfigMap, or nil if it does not exist.
+func (p *LastKnownGoodPersister) load(ctx context.Context) (*corev1.ConfigMap, error) {
+	configMap := &corev1.ConfigMap{}
+	if err := p.Client.Get(ctx, p.Key, configMap); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not get ConfigMap %s: %w", p.Key, err)
+	}
+	if data, exists := configMap.Data[LastKnownGoodDataKey]; exists {
+		if err := p.Store.Load([]byte(data)); err != nil {
+			return nil, fmt.Errorf("could not parse key %s of ConfigMap %s: %w", LastKnownGoodDataKey, p.Key, err)
+		}
+	}
+	return configMap, nil
+}
+
+// save merges the digests of other replicas from the ConfigMap into the
+// store, and writes the store to the ConfigMap, creating it if necessary.
+func (p *LastKnownGoodPersister) save(ctx context.Context) error {
+	configMap, err := p.load(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := p.Store.Marshal()
+	if err != nil {
+		return err
+	}
+	if configMap == nil {
+		configMap = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: p.Key.Namespace,
+				Name:      p.Key.Name,
+			},
+			Data: map[string]string{LastKnownGoodDataKey: string(data)},
+		}
+		if err := p.Client.Create(ctx, configMap); err != nil {
+			return fmt.Errorf("could not create ConfigMap %s: %w", p.Key, err)
+		}
+		p.Log.V(1).Info("created last-known-good ConfigMap", "configmap", p.Key)
+		return nil
+	}
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[LastKnownGoodDataKey] = string(data)
+	if err := p.Client.Update(ctx, configMap); err != nil {
+		return fmt.Errorf("could not update ConfigMap %s: %w", p.Key, err)
+	}
+	p.Log.V(1).Info("saved last-known-good digests", "configmap", p.Key)
+	return nil
+}
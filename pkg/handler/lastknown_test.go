@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+func lockData(t *testing.T, entries ...resolve.LockEntry) string {
+	lock := resolve.NewLock()
+	for _, entry := range entries {
+		lock.Set(entry)
+	}
+	data, err := lock.Marshal()
+	if err != nil {
+		t.Fatalf("could not marshal lock: %v", err)
+	}
+	return string(data)
+}
+
+func Test_LastKnownGoodPersister_save(t *testing.T) {
+	key := types.NamespacedName{Namespace: "digester-system", Name: "digester-last-known-good"}
+	resolvedAt := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := fake.NewClientBuilder().Build()
+	store := resolve.NewLastKnownGood(0)
+	if err := store.Load([]byte(lockData(t, resolve.LockEntry{Image: "image0", Digest: "sha256:digest0", ResolvedAt: resolvedAt}))); err != nil {
+		t.Fatalf("could not load store: %v", err)
+	}
+	p := &LastKnownGoodPersister{Log: log, Client: c, Store: store, Key: key}
+
+	if err := p.save(ctx); err != nil {
+		t.Fatalf("could not create ConfigMap: %v", err)
+	}
+
+	// Another replica adds a digest.
+	configMap := &corev1.ConfigMap{}
+	if err := c.Get(ctx, key, configMap); err != nil {
+		t.Fatalf("could not get ConfigMap: %v", err)
+	}
+	configMap.Data[LastKnownGoodDataKey] = lockData(t, resolve.LockEntry{Image: "image1", Digest: "sha256:digest1", ResolvedAt: resolvedAt})
+	if err := c.Update(ctx, configMap); err != nil {
+		t.Fatalf("could not update ConfigMap: %v", err)
+	}
+
+	if err := p.save(ctx); err != nil {
+		t.Fatalf("could not update ConfigMap: %v", err)
+	}
+	if err := c.Get(ctx, key, configMap); err != nil {
+		t.Fatalf("could not get ConfigMap: %v", err)
+	}
+	data := configMap.Data[LastKnownGoodDataKey]
+	for _, digest := range []string{"sha256:digest0", "sha256:digest1"} {
+		if !strings.Contains(data, digest) {
+			t.Errorf("wanted %s in ConfigMap, got:\n%s", digest, data)
+		}
+	}
+}
+
+func Test_LastKnownGoodPersister_load_Invalid(t *testing.T) {
+	key := types.NamespacedName{Namespace: "digester-system", Name: "digester-last-known-good"}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name},
+		Data:       map[string]string{LastKnownGoodDataKey: "images: []"},
+	}
+	c := fake.NewClientBuilder().WithObjects(configMap).Build()
+	p := &LastKnownGoodPersister{Log: log, Client: c, Store: resolve.NewLastKnownGood(0), Key: key}
+
+	if _, err := p.load(ctx); err == nil || !strings.Contains(err.Error(), "must have apiVersion") {
+		t.Errorf("wanted invalid lock error, got %v", err)
+	}
+}
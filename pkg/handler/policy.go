@@ -0,0 +1,192 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/yaml"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+// Causes of policy violations, used in the details of denied responses.
+const (
+	causeUnresolvable       metav1.CauseType = "UnresolvableImage"
+	causeLatestTag          metav1.CauseType = "LatestTag"
+	causeRegistryNotAllowed metav1.CauseType = "RegistryNotAllowed"
+	causeInvalidReference   metav1.CauseType = "InvalidImageReference"
+)
+
+// Policy rejects admission of resources with images that cannot be pinned.
+// The first rule that matches a resource applies.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule defines the checks for resources that match the namespaces and
+// the label selector.
+type PolicyRule struct {
+	// Name identifies the rule in denied responses.
+	Name string `json:"name"`
+	// Namespaces the rule applies to. Empty means all namespaces.
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Selector matches labels of the resource. Empty means all resources.
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	// DenyUnresolvable denies resources with images that cannot be resolved
+	// to digests.
+	DenyUnresolvable bool `json:"denyUnresolvable,omitempty"`
+	// DenyLatest denies resources with images that use the `latest` tag, or
+	// no tag, and that do not have a digest.
+	DenyLatest bool `json:"denyLatest,omitempty"`
+	// AllowedRegistries denies resources with images from other registries
+	// or repository prefixes. Empty means all registries are allowed.
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+}
+
+// LoadPolicy reads a policy from a YAML file.
+func LoadPolicy(filename string) (*Policy, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read policy file %s: %w", filename, err)
+	}
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict(b, policy); err != nil {
+		return nil, fmt.Errorf("could not parse policy file %s: %w", filename, err)
+	}
+	for _, rule := range policy.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("policy rule in %s is missing a name", filename)
+		}
+		if _, err := metav1.LabelSelectorAsSelector(rule.Selector); err != nil {
+			return nil, fmt.Errorf("invalid selector in policy rule %s: %w", rule.Name, err)
+		}
+	}
+	return policy, nil
+}
+
+// match returns the first rule that applies to resources in the namespace
+// with the labels, or nil if no rules apply.
+func (p *Policy) match(namespace string, resourceLabels map[string]string) *PolicyRule {
+	if p == nil {
+		return nil
+	}
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if len(rule.Namespaces) > 0 && !slices.Contains(rule.Namespaces, namespace) {
+			continue
+		}
+		if rule.Selector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(rule.Selector)
+			if err != nil || !selector.Matches(labels.Set(resourceLabels)) {
+				continue
+			}
+		}
+		return rule
+	}
+	return nil
+}
+
+// check returns the violations of the rule by the images.
+func (r *PolicyRule) check(images []string) []metav1.StatusCause {
+	var violations []metav1.StatusCause
+	for _, image := range images {
+		repository, latest, err := parsePolicyImage(image)
+		if err != nil {
+			// Invalid references cannot be checked, so they cannot pass.
+			violations = append(violations, metav1.StatusCause{
+				Type:    causeInvalidReference,
+				Message: fmt.Sprintf("image %s is not a valid image reference: %v", image, err),
+			})
+			continue
+		}
+		if r.DenyLatest && latest {
+			violations = append(violations, metav1.StatusCause{
+				Type:    causeLatestTag,
+				Message: fmt.Sprintf("image %s uses the %s tag, or no tag", image, name.DefaultTag),
+			})
+		}
+		if len(r.AllowedRegistries) > 0 && !registryAllowed(repository, r.AllowedRegistries) {
+			violations = append(violations, metav1.StatusCause{
+				Type:    causeRegistryNotAllowed,
+				Message: fmt.Sprintf("image %s is not from an allowed registry", image),
+			})
+		}
+	}
+	return violations
+}
+
+// denied creates a response that denies admission with a message that
+// summarizes the violations, and with one cause per violation.
+func (r *PolicyRule) denied(violations []metav1.StatusCause) admission.Response {
+	messages := make([]string, len(violations))
+	for i, violation := range violations {
+		messages[i] = violation.Message
+	}
+	resp := admission.Denied(fmt.Sprintf("digester policy rule %s: %s", r.Name, strings.Join(messages, "; ")))
+	resp.Result.Details = &metav1.StatusDetails{
+		Name:   r.Name,
+		Causes: violations,
+	}
+	return resp
+}
+
+// parsePolicyImage returns the repository of the image reference, and
+// whether the image reference uses the `latest` tag, or no tag, without a
+// digest. Image references with semantic version ranges as tags, such as
+// `myapp:~1.4`, are valid, because the resolver accepts them.
+func parsePolicyImage(image string) (name.Repository, bool, error) {
+	withoutDigest, digest, hasDigest := strings.Cut(image, "@")
+	if repository, _, isRange := resolve.SplitVersionRange(withoutDigest); isRange {
+		repo, err := name.NewRepository(repository)
+		if err != nil {
+			return name.Repository{}, false, err
+		}
+		if hasDigest {
+			if _, err := name.NewDigest(repository + "@" + digest); err != nil {
+				return name.Repository{}, false, err
+			}
+		}
+		return repo, false, nil
+	}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return name.Repository{}, false, err
+	}
+	return ref.Context(), !hasDigest && ref.Identifier() == name.DefaultTag, nil
+}
+
+// registryAllowed returns true if the repository matches one of the allowed
+// registries or repository prefixes.
+func registryAllowed(repo name.Repository, allowedRegistries []string) bool {
+	repository := repo.Name()
+	for _, allowed := range allowedRegistries {
+		allowed = strings.TrimSuffix(allowed, "/")
+		if allowed == "docker.io" || strings.HasPrefix(allowed, "docker.io/") {
+			allowed = name.DefaultRegistry + strings.TrimPrefix(allowed, "docker.io")
+		}
+		if repository == allowed || strings.HasPrefix(repository, allowed+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+func createPodRequest(namespace string, image string) admission.Request {
+	return admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: namespace,
+			Operation: admissionv1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(fmt.Sprintf(`{"kind": "Pod", "metadata": {"labels": {"team": "a"}}, "spec": {"containers": [{"image": "%s"}]}}`, image)),
+			},
+		},
+	}
+}
+
+func Test_Handle_PolicyDeniesLatest(t *testing.T) {
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, _ []string, _ ...resolve.Option) error {
+		return nil
+	}
+	h := &Handler{
+		Log: log,
+		Policy: &Policy{Rules: []PolicyRule{{
+			Name:       "no-latest",
+			DenyLatest: true,
+		}}},
+	}
+
+	for _, image := range []string{"registry.example.com/repository/image", "registry.example.com/repository/image:latest"} {
+		resp := h.Handle(ctx, createPodRequest("test", image))
+
+		assertAdmissionDenied(t, resp, causeLatestTag)
+	}
+}
+
+func Test_Handle_PolicyAllowsLatestWithDigest(t *testing.T) {
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, _ []string, _ ...resolve.Option) error {
+		return nil
+	}
+	h := &Handler{
+		Log: log,
+		Policy: &Policy{Rules: []PolicyRule{{
+			Name:       "no-latest",
+			DenyLatest: true,
+		}}},
+	}
+
+	resp := h.Handle(ctx, createPodRequest("test", "registry.example.com/repository/image:latest@sha256:0000000000000000000000000000000000000000000000000000000000000000"))
+
+	assertAdmissionAllowed(t, resp)
+}
+
+func Test_Handle_PolicyDeniesRegistry(t *testing.T) {
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, _ []string, _ ...resolve.Option) error {
+		return nil
+	}
+	h := &Handler{
+		Log: log,
+		Policy: &Policy{Rules: []PolicyRule{{
+			Name:              "allowed-registries",
+			AllowedRegistries: []string{"registry.example.com/allowed", "docker.io/library"},
+		}}},
+	}
+
+	assertAdmissionAllowed(t, h.Handle(ctx, createPodRequest("test", "registry.example.com/allowed/image:tag")))
+	assertAdmissionAllowed(t, h.Handle(ctx, createPodRequest("test", "nginx:1.25")))
+	assertAdmissionDenied(t, h.Handle(ctx, createPodRequest("test", "registry.example.com/allowedx/image:tag")), causeRegistryNotAllowed)
+	assertAdmissionDenied(t, h.Handle(ctx, createPodRequest("test", "docker.io/bitnami/nginx:1.25")), causeRegistryNotAllowed)
+}
+
+func Test_Handle_PolicyVersionRanges(t *testing.T) {
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, _ []string, _ ...resolve.Option) error {
+		return nil
+	}
+	h := &Handler{
+		Log:           log,
+		VersionRanges: true,
+		Policy: &Policy{Rules: []PolicyRule{{
+			Name:              "production",
+			DenyLatest:        true,
+			AllowedRegistries: []string{"registry.example.com/allowed"},
+		}}},
+	}
+
+	assertAdmissionAllowed(t, h.Handle(ctx, createPodRequest("test", "registry.example.com/allowed/image:~1.4")))
+	assertAdmissionAllowed(t, h.Handle(ctx, createPodRequest("test", "registry.example.com/allowed/image:^1@sha256:0000000000000000000000000000000000000000000000000000000000000000")))
+	assertAdmissionDenied(t, h.Handle(ctx, createPodRequest("test", "evil.example.com/image:^1")), causeRegistryNotAllowed)
+	assertAdmissionDenied(t, h.Handle(ctx, createPodRequest("test", "evil.example.com/image:~1.4@sha256:0000000000000000000000000000000000000000000000000000000000000000")), causeRegistryNotAllowed)
+	assertAdmissionDenied(t, h.Handle(ctx, createPodRequest("test", "registry.example.com/allowed/image:1.4!")), causeInvalidReference)
+	assertAdmissionDenied(t, h.Handle(ctx, createPodRequest("test", "registry.example.com/allowed/image:~1.4@sha256:digest")), causeInvalidReference)
+}
+
+func Test_Handle_PolicyDeniesUnresolvable(t *testing.T) {
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, _ []string, _ ...resolve.Option) error {
+		return fmt.Errorf("intentional error")
+	}
+	h := &Handler{
+		Log:          nullLog,
+		IgnoreErrors: true,
+		Policy: &Policy{Rules: []PolicyRule{{
+			Name:             "pinned",
+			Namespaces:       []string{"prod"},
+			DenyUnresolvable: true,
+		}}},
+	}
+
+	assertAdmissionDenied(t, h.Handle(ctx, createPodRequest("prod", "registry.example.com/repository/image:tag")), causeUnresolvable)
+
+	resp := h.Handle(ctx, createPodRequest("dev", "registry.example.com/repository/image:tag"))
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonErrorIgnored)
+}
+
+func Test_Handle_PolicyDeniesUnresolvableInModeOff(t *testing.T) {
+	resolveImageTags = resolveImageTagsWithResolver(fakeResolver{
+		"registry.example.com/repository/image:tag": "sha256:digest",
+	})
+	h := &Handler{
+		Log: nullLog,
+		Policy: &Policy{Rules: []PolicyRule{{
+			Name:             "pinned",
+			DenyUnresolvable: true,
+		}}},
+	}
+
+	resp := h.Handle(ctx, createAnnotatedPodRequest("test", `"digester.k8s.io/mode": "off"`))
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonModeOff)
+	assertNoPatches(t, resp)
+
+	resolveImageTags = resolveImageTagsWithResolver(fakeResolver{})
+	resp = h.Handle(ctx, createAnnotatedPodRequest("test", `"digester.k8s.io/mode": "off"`))
+	assertAdmissionDenied(t, resp, causeUnresolvable)
+}
+
+func Test_Policy_match(t *testing.T) {
+	policy := &Policy{Rules: []PolicyRule{
+		{
+			Name:     "team-b",
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "b"}},
+		},
+		{
+			Name:       "prod",
+			Namespaces: []string{"prod"},
+		},
+	}}
+	tests := []struct {
+		namespace string
+		labels    map[string]string
+		want      string
+	}{
+		{namespace: "dev", labels: map[string]string{"team": "b"}, want: "team-b"},
+		{namespace: "prod", labels: map[string]string{"team": "b"}, want: "team-b"},
+		{namespace: "prod", labels: map[string]string{"team": "a"}, want: "prod"},
+		{namespace: "dev", labels: nil, want: ""},
+	}
+	for _, test := range tests {
+		var got string
+		if rule := policy.match(test.namespace, test.labels); rule != nil {
+			got = rule.Name
+		}
+		if got != test.want {
+			t.Errorf("%s %v: wanted rule [%s], got [%s]", test.namespace, test.labels, test.want, got)
+		}
+	}
+}
+
+func Test_LoadPolicy(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(filename, []byte(`rules:
+- name: prod
+  namespaces:
+  - prod
+  selector:
+    matchExpressions:
+    - key: team
+      operator: In
+      values:
+      - a
+  denyUnresolvable: true
+  denyLatest: true
+  allowedRegistries:
+  - gcr.io
+`), 0o600); err != nil {
+		t.Fatalf("could not write policy file: %v", err)
+	}
+
+	policy, err := LoadPolicy(filename)
+	if err != nil {
+		t.Fatalf("could not load policy: %v", err)
+	}
+
+	if rule := policy.match("prod", map[string]string{"team": "a"}); rule == nil || !rule.DenyLatest || !rule.DenyUnresolvable {
+		t.Errorf("wanted rule prod with denyLatest and denyUnresolvable, got %+v", rule)
+	}
+}
+
+func assertAdmissionDenied(t *testing.T, resp admission.Response, wantCause metav1.CauseType) {
+	t.Helper()
+	if resp.Allowed {
+		t.Errorf("wanted disallowed, got allowed")
+	}
+	if resp.Result.Code != http.StatusForbidden {
+		t.Errorf("wanted code %d, got %d", http.StatusForbidden, resp.Result.Code)
+	}
+	if resp.Result.Details == nil || len(resp.Result.Details.Causes) == 0 {
+		t.Fatalf("wanted result details with causes, got %+v", resp.Result)
+	}
+	if gotCause := resp.Result.Details.Causes[0].Type; gotCause != wantCause {
+		t.Errorf("wanted cause %s, got %s", wantCause, gotCause)
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// Annotations on namespaces and resources that override the behavior of the
+// webhook. Annotations on resources take precedence over annotations on
+// namespaces.
+const (
+	// AnnotationMode is one of ModeOff, ModeDryRun, or ModeEnforce.
+	AnnotationMode = "digester.k8s.io/mode"
+	// AnnotationSkipContainers is a comma-separated list of names of
+	// containers whose images are not mutated. Policy rules still apply to
+	// their images.
+	AnnotationSkipContainers = "digester.k8s.io/skip-containers"
+)
+
+// Values of the AnnotationMode annotation.
+const (
+	// ModeOff does not mutate resources. Policy rules still apply, and image
+	// tags are resolved only if the policy rule denies unresolvable images.
+	ModeOff = "off"
+	// ModeDryRun resolves image tags, but does not mutate resources.
+	ModeDryRun = "dry-run"
+	// ModeEnforce resolves image tags and mutates resources, even if the
+	// webhook runs with dry-run.
+	ModeEnforce = "enforce"
+)
+
+const reasonModeOff = "ModeOff"
+
+// scope is the behavior of the webhook for one resource, as determined by
+// the annotations of the resource and its namespace.
+type scope struct {
+	mode           string // empty means the mode of the webhook settings
+	skipContainers []string
+}
+
+// scope reads the annotations of the namespace and the resource. The
+// namespace is read using the Client, if there is one.
+func (h *Handler) scope(ctx context.Context, namespace string, r *yaml.RNode) (scope, error) {
+	var s scope
+	if h.Client != nil && namespace != "" {
+		ns := &corev1.Namespace{}
+		err := h.Client.Get(ctx, types.NamespacedName{Name: namespace}, ns)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return s, fmt.Errorf("could not get namespace %s: %w", namespace, err)
+		}
+		if err := s.apply(ns.GetAnnotations()); err != nil {
+			return s, fmt.Errorf("invalid annotation on namespace %s: %w", namespace, err)
+		}
+	}
+	if err := s.apply(r.GetAnnotations()); err != nil {
+		return s, fmt.Errorf("invalid annotation on resource: %w", err)
+	}
+	return s, nil
+}
+
+// apply overrides the scope with the values of the annotations, if present.
+func (s *scope) apply(annotations map[string]string) error {
+	if mode, exists := annotations[AnnotationMode]; exists {
+		switch mode {
+		case ModeOff, ModeDryRun, ModeEnforce:
+			s.mode = mode
+		default:
+			return fmt.Errorf("unknown %s value %q, must be one of %s, %s, or %s", AnnotationMode, mode, ModeOff, ModeDryRun, ModeEnforce)
+		}
+	}
+	if names, exists := annotations[AnnotationSkipContainers]; exists {
+		s.skipContainers = nil
+		for _, name := range strings.Split(names, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				s.skipContainers = append(s.skipContainers, name)
+			}
+		}
+	}
+	return nil
+}
+
+// dryRun returns true if the webhook should not mutate the resource.
+func (s scope) dryRun(settings Settings) bool {
+	switch s.mode {
+	case ModeDryRun:
+		return true
+	case ModeEnforce:
+		return false
+	default:
+		return settings.DryRun
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-cmp/cmp"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+func createNamespace(name string, annotations map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: annotations,
+		},
+	}
+}
+
+func createAnnotatedPodRequest(namespace string, annotations string) admission.Request {
+	return admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: namespace,
+			Operation: admissionv1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"kind": "Pod", "metadata": {"annotations": {` + annotations + `}}, "spec": {"containers": [{"image": "registry.example.com/repository/image:tag"}]}}`),
+			},
+		},
+	}
+}
+
+// resolveFirstContainer is an implementation of resolveImageTags that adds a
+// digest to the first container image.
+func resolveFirstContainer(_ context.Context, _ logr.Logger, _ *rest.Config, n *yaml.RNode, _ []string, _ ...resolve.Option) error {
+	return n.PipeE(yaml.Lookup("spec", "containers", "0", "image"), yaml.FieldSetter{StringValue: "registry.example.com/repository/image:tag@sha256:digest"})
+}
+
+func Test_Handle_ModeFromNamespace(t *testing.T) {
+	resolveImageTags = resolveFirstContainer
+	c := fake.NewClientBuilder().WithObjects(
+		createNamespace("off", map[string]string{AnnotationMode: ModeOff}),
+		createNamespace("dry-run", map[string]string{AnnotationMode: ModeDryRun}),
+		createNamespace("default", nil),
+	).Build()
+	h := &Handler{Log: log, Client: c}
+
+	resp := h.Handle(ctx, createAnnotatedPodRequest("off", ""))
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonModeOff)
+	assertNoPatches(t, resp)
+
+	resp = h.Handle(ctx, createAnnotatedPodRequest("dry-run", ""))
+	assertMessage(t, resp, reasonNotPatched)
+	assertNoPatches(t, resp)
+
+	resp = h.Handle(ctx, createAnnotatedPodRequest("default", ""))
+	assertMessage(t, resp, reasonPatched)
+}
+
+func Test_Handle_ModeFromResourceOverridesNamespace(t *testing.T) {
+	resolveImageTags = resolveFirstContainer
+	c := fake.NewClientBuilder().WithObjects(
+		createNamespace("off", map[string]string{AnnotationMode: ModeOff}),
+	).Build()
+	h := &Handler{Log: log, Client: c, DryRun: true}
+
+	resp := h.Handle(ctx, createAnnotatedPodRequest("off", `"digester.k8s.io/mode": "enforce"`))
+
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonPatched)
+}
+
+func Test_Handle_InvalidMode(t *testing.T) {
+	resolveImageTags = resolveFirstContainer
+	h := &Handler{Log: nullLog}
+
+	resp := h.Handle(ctx, createAnnotatedPodRequest("test", `"digester.k8s.io/mode": "sometimes"`))
+
+	assertAdmissionError(t, resp)
+}
+
+func Test_Handle_SkipContainers(t *testing.T) {
+	var got *resolve.ImageTagFilter
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, _ []string, opts ...resolve.Option) error {
+		got = &resolve.ImageTagFilter{}
+		for _, opt := range opts {
+			opt(got)
+		}
+		return nil
+	}
+	c := fake.NewClientBuilder().WithObjects(
+		createNamespace("test", map[string]string{AnnotationSkipContainers: "istio-proxy"}),
+	).Build()
+	h := &Handler{Log: log, Client: c}
+
+	h.Handle(ctx, createAnnotatedPodRequest("test", ""))
+	if diff := cmp.Diff([]string{"istio-proxy"}, got.SkipContainers); diff != "" {
+		t.Errorf("skip containers mismatch (-want +got):\n%s", diff)
+	}
+
+	h.Handle(ctx, createAnnotatedPodRequest("test", `"digester.k8s.io/skip-containers": "app, sidecar"`))
+	if diff := cmp.Diff([]string{"app", "sidecar"}, got.SkipContainers); diff != "" {
+		t.Errorf("skip containers mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_Handle_SkipContainersPolicy(t *testing.T) {
+	req := admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Namespace: "test",
+			Operation: admissionv1.Create,
+			Object: runtime.RawExtension{
+				Raw: []byte(`{"kind": "Pod", "metadata": {"annotations": {"digester.k8s.io/skip-containers": "sidecar"}}, "spec": {"containers": [{"name": "app", "image": "registry.example.com/repository/image:tag"}, {"name": "sidecar", "image": "registry.example.com/repository/sidecar:tag"}]}}`),
+			},
+		},
+	}
+	resolveImageTags = resolveImageTagsWithResolver(fakeResolver{
+		"registry.example.com/repository/image:tag": "sha256:digest",
+	})
+	h := &Handler{Log: nullLog}
+
+	resp := h.Handle(ctx, req)
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonPatched)
+
+	h.Policy = &Policy{Rules: []PolicyRule{{Name: "allowed-registries", AllowedRegistries: []string{"registry.example.com/repository/image"}}}}
+	assertAdmissionDenied(t, h.Handle(ctx, req), causeRegistryNotAllowed)
+
+	h.Policy = &Policy{Rules: []PolicyRule{{Name: "pinned", DenyUnresolvable: true}}}
+	assertAdmissionDenied(t, h.Handle(ctx, req), causeUnresolvable)
+
+	resolveImageTags = resolveImageTagsWithResolver(fakeResolver{
+		"registry.example.com/repository/image:tag":   "sha256:digest",
+		"registry.example.com/repository/sidecar:tag": "sha256:digest",
+	})
+	resp = h.Handle(ctx, req)
+	assertAdmissionAllowed(t, resp)
+	if len(resp.Patches) != 1 || resp.Patches[0].Path != "/spec/containers/0/image" {
+		t.Errorf("wanted one patch of the app container image, got %+v", resp.Patches)
+	}
+
+	calls := 0
+	resolveWithResolver := resolveImageTags
+	resolveImageTags = func(ctx context.Context, log logr.Logger, config *rest.Config, n *yaml.RNode, skipPrefixes []string, opts ...resolve.Option) error {
+		calls++
+		return resolveWithResolver(ctx, log, config, n, skipPrefixes, opts...)
+	}
+	h.Handle(ctx, req)
+	if calls != 1 {
+		t.Errorf("wanted the image tags resolved in one pass, got %d passes", calls)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/metrics"
+	"github.com/google/k8s-digester/pkg/resolve"
+	"github.com/google/k8s-digester/pkg/util"
+)
+
+const (
+	reasonNoValidationForOperation = "NoValidationForOperation"
+	reasonPinned                   = "Pinned"
+	reasonNotPinned                = "NotPinned"
+)
+
+// Validator implements admission.Handler for the validating webhook. It
+// resolves image tags using the configuration of the Handler, but it never
+// mutates resources. Instead, it reports image references that do not have
+// digests, or whose digests differ from the current digests of their tags,
+// as admission warnings and audit annotations. Image references whose tags
+// cannot be resolved are reported individually. It always allows admission.
+type Validator struct {
+	Handler *Handler
+}
+
+// Handle processes the AdmissionRequest by resolving the image tags in a
+// copy of the resource.
+func (v *Validator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	ctx, span := startSpan(ctx, "Validator.Handle", req)
+	resp := v.handle(ctx, req)
+	reason := responseReason(resp)
+	metrics.AdmissionResponses.WithLabelValues(webhookValidate, reason).Inc()
+	endSpan(span, resp, reason)
+	return resp
+}
+
+func (v *Validator) handle(ctx context.Context, req admission.Request) admission.Response {
+	h := v.Handler
+	h.Log.Info("received validation request", "name", req.Name, "namespace", req.Namespace, "gvk", req.Kind)
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return admission.Allowed(reasonNoValidationForOperation)
+	}
+	if req.Namespace == util.GetNamespace() {
+		return admission.Allowed(reasonNoSelfManagement)
+	}
+	r, err := yaml.Parse(string(req.Object.Raw))
+	if err != nil {
+		return v.validationError(err)
+	}
+	if err := r.SetNamespace(req.Namespace); err != nil {
+		return v.validationError(err)
+	}
+	s, err := h.scope(ctx, req.Namespace, r)
+	if err != nil {
+		return v.validationError(err)
+	}
+	if s.mode == ModeOff {
+		return admission.Allowed(reasonModeOff)
+	}
+	var results []resolve.Result
+	opts := append(h.resolveOptions(r, s, h.fieldSpecs(req.SubResource)), resolve.WithResults(&results), resolve.WithVerifyDigests(true), resolve.WithContinueOnError(true))
+	settings := h.settings()
+	if err := resolveImageTags(ctx, h.Log, settings.config(h.Config), r, settings.SkipPrefixes, opts...); err != nil {
+		return v.validationError(err)
+	}
+	resp := admission.Allowed(reasonPinned)
+	for i, result := range results {
+		var message string
+		switch result.Status {
+		case resolve.StatusResolved:
+			message = fmt.Sprintf("image %s in %s is not pinned to a digest, the tag resolves to %s", result.Image, result.Field, result.Digest)
+		case resolve.StatusMismatch:
+			message = fmt.Sprintf("image %s in %s does not match the current digest %s of the tag", result.Image, result.Field, result.Digest)
+		case resolve.StatusFailed:
+			message = fmt.Sprintf("digester could not verify image %s in %s: %v", result.Image, result.Field, result.Err)
+		default:
+			continue
+		}
+		addResult(&resp, auditAnnotationKey(result, i), message, true, true)
+		if result.Status != resolve.StatusFailed || !strings.Contains(result.Image, "@") {
+			resp.Result.Message = reasonNotPinned
+		}
+	}
+	h.Log.V(1).Info("validated resource", "warnings", resp.Warnings)
+	return resp
+}
+
+// validationError allows admission, because the validating webhook only
+// reports, but it adds the error as a warning.
+func (v *Validator) validationError(err error) admission.Response {
+	v.Handler.Log.Error(err, "validation error")
+	resp := admission.Allowed(reasonErrorIgnored)
+	resp.Warnings = []string{fmt.Sprintf("digester could not verify image digests: %v", err)}
+	return resp
+}
+
+// addResult adds the message to the response as a warning, and as an audit
+// annotation with the key.
+func addResult(resp *admission.Response, key string, message string, warning bool, auditAnnotation bool) {
+	if warning {
+		resp.Warnings = append(resp.Warnings, message)
+	}
+	if auditAnnotation {
+		if resp.AuditAnnotations == nil {
+			resp.AuditAnnotations = map[string]string{}
+		}
+		resp.AuditAnnotations[key] = message
+	}
+}
+
+// maxAuditAnnotationKeyLength is the maximum length of the name part of a
+// qualified name. The API server drops audit annotations with longer keys.
+const maxAuditAnnotationKeyLength = 63
+
+// auditAnnotationKey creates a key from the list and the name of the list
+// element that contains the image reference, e.g., `containers.app`. The API
+// server adds the webhook name as a prefix. The index of the result is used
+// if the image reference is not in a list. Keys that are too long are
+// truncated, and end with a hash of the full key, so that they stay unique.
+func auditAnnotationKey(result resolve.Result, index int) string {
+	key := fmt.Sprintf("image.%d", index)
+	if result.List != "" {
+		key = result.List + "." + result.Name
+	}
+	if len(key) <= maxAuditAnnotationKeyLength {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	suffix := "." + hex.EncodeToString(sum[:])[:8]
+	return key[:maxAuditAnnotationKeyLength-len(suffix)] + suffix
+}
@@ -0,0 +1,173 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/resolve"
+)
+
+// resolveImageTagsWithResults returns an implementation of resolveImageTags
+// that reports the results without modifying the resource.
+func resolveImageTagsWithResults(results ...resolve.Result) func(context.Context, logr.Logger, *rest.Config, *yaml.RNode, []string, ...resolve.Option) error {
+	return func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, _ []string, opts ...resolve.Option) error {
+		f := &resolve.ImageTagFilter{}
+		for _, opt := range opts {
+			opt(f)
+		}
+		if f.Results != nil {
+			*f.Results = append(*f.Results, results...)
+		}
+		return nil
+	}
+}
+
+func Test_Validate_Pinned(t *testing.T) {
+	resolveImageTags = resolveImageTagsWithResults(resolve.Result{
+		Field:  "spec.containers[0].image",
+		List:   "containers",
+		Name:   "0",
+		Image:  "registry.example.com/repository/image@sha256:digest",
+		Digest: "sha256:digest",
+		Status: resolve.StatusPinned,
+	})
+	v := &Validator{Handler: &Handler{Log: log}}
+
+	resp := v.Handle(ctx, createPodRequest("test", "registry.example.com/repository/image@sha256:digest"))
+
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonPinned)
+	assertNoPatches(t, resp)
+	if len(resp.Warnings) > 0 {
+		t.Errorf("wanted no warnings, got %v", resp.Warnings)
+	}
+}
+
+func Test_Validate_NotPinned(t *testing.T) {
+	resolveImageTags = resolveImageTagsWithResults(
+		resolve.Result{
+			Field:  "spec.containers[name=app].image",
+			List:   "containers",
+			Name:   "app",
+			Image:  "registry.example.com/repository/image:tag",
+			Digest: "sha256:current",
+			Status: resolve.StatusResolved,
+		},
+		resolve.Result{
+			Field:  "spec.initContainers[name=init].image",
+			List:   "initContainers",
+			Name:   "init",
+			Image:  "registry.example.com/repository/init:tag@sha256:stale",
+			Digest: "sha256:current",
+			Status: resolve.StatusMismatch,
+		},
+	)
+	v := &Validator{Handler: &Handler{Log: log}}
+
+	resp := v.Handle(ctx, createPodRequest("test", "registry.example.com/repository/image:tag"))
+
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonNotPinned)
+	assertNoPatches(t, resp)
+	if len(resp.Warnings) != 2 {
+		t.Errorf("wanted 2 warnings, got %v", resp.Warnings)
+	}
+	for _, key := range []string{"containers.app", "initContainers.init"} {
+		if _, exists := resp.AuditAnnotations[key]; !exists {
+			t.Errorf("wanted audit annotation %s, got %v", key, resp.AuditAnnotations)
+		}
+	}
+}
+
+func Test_Validate_ReportsEveryImageOnResolutionFailure(t *testing.T) {
+	req := createPodRequest("test", "registry.example.com/repository/image:tag")
+	req.Object.Raw = []byte(`{"kind": "Pod", "spec": {"containers": [{"name": "app", "image": "registry.example.com/repository/image:tag"}, {"name": "sidecar", "image": "registry.example.com/repository/unresolvable:tag"}]}}`)
+	resolveImageTags = resolveImageTagsWithResolver(fakeResolver{
+		"registry.example.com/repository/image:tag": "sha256:digest",
+	})
+	v := &Validator{Handler: &Handler{Log: nullLog}}
+
+	resp := v.Handle(ctx, req)
+
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonNotPinned)
+	if len(resp.Warnings) != 2 {
+		t.Errorf("wanted 2 warnings, got %v", resp.Warnings)
+	}
+	if got := resp.AuditAnnotations["containers.app"]; !strings.Contains(got, "the tag resolves to sha256:digest") {
+		t.Errorf("wanted audit annotation for the resolved image, got %q", got)
+	}
+	if got := resp.AuditAnnotations["containers.sidecar"]; !strings.Contains(got, "could not verify image registry.example.com/repository/unresolvable:tag") {
+		t.Errorf("wanted audit annotation for the unresolvable image, got %q", got)
+	}
+}
+
+func Test_Validate_AllowedOnError(t *testing.T) {
+	resolveImageTags = func(_ context.Context, _ logr.Logger, _ *rest.Config, _ *yaml.RNode, _ []string, _ ...resolve.Option) error {
+		return fmt.Errorf("intentional error")
+	}
+	v := &Validator{Handler: &Handler{Log: nullLog}}
+
+	resp := v.Handle(ctx, createPodRequest("test", "registry.example.com/repository/image:tag"))
+
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonErrorIgnored)
+	if len(resp.Warnings) != 1 {
+		t.Errorf("wanted 1 warning, got %v", resp.Warnings)
+	}
+}
+
+func Test_Validate_EphemeralContainersSubResourceIgnoresOtherContainers(t *testing.T) {
+	req := createPodRequest("test", "registry.example.com/repository/unresolvable:tag")
+	req.Operation = admissionv1.Update
+	req.SubResource = "ephemeralcontainers"
+	resolveImageTags = resolveImageTagsWithResolver(fakeResolver{})
+	v := &Validator{Handler: &Handler{Log: log}}
+
+	resp := v.Handle(ctx, req)
+
+	assertAdmissionAllowed(t, resp)
+	assertMessage(t, resp, reasonPinned)
+	if len(resp.Warnings) > 0 {
+		t.Errorf("wanted no warnings, got %v", resp.Warnings)
+	}
+}
+
+func Test_auditAnnotationKey_Length(t *testing.T) {
+	name := strings.Repeat("a", 62) + "b"
+	otherName := strings.Repeat("a", 62) + "c"
+	key := auditAnnotationKey(resolve.Result{List: "ephemeralContainers", Name: name}, 0)
+	otherKey := auditAnnotationKey(resolve.Result{List: "ephemeralContainers", Name: otherName}, 0)
+
+	if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+		t.Errorf("wanted qualified name, got %s: %v", key, errs)
+	}
+	if key == otherKey {
+		t.Errorf("wanted different keys for different containers, got %s", key)
+	}
+	if got := auditAnnotationKey(resolve.Result{List: "containers", Name: "app"}, 0); got != "containers.app" {
+		t.Errorf("wanted containers.app, got %s", got)
+	}
+}
@@ -27,9 +27,13 @@ import (
 	"github.com/google/go-containerregistry/pkg/authn/github"
 	"github.com/google/go-containerregistry/pkg/authn/k8schain"
 	"github.com/google/go-containerregistry/pkg/v1/google"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/google/k8s-digester/pkg/tracing"
 )
 
 var (
@@ -40,7 +44,9 @@ var (
 )
 
 // Create a multi keychain based in input arguments
-func Create(ctx context.Context, log logr.Logger, config *rest.Config, n *yaml.RNode) (authn.Keychain, error) {
+func Create(ctx context.Context, log logr.Logger, config *rest.Config, n *yaml.RNode) (kc authn.Keychain, err error) {
+	ctx, span := tracing.Start(ctx, "keychain.Create", trace.WithAttributes(attribute.Bool("offline", config == nil)))
+	defer func() { tracing.End(span, err) }()
 	if config == nil {
 		log.V(1).Info("creating offline keychain")
 		return authn.NewMultiKeychain(
@@ -67,7 +73,9 @@ func createClient(config *rest.Config) (kubernetes.Interface, error) {
 	return kubernetes.NewForConfig(config)
 }
 
-func createK8schain(ctx context.Context, log logr.Logger, client kubernetes.Interface, n *yaml.RNode) (authn.Keychain, error) {
+func createK8schain(ctx context.Context, log logr.Logger, client kubernetes.Interface, n *yaml.RNode) (kc authn.Keychain, err error) {
+	ctx, span := tracing.Start(ctx, "createK8schain")
+	defer func() { tracing.End(span, err) }()
 	var namespace string
 	namespaceNode, err := n.Pipe(yaml.Lookup("metadata", "namespace"))
 	if err == nil {
@@ -111,6 +119,11 @@ func createK8schain(ctx context.Context, log logr.Logger, client kubernetes.Inte
 		"namespace", namespace,
 		"serviceAccountName", serviceAccountName,
 		"imagePullSecrets", imagePullSecrets)
+	span.SetAttributes(
+		attribute.String("namespace", namespace),
+		attribute.String("serviceAccountName", serviceAccountName),
+		attribute.Int("imagePullSecrets", len(imagePullSecrets)),
+	)
 	return k8schain.New(ctx, client, k8schain.Options{
 		Namespace:          namespace,          // defaults to "default" if empty
 		ServiceAccountName: serviceAccountName, // defaults to "default" if empty
@@ -0,0 +1,146 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics defines the Prometheus metrics of digester.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "digester"
+
+// Label values for the result of resolutions and cache lookups.
+const (
+	ResultSuccess = "success"
+	ResultError   = "error"
+	ResultHit     = "hit"
+	ResultMiss    = "miss"
+	// ResultCircuitOpen means that the resolution failed fast, because the
+	// circuit breaker of the registry was open.
+	ResultCircuitOpen = "circuit_open"
+)
+
+var (
+	// AdmissionResponses counts admission responses by webhook and reason.
+	AdmissionResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "admission_responses_total",
+		Help:      "Number of admission responses, by webhook and reason.",
+	}, []string{"webhook", "reason"})
+
+	// Resolutions counts resolutions of image tags to digests by registry
+	// host and result. Digests found in the cache are not counted.
+	Resolutions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "resolutions_total",
+		Help:      "Number of image tag resolutions using a registry, by registry host and result.",
+	}, []string{"registry", "result"})
+
+	// Retries counts retries of registry requests by registry host.
+	Retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retries_total",
+		Help:      "Number of retried image tag resolutions, by registry host.",
+	}, []string{"registry"})
+
+	// RegistryLatency observes the duration of resolving an image tag using
+	// a registry.
+	RegistryLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "registry_request_duration_seconds",
+		Help:      "Duration of resolving an image tag using a registry, by registry host.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"registry"})
+
+	// KeychainLatency observes the duration of creating a keychain.
+	KeychainLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "keychain_create_duration_seconds",
+		Help:      "Duration of creating a keychain for registry authentication.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// CacheRequests counts digest cache lookups by result, hit or miss.
+	CacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_requests_total",
+		Help:      "Number of digest cache lookups, by result.",
+	}, []string{"result"})
+)
+
+var collectors = []prometheus.Collector{
+	AdmissionResponses,
+	Resolutions,
+	Retries,
+	RegistryLatency,
+	KeychainLatency,
+	CacheRequests,
+}
+
+// Register registers the digester metrics with the registry, for instance
+// the controller-runtime metrics registry.
+func Register(registry prometheus.Registerer) error {
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil {
+			return fmt.Errorf("could not register metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+// WriteSummary writes the values of the digester metrics in the gatherer,
+// one line per metric and label combination. For histograms, it writes the
+// count and the sum.
+func WriteSummary(w io.Writer, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("could not gather metrics: %w", err)
+	}
+	var lines []string
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), namespace+"_") {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			var labels []string
+			for _, label := range metric.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+			}
+			name := family.GetName()
+			if len(labels) > 0 {
+				name += "{" + strings.Join(labels, ",") + "}"
+			}
+			switch {
+			case metric.GetCounter() != nil:
+				lines = append(lines, fmt.Sprintf("%s %v", name, metric.GetCounter().GetValue()))
+			case metric.GetHistogram() != nil:
+				histogram := metric.GetHistogram()
+				lines = append(lines, fmt.Sprintf("%s count=%d sum=%.3fs", name, histogram.GetSampleCount(), histogram.GetSampleSum()))
+			}
+		}
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_WriteSummary(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if err := Register(registry); err != nil {
+		t.Fatalf("could not register metrics: %v", err)
+	}
+	Resolutions.WithLabelValues("gcr.io", ResultSuccess).Add(2)
+	CacheRequests.WithLabelValues(ResultHit).Inc()
+	KeychainLatency.Observe(0.5)
+
+	var buf bytes.Buffer
+	if err := WriteSummary(&buf, registry); err != nil {
+		t.Fatalf("could not write summary: %v", err)
+	}
+
+	got := buf.String()
+	for _, want := range []string{
+		`digester_resolutions_total{registry="gcr.io",result="success"} 2`,
+		`digester_cache_requests_total{result="hit"} 1`,
+		`digester_keychain_create_duration_seconds count=1 sum=0.500s`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("wanted summary to contain [%s], got:\n%s", want, got)
+		}
+	}
+}
+
+func Test_Register_Twice(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if err := Register(registry); err != nil {
+		t.Fatalf("could not register metrics: %v", err)
+	}
+	if err := Register(registry); err == nil {
+		t.Errorf("wanted error registering metrics twice, got nil")
+	}
+}
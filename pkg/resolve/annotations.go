@@ -0,0 +1,93 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	// AnnotationResolvedAt is the time when digester last resolved image
+	// tags in the resource, in RFC 3339 format.
+	AnnotationResolvedAt = "digester.k8s.io/resolved-at"
+	// AnnotationOriginalImages is a JSON object that maps the list and the
+	// name of the list element that contains the image reference, e.g.,
+	// `containers.app`, or the path of image references that are not in a
+	// list, e.g., `spec.image`, to the image reference before digester added
+	// the digest.
+	AnnotationOriginalImages = "digester.k8s.io/original-images"
+)
+
+var now = time.Now // override for testing
+
+// WithAnnotations records the original image references and the resolution
+// time as annotations on the resource, if any tags were resolved.
+func WithAnnotations(annotations bool) Option {
+	return func(f *ImageTagFilter) {
+		f.Annotations = annotations
+	}
+}
+
+// annotate sets the provenance annotations on the resource for the results
+// with StatusResolved. Original image references recorded by earlier
+// resolutions are kept, unless the same list element was resolved again.
+func annotate(n *yaml.RNode, results []Result) error {
+	originalImages := map[string]string{}
+	for _, result := range results {
+		if result.Status == StatusResolved {
+			originalImages[originalImageKey(result)] = result.Image
+		}
+	}
+	if len(originalImages) == 0 {
+		return nil
+	}
+	if existing := n.GetAnnotations()[AnnotationOriginalImages]; existing != "" {
+		previousImages := map[string]string{}
+		if err := json.Unmarshal([]byte(existing), &previousImages); err == nil {
+			for name, image := range previousImages {
+				if _, exists := originalImages[name]; !exists {
+					originalImages[name] = image
+				}
+			}
+		}
+	}
+	b, err := json.Marshal(originalImages)
+	if err != nil {
+		return fmt.Errorf("could not marshal original images: %w", err)
+	}
+	if err := n.PipeE(yaml.SetAnnotation(AnnotationOriginalImages, string(b))); err != nil {
+		return fmt.Errorf("could not set annotation %s: %w", AnnotationOriginalImages, err)
+	}
+	if err := n.PipeE(yaml.SetAnnotation(AnnotationResolvedAt, now().UTC().Format(time.RFC3339))); err != nil {
+		return fmt.Errorf("could not set annotation %s: %w", AnnotationResolvedAt, err)
+	}
+	return nil
+}
+
+// originalImageKey creates a key from the list and the name of the list
+// element that contains the image reference, e.g., `containers.app`, so that
+// containers and image volumes with the same name do not collide. Image
+// references that are not in a list use the path of the field, e.g.,
+// `spec.image`.
+func originalImageKey(result Result) string {
+	if result.List == "" {
+		return result.Field
+	}
+	return result.List + "." + result.Name
+}
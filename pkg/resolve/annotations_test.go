@@ -0,0 +1,116 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"testing"
+	"time"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+func Test_ImageTags_Annotations(t *testing.T) {
+	origNow := now
+	defer func() { now = origNow }()
+	now = func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }
+	node, err := createPodNode([]string{"image0", "image1@sha256:pinned"}, []string{"image2"})
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	if err := node.PipeE(yaml.SetAnnotation(AnnotationOriginalImages, `{"containers.container0":"old","containers.removed":"image3"}`)); err != nil {
+		t.Fatalf("could not set annotation: %v", err)
+	}
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithAnnotations(true)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	annotations := node.GetAnnotations()
+	wantOriginalImages := `{"containers.container0":"image0","containers.removed":"image3","initContainers.initcontainer0":"image2"}`
+	if got := annotations[AnnotationOriginalImages]; got != wantOriginalImages {
+		t.Errorf("wanted %s, got %s", wantOriginalImages, got)
+	}
+	if got := annotations[AnnotationResolvedAt]; got != "2021-06-01T12:00:00Z" {
+		t.Errorf("wanted 2021-06-01T12:00:00Z, got %s", got)
+	}
+}
+
+func Test_ImageTags_Annotations_SameNames(t *testing.T) {
+	node, err := yaml.Parse(`apiVersion: v1
+kind: Pod
+metadata:
+  name: pod
+spec:
+  containers:
+  - name: app
+    image: image0
+  volumes:
+  - name: app
+    image:
+      reference: image1
+`)
+	if err != nil {
+		t.Fatalf("could not parse pod: %v", err)
+	}
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithAnnotations(true)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	wantOriginalImages := `{"containers.app":"image0","volumes.app":"image1"}`
+	if got := node.GetAnnotations()[AnnotationOriginalImages]; got != wantOriginalImages {
+		t.Errorf("wanted %s, got %s", wantOriginalImages, got)
+	}
+}
+
+func Test_ImageTags_Annotations_NotInList(t *testing.T) {
+	node, err := yaml.Parse(`apiVersion: example.com/v1
+kind: App
+metadata:
+  name: app
+spec:
+  image: image0
+  sidecar:
+    image: image1
+`)
+	if err != nil {
+		t.Fatalf("could not parse resource: %v", err)
+	}
+	fieldSpecs := []FieldSpec{{Path: "spec/image"}, {Path: "spec/sidecar/image"}}
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithFieldSpecs(fieldSpecs), WithAnnotations(true)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	wantOriginalImages := `{"spec.image":"image0","spec.sidecar.image":"image1"}`
+	if got := node.GetAnnotations()[AnnotationOriginalImages]; got != wantOriginalImages {
+		t.Errorf("wanted %s, got %s", wantOriginalImages, got)
+	}
+}
+
+func Test_ImageTags_AnnotationsNotSetWhenPinned(t *testing.T) {
+	node, err := createPodNode([]string{"image0@sha256:pinned"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithAnnotations(true)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	if annotations := node.GetAnnotations(); len(annotations) > 0 {
+		t.Errorf("wanted no annotations, got %v", annotations)
+	}
+}
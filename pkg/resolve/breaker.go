@@ -0,0 +1,203 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned when resolving an image tag fails fast, because
+// the circuit breaker of the registry is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// Circuit breaker states.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitStatus describes the circuit breaker state of a registry host.
+type CircuitStatus struct {
+	Registry string `json:"registry"`
+	State    string `json:"state"`
+	// Failures is the number of consecutive failures.
+	Failures int `json:"failures"`
+	// OpenedAt is the time when the circuit opened, if it is open or
+	// half-open.
+	OpenedAt *time.Time `json:"openedAt,omitempty"`
+}
+
+// CircuitBreaker tracks consecutive failures per registry host. After
+// Threshold failures, the circuit of the registry opens, and image tags from
+// the registry fail fast with ErrCircuitOpen. After OpenDuration, the circuit
+// is half-open, and one request probes the registry. If the probe succeeds,
+// the circuit closes, otherwise it opens again. It is safe for concurrent
+// use, and is meant to be shared across requests.
+type CircuitBreaker struct {
+	Threshold    int
+	OpenDuration time.Duration
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker creates a circuit breaker that opens after threshold
+// consecutive failures, and probes the registry after openDuration. A
+// threshold less than 1 returns nil, which disables the circuit breaker.
+func NewCircuitBreaker(threshold int, openDuration time.Duration) *CircuitBreaker {
+	if threshold < 1 {
+		return nil
+	}
+	return &CircuitBreaker{
+		Threshold:    threshold,
+		OpenDuration: openDuration,
+		circuits:     map[string]*circuit{},
+	}
+}
+
+// WithCircuitBreaker fails fast for registries with open circuits, and
+// records the outcome of registry requests in the circuit breaker. A nil
+// circuit breaker disables this behavior.
+func WithCircuitBreaker(breaker *CircuitBreaker) Option {
+	return func(f *ImageTagFilter) {
+		f.CircuitBreaker = breaker
+	}
+}
+
+// allow returns an error wrapping ErrCircuitOpen if the circuit of the
+// registry is open, or if it is half-open and another request is probing
+// the registry. A nil circuit breaker allows all requests.
+func (b *CircuitBreaker) allow(registry string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(registry)
+	switch c.state {
+	case CircuitOpen:
+		if until := c.openedAt.Add(b.OpenDuration); now().Before(until) {
+			return fmt.Errorf("registry %s failed %d times, not trying again before %s: %w", registry, c.failures, until.UTC().Format(time.RFC3339), ErrCircuitOpen)
+		}
+		c.state = CircuitHalfOpen
+		c.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if c.probing {
+			return fmt.Errorf("registry %s failed %d times, waiting for probe: %w", registry, c.failures, ErrCircuitOpen)
+		}
+		c.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// record updates the circuit of the registry with the outcome of a request.
+// Errors that show that the registry is unavailable count as failures.
+// Other errors, such as unknown tags, count as successes, because the
+// registry responded. Cancellation and the deadline of the caller do not
+// count.
+func (b *CircuitBreaker) record(registry string, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.circuit(registry)
+	wasProbing := c.probing
+	c.probing = false
+	switch {
+	case isCallerDone(err):
+		return
+	case !isUnavailable(err):
+		c.state = CircuitClosed
+		c.failures = 0
+	case c.state == CircuitHalfOpen && wasProbing:
+		c.failures++
+		c.state = CircuitOpen
+		c.openedAt = now()
+	default:
+		c.failures++
+		if c.state == CircuitClosed && c.failures >= b.Threshold {
+			c.state = CircuitOpen
+			c.openedAt = now()
+		}
+	}
+}
+
+// Statuses returns the circuit breaker states of the registries, sorted by
+// registry host.
+func (b *CircuitBreaker) Statuses() []CircuitStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	statuses := make([]CircuitStatus, 0, len(b.circuits))
+	for registry, c := range b.circuits {
+		status := CircuitStatus{Registry: registry, State: c.state, Failures: c.failures}
+		if c.state != CircuitClosed {
+			openedAt := c.openedAt.UTC()
+			status.OpenedAt = &openedAt
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Registry < statuses[j].Registry })
+	return statuses
+}
+
+// circuit returns the circuit of the registry, creating a closed circuit if
+// there is none. Requires b.mu.
+func (b *CircuitBreaker) circuit(registry string) *circuit {
+	c, exists := b.circuits[registry]
+	if !exists {
+		c = &circuit{state: CircuitClosed}
+		b.circuits[registry] = c
+	}
+	return c
+}
+
+// isUnavailable returns true if the error shows that the registry is
+// unavailable: a retryable HTTP status, a registry timeout, or a network
+// error. Errors caused by the cancellation or deadline of the caller, such
+// as the deadline of the admission request, do not show that.
+func isUnavailable(err error) bool {
+	if err == nil || isCallerDone(err) {
+		return false
+	}
+	var netErr net.Error
+	return isRetryable(err) || errors.Is(err, errRegistryTimeout) || errors.As(err, &netErr)
+}
+
+// isCallerDone returns true if the error is caused by the cancellation or
+// deadline of the context of the caller, and not by the registry.
+func isCallerDone(err error) bool {
+	if isRetryable(err) || errors.Is(err, errRegistryTimeout) {
+		return false
+	}
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
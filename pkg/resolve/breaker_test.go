@@ -0,0 +1,139 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func Test_ImageTags_CircuitBreaker(t *testing.T) {
+	origNow := now
+	defer func() { now = origNow }()
+	current := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	var calls int32
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	origResolveTagFn := resolveTagFn
+	defer func() { resolveTagFn = origResolveTagFn }()
+	resolveTagFn = func(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		if code := int(status.Load()); code != http.StatusOK {
+			return "", &transport.Error{StatusCode: code}
+		}
+		return origResolveTagFn(ctx, image, keychain, platform)
+	}
+	breaker := NewCircuitBreaker(2, time.Minute)
+	resolveImage := func(image string) error {
+		node, err := createPodNode([]string{image}, nil)
+		if err != nil {
+			t.Fatalf("could not create pod node: %v", err)
+		}
+		return ImageTags(ctx, log, nil, node, []string{}, WithCircuitBreaker(breaker), WithRetry(RetryPolicy{}))
+	}
+
+	for i, image := range []string{"gcr.io/project/image0", "gcr.io/project/image1"} {
+		if err := resolveImage(image); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("wanted registry error for request %d, got %v", i, err)
+		}
+	}
+	if err := resolveImage("gcr.io/project/image2"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("wanted ErrCircuitOpen, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("wanted 2 registry calls while the circuit is open, got %d", calls)
+	}
+	if err := resolveImage("quay.io/image0"); errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("wanted other registries to be unaffected, got %v", err)
+	}
+	statuses := breaker.Statuses()
+	if len(statuses) != 2 || statuses[0].Registry != "gcr.io" || statuses[0].State != CircuitOpen || statuses[0].Failures != 2 {
+		t.Errorf("wanted open circuit for gcr.io, got %+v", statuses)
+	}
+
+	// The probe after the open duration fails, and the circuit opens again.
+	current = current.Add(time.Minute)
+	calls = 0
+	if err := resolveImage("gcr.io/project/image0"); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("wanted registry error for probe, got %v", err)
+	}
+	if err := resolveImage("gcr.io/project/image0"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("wanted ErrCircuitOpen after failed probe, got %v", err)
+	}
+
+	// The probe succeeds, and the circuit closes.
+	current = current.Add(time.Minute)
+	status.Store(http.StatusOK)
+	if err := resolveImage("gcr.io/project/image0"); err != nil {
+		t.Errorf("wanted probe to succeed, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("wanted 2 probes, got %d", calls)
+	}
+	if statuses := breaker.Statuses(); statuses[0].State != CircuitClosed || statuses[0].Failures != 0 {
+		t.Errorf("wanted closed circuit for gcr.io, got %+v", statuses[0])
+	}
+}
+
+func Test_CircuitBreaker_record(t *testing.T) {
+	breaker := NewCircuitBreaker(1, time.Minute)
+	breaker.record("gcr.io", &transport.Error{StatusCode: http.StatusNotFound})
+	breaker.record("gcr.io", context.Canceled)
+	if err := breaker.allow("gcr.io"); err != nil {
+		t.Errorf("wanted closed circuit after unknown tag and cancellation, got %v", err)
+	}
+	breaker.record("gcr.io", context.DeadlineExceeded)
+	if err := breaker.allow("gcr.io"); err != nil {
+		t.Errorf("wanted closed circuit after deadline of the caller, got %v", err)
+	}
+	breaker.record("gcr.io", fmt.Errorf("%w: %w", errRegistryTimeout, context.DeadlineExceeded))
+	if err := breaker.allow("gcr.io"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("wanted open circuit after registry timeout, got %v", err)
+	}
+	if NewCircuitBreaker(0, time.Minute) != nil {
+		t.Errorf("wanted nil circuit breaker for threshold 0")
+	}
+}
+
+func Test_resolveWithRetry_DeadlineIsNotUnavailable(t *testing.T) {
+	blockUntilDone := func(ctx context.Context) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+
+	f := &ImageTagFilter{Log: log, Retry: &RetryPolicy{}, RegistryTimeout: time.Millisecond}
+	_, err := f.resolveWithRetry(ctx, "image0", "gcr.io", blockUntilDone)
+	if !errors.Is(err, context.DeadlineExceeded) || !isUnavailable(err) {
+		t.Errorf("wanted registry timeout to show unavailable registry, got %v", err)
+	}
+
+	f = &ImageTagFilter{Log: log, Retry: &RetryPolicy{}, RegistryTimeout: time.Minute}
+	deadlineCtx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	_, err = f.resolveWithRetry(deadlineCtx, "image0", "gcr.io", blockUntilDone)
+	if !errors.Is(err, context.DeadlineExceeded) || isUnavailable(err) {
+		t.Errorf("wanted deadline of the caller to not show unavailable registry, got %v", err)
+	}
+}
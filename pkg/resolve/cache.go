@@ -0,0 +1,172 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Cache stores digests of resolved image references, and the tags of
+// repositories for version ranges. Implementations must be safe for
+// concurrent use.
+type Cache interface {
+	// Get returns the digest stored for the key, if present.
+	Get(key string) (string, bool)
+	// Set stores the digest for the key.
+	Set(key string, digest string)
+}
+
+// lruCache is an in-memory Cache that evicts the least recently used entry
+// when full, and that expires entries after a fixed time-to-live.
+type lruCache struct {
+	mu      sync.Mutex
+	maxSize int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List // front is most recently used
+	now     func() time.Time
+}
+
+type lruEntry struct {
+	key     string
+	digest  string
+	expires time.Time
+}
+
+var _ Cache = &lruCache{}
+
+// NewLRUCache creates an in-memory Cache that holds at most maxSize entries,
+// each for at most ttl.
+func NewLRUCache(maxSize int, ttl time.Duration) Cache {
+	return &lruCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// Get returns the digest for the key, unless it is missing or expired.
+func (c *lruCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, exists := c.entries[key]
+	if !exists {
+		return "", false
+	}
+	entry := elem.Value.(*lruEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(elem)
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	return entry.digest, true
+}
+
+// Set stores the digest for the key, evicting the least recently used entry
+// if the cache is full.
+func (c *lruCache) Set(key string, digest string) {
+	if c.maxSize <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(c.ttl)
+	if elem, exists := c.entries[key]; exists {
+		entry := elem.Value.(*lruEntry)
+		entry.digest = digest
+		entry.expires = expires
+		c.order.MoveToFront(elem)
+		return
+	}
+	for c.order.Len() >= c.maxSize {
+		c.remove(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{
+		key:     key,
+		digest:  digest,
+		expires: expires,
+	})
+}
+
+func (c *lruCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*lruEntry).key)
+}
+
+// cacheKey creates a key from the fully-normalized image reference, the
+// target platform, and a hash of the credentials that the keychain provides
+// for the repository. This ensures that a digest resolved using one set of
+// credentials is never served to a request that uses different credentials.
+func cacheKey(image string, keychain authn.Keychain, platform *v1.Platform) (string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", fmt.Errorf("could not parse image reference %s: %w", image, err)
+	}
+	identity, err := credentialsHash(ref.Context(), keychain)
+	if err != nil {
+		return "", err
+	}
+	var platformName string
+	if platform != nil {
+		platformName = platform.String()
+	}
+	return fmt.Sprintf("%s|%s|%s", ref.Name(), platformName, identity), nil
+}
+
+// tagsCacheKey creates a key for the tags of the repository from the
+// fully-normalized repository name and a hash of the credentials, like
+// cacheKey. The prefix separates the keys from the keys of digests.
+func tagsCacheKey(repository string, keychain authn.Keychain) (string, error) {
+	repo, err := name.NewRepository(repository)
+	if err != nil {
+		return "", fmt.Errorf("could not parse repository %s: %w", repository, err)
+	}
+	identity, err := credentialsHash(repo, keychain)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("tags|%s|%s", repo.Name(), identity), nil
+}
+
+// credentialsHash returns a hash of the credentials that the keychain
+// provides for the repository.
+func credentialsHash(repo name.Repository, keychain authn.Keychain) (string, error) {
+	auth, err := keychain.Resolve(repo)
+	if err != nil {
+		return "", fmt.Errorf("could not resolve credentials for %s: %w", repo.Name(), err)
+	}
+	authConfig, err := auth.Authorization()
+	if err != nil {
+		return "", fmt.Errorf("could not get authorization for %s: %w", repo.Name(), err)
+	}
+	authConfigBytes, err := json.Marshal(authConfig)
+	if err != nil {
+		return "", fmt.Errorf("could not marshal authorization for %s: %w", repo.Name(), err)
+	}
+	identity := sha256.Sum256(authConfigBytes)
+	return hex.EncodeToString(identity[:]), nil
+}
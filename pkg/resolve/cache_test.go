@@ -0,0 +1,139 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+type basicKeychain struct {
+	username string
+}
+
+var _ authn.Keychain = &basicKeychain{}
+
+func (kc *basicKeychain) Resolve(_ authn.Resource) (authn.Authenticator, error) {
+	return &authn.Basic{Username: kc.username, Password: "secret"}, nil
+}
+
+func Test_lruCache_Expires(t *testing.T) {
+	now := time.Now()
+	cache := NewLRUCache(10, time.Minute).(*lruCache)
+	cache.now = func() time.Time { return now }
+
+	cache.Set("key", "sha256:digest")
+	if got, exists := cache.Get("key"); !exists || got != "sha256:digest" {
+		t.Errorf("wanted [sha256:digest], got [%s] (exists=%t)", got, exists)
+	}
+
+	now = now.Add(time.Minute)
+	if got, exists := cache.Get("key"); exists {
+		t.Errorf("wanted expired entry, got [%s]", got)
+	}
+}
+
+func Test_lruCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewLRUCache(2, time.Minute)
+
+	cache.Set("key0", "sha256:digest0")
+	cache.Set("key1", "sha256:digest1")
+	cache.Get("key0")
+	cache.Set("key2", "sha256:digest2")
+
+	if _, exists := cache.Get("key1"); exists {
+		t.Errorf("wanted key1 to be evicted")
+	}
+	for _, key := range []string{"key0", "key2"} {
+		if _, exists := cache.Get(key); !exists {
+			t.Errorf("wanted %s to be cached", key)
+		}
+	}
+}
+
+func Test_cacheKey_NormalizesReference(t *testing.T) {
+	key0, err := cacheKey("nginx", &anonymousKeychain{}, nil)
+	if err != nil {
+		t.Fatalf("could not create cache key: %v", err)
+	}
+	key1, err := cacheKey("index.docker.io/library/nginx:latest", &anonymousKeychain{}, nil)
+	if err != nil {
+		t.Fatalf("could not create cache key: %v", err)
+	}
+	if key0 != key1 {
+		t.Errorf("wanted equal keys, got [%s] and [%s]", key0, key1)
+	}
+}
+
+func Test_cacheKey_DiffersByCredentials(t *testing.T) {
+	image := "registry.example.com/repository/image:tag"
+	key0, err := cacheKey(image, &basicKeychain{username: "tenant0"}, nil)
+	if err != nil {
+		t.Fatalf("could not create cache key: %v", err)
+	}
+	key1, err := cacheKey(image, &basicKeychain{username: "tenant1"}, nil)
+	if err != nil {
+		t.Fatalf("could not create cache key: %v", err)
+	}
+	if key0 == key1 {
+		t.Errorf("wanted different keys for different credentials, got [%s]", key0)
+	}
+}
+
+func Test_ImageTagFilter_filterImage_Cache(t *testing.T) {
+	image := "registry.example.com/repository/image:tag"
+	key, err := cacheKey(image, &anonymousKeychain{}, nil)
+	if err != nil {
+		t.Fatalf("could not create cache key: %v", err)
+	}
+	cache := NewLRUCache(10, time.Minute)
+	cache.Set(key, "sha256:cached")
+	node, err := createPodNode([]string{image}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithCache(cache)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	assertContainer(t, node, image+"@sha256:cached", "spec", "containers", "[name=container0]")
+}
+
+func Test_ImageTags_VerifyDigestsWithoutCache(t *testing.T) {
+	image := "registry.example.com/repository/image:tag"
+	key, err := cacheKey(image, &anonymousKeychain{}, nil)
+	if err != nil {
+		t.Fatalf("could not create cache key: %v", err)
+	}
+	cache := NewLRUCache(10, time.Minute)
+	cache.Set(key, "sha256:cached")
+	node, err := createPodNode([]string{image, image + "@sha256:cached"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	var results []Result
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithCache(cache), WithVerifyDigests(true), WithResults(&results)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	wantDigest := "sha256:" + sha256Hex(image)
+	if len(results) != 2 || results[1].Status != StatusMismatch || results[1].Digest != wantDigest {
+		t.Errorf("wanted mismatch with digest %s from the registry, got %+v", wantDigest, results)
+	}
+}
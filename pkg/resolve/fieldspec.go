@@ -0,0 +1,284 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// FieldSpec identifies the location of image references in resources,
+// similar to kustomize field specs. Empty Group, Version, and Kind values
+// match resources of any group, version, and kind.
+type FieldSpec struct {
+	Group   string `json:"group,omitempty" yaml:"group,omitempty"`
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+	Kind    string `json:"kind,omitempty" yaml:"kind,omitempty"`
+	// Path is the slash-separated path to the image reference field. A `[]`
+	// suffix on a path element matches every element of that sequence, e.g.,
+	// `spec/template/spec/containers[]/image`.
+	Path string `json:"path" yaml:"path"`
+}
+
+// FieldSpecList is the format of field spec configuration files.
+type FieldSpecList struct {
+	FieldSpecs []FieldSpec `json:"fieldSpecs" yaml:"fieldSpecs"`
+}
+
+// podSpecImagePaths are the paths to image references in a Pod spec.
+var podSpecImagePaths = []string{
+	"containers[]/image",
+	"initContainers[]/image",
+	"ephemeralContainers[]/image",
+	"volumes[]/image/reference",
+}
+
+// containerLists are the names of the lists of containers in a Pod spec.
+var containerLists = map[string]bool{
+	"containers":          true,
+	"initContainers":      true,
+	"ephemeralContainers": true,
+}
+
+// DefaultFieldSpecs are the built-in locations of image references in Pod
+// specs and Pod template specs.
+var DefaultFieldSpecs = append(
+	podSpecFieldSpecs("", "spec", "spec/template/spec"),
+	podSpecFieldSpecs("CronJob", "spec/jobTemplate/spec/template/spec")...,
+)
+
+// podSpecFieldSpecs creates field specs for the image references of Pod specs
+// located at the provided paths in resources of the kind.
+func podSpecFieldSpecs(kind string, podSpecPaths ...string) []FieldSpec {
+	var fieldSpecs []FieldSpec
+	for _, podSpecPath := range podSpecPaths {
+		for _, imagePath := range podSpecImagePaths {
+			fieldSpecs = append(fieldSpecs, FieldSpec{
+				Kind: kind,
+				Path: podSpecPath + "/" + imagePath,
+			})
+		}
+	}
+	return fieldSpecs
+}
+
+// LoadFieldSpecs reads field specs from a YAML file containing a
+// `fieldSpecs` list, and returns them appended to the DefaultFieldSpecs.
+func LoadFieldSpecs(filename string) ([]FieldSpec, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read field specs file %s: %w", filename, err)
+	}
+	var list FieldSpecList
+	if err := unmarshalStrict(b, &list); err != nil {
+		return nil, fmt.Errorf("could not parse field specs file %s: %w", filename, err)
+	}
+	for _, fieldSpec := range list.FieldSpecs {
+		if err := fieldSpec.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid field spec in %s: %w", filename, err)
+		}
+	}
+	return append(append([]FieldSpec{}, DefaultFieldSpecs...), list.FieldSpecs...), nil
+}
+
+// unmarshalStrict decodes the YAML document into v, and returns an error
+// for unknown fields, so that typos in configuration files do not go
+// unnoticed. An empty document is valid.
+func unmarshalStrict(b []byte, v interface{}) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// Validate returns an error if the path is empty, contains empty elements,
+// or starts with `[]`, because resources are not sequences.
+func (fs FieldSpec) Validate() error {
+	if fs.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	elements := fs.pathElements()
+	for _, element := range elements {
+		if element == "" {
+			return fmt.Errorf("path %s contains an empty element", fs.Path)
+		}
+	}
+	if elements[0] == "[]" {
+		return fmt.Errorf("path %s must start with a field name", fs.Path)
+	}
+	return nil
+}
+
+// Matches returns true if the field spec applies to the resource.
+func (fs FieldSpec) Matches(n *yaml.RNode) bool {
+	group, version := "", n.GetApiVersion()
+	if i := strings.LastIndex(version, "/"); i >= 0 {
+		group, version = version[:i], version[i+1:]
+	}
+	return (fs.Group == "" || fs.Group == group) &&
+		(fs.Version == "" || fs.Version == version) &&
+		(fs.Kind == "" || fs.Kind == n.GetKind())
+}
+
+// pathElements splits the path into elements that lookupAll understands.
+func (fs FieldSpec) pathElements() []string {
+	var elements []string
+	for _, element := range strings.Split(fs.Path, "/") {
+		if element != "[]" && strings.HasSuffix(element, "[]") {
+			elements = append(elements, strings.TrimSuffix(element, "[]"), "[]")
+			continue
+		}
+		elements = append(elements, element)
+	}
+	return elements
+}
+
+// Images returns the image references in the resource, at the locations
+// identified by the field specs. A nil value means DefaultFieldSpecs.
+func Images(n *yaml.RNode, fieldSpecs []FieldSpec) ([]string, error) {
+	fields, err := findImages(n, fieldSpecs)
+	if err != nil {
+		return nil, err
+	}
+	images := make([]string, len(fields))
+	for i, field := range fields {
+		images[i] = yaml.GetValue(field.node)
+	}
+	return images, nil
+}
+
+// imageField is an image reference found in a resource.
+type imageField struct {
+	node *yaml.RNode
+	// path is the path to the field, e.g., `spec.containers[name=app].image`.
+	path string
+	// list is the name of the innermost sequence field on the path, e.g.,
+	// `containers`, and name is the value of the `name` field of the
+	// sequence element, or the index of the element if it has no name.
+	list string
+	name string
+}
+
+// findImages returns the distinct image reference fields in the resource
+// that match the field specs. A nil value means DefaultFieldSpecs.
+func findImages(n *yaml.RNode, fieldSpecs []FieldSpec) ([]imageField, error) {
+	if fieldSpecs == nil {
+		fieldSpecs = DefaultFieldSpecs
+	}
+	var images []imageField
+	seen := map[*yaml.Node]bool{}
+	for _, fieldSpec := range fieldSpecs {
+		if !fieldSpec.Matches(n) {
+			continue
+		}
+		fields, err := lookupFields(n, fieldSpec.pathElements(), imageField{})
+		if err != nil {
+			return nil, fmt.Errorf("could not lookup %s: %w", fieldSpec.Path, err)
+		}
+		for _, field := range fields {
+			if !seen[field.node.YNode()] {
+				seen[field.node.YNode()] = true
+				images = append(images, field)
+			}
+		}
+	}
+	return images, nil
+}
+
+// lookupAll returns all nodes that match the path. A `[]` path element
+// matches every element of a sequence. Missing fields are not an error.
+func lookupAll(n *yaml.RNode, path []string) ([]*yaml.RNode, error) {
+	fields, err := lookupFields(n, path, imageField{})
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]*yaml.RNode, len(fields))
+	for i, field := range fields {
+		nodes[i] = field.node
+	}
+	return nodes, nil
+}
+
+// lookupFields returns all fields that match the path, relative to the
+// parent field.
+func lookupFields(n *yaml.RNode, path []string, parent imageField) ([]imageField, error) {
+	for i, field := range path {
+		if field != "[]" {
+			continue
+		}
+		seq, err := n.Pipe(yaml.Lookup(path[:i]...))
+		if err != nil || seq == nil {
+			return nil, err
+		}
+		elements, err := seq.Elements()
+		if err != nil {
+			return nil, err
+		}
+		// A leading `[]` matches the elements of n itself, which is the list
+		// of the parent field, if any.
+		list := parent.list
+		if i > 0 {
+			list = path[i-1]
+		}
+		var fields []imageField
+		for index, element := range elements {
+			elementField := imageField{
+				path: joinPath(parent.path, path[:i]...),
+				list: list,
+				name: strconv.Itoa(index),
+			}
+			nameNode, err := element.Pipe(yaml.Lookup("name"))
+			if elementName := yaml.GetValue(nameNode); err == nil && elementName != "" {
+				elementField.name = elementName
+				elementField.path += fmt.Sprintf("[name=%s]", elementName)
+			} else {
+				elementField.path += fmt.Sprintf("[%d]", index)
+			}
+			found, err := lookupFields(element, path[i+1:], elementField)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, found...)
+		}
+		return fields, nil
+	}
+	node, err := n.Pipe(yaml.Lookup(path...))
+	if err != nil || node == nil {
+		return nil, err
+	}
+	parent.node = node
+	parent.path = joinPath(parent.path, path...)
+	return []imageField{parent}, nil
+}
+
+// joinPath appends the elements to the dot-separated path.
+func joinPath(path string, elements ...string) string {
+	for _, element := range elements {
+		if path != "" {
+			path += "."
+		}
+		path += element
+	}
+	return path
+}
@@ -0,0 +1,152 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const tektonTask = `apiVersion: tekton.dev/v1
+kind: Task
+metadata:
+  name: test-task
+spec:
+  steps:
+  - name: step0
+    image: image0
+  - name: step1
+    image: image1
+  sidecars:
+  - name: sidecar0
+    image: image2
+`
+
+func Test_FieldSpec_pathElements(t *testing.T) {
+	fieldSpec := FieldSpec{Path: "spec/template/spec/containers[]/image"}
+
+	got := fieldSpec.pathElements()
+
+	want := []string{"spec", "template", "spec", "containers", "[]", "image"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("path elements mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func Test_FieldSpec_Validate(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantErr bool
+	}{
+		{"spec/steps[]/image", false},
+		{"", true},
+		{"spec//image", true},
+		{"[]/image", true},
+	}
+	for _, test := range tests {
+		if err := (FieldSpec{Path: test.path}).Validate(); (err != nil) != test.wantErr {
+			t.Errorf("%q: wanted error %t, got %v", test.path, test.wantErr, err)
+		}
+	}
+}
+
+func Test_FieldSpec_Matches(t *testing.T) {
+	node, err := yaml.Parse(tektonTask)
+	if err != nil {
+		t.Fatalf("could not parse task: %v", err)
+	}
+	tests := []struct {
+		fieldSpec FieldSpec
+		want      bool
+	}{
+		{FieldSpec{}, true},
+		{FieldSpec{Group: "tekton.dev"}, true},
+		{FieldSpec{Group: "tekton.dev", Version: "v1", Kind: "Task"}, true},
+		{FieldSpec{Group: "tekton.dev", Version: "v1beta1", Kind: "Task"}, false},
+		{FieldSpec{Kind: "Pipeline"}, false},
+		{FieldSpec{Group: "apps"}, false},
+	}
+	for _, test := range tests {
+		if got := test.fieldSpec.Matches(node); got != test.want {
+			t.Errorf("%+v: wanted %t, got %t", test.fieldSpec, test.want, got)
+		}
+	}
+}
+
+func Test_LoadFieldSpecs(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "fieldspecs.yaml")
+	if err := os.WriteFile(filename, []byte(`fieldSpecs:
+- group: tekton.dev
+  kind: Task
+  path: spec/steps[]/image
+- group: tekton.dev
+  kind: Task
+  path: spec/sidecars[]/image
+`), 0o600); err != nil {
+		t.Fatalf("could not write field specs file: %v", err)
+	}
+
+	fieldSpecs, err := LoadFieldSpecs(filename)
+	if err != nil {
+		t.Fatalf("could not load field specs: %v", err)
+	}
+
+	if len(fieldSpecs) != len(DefaultFieldSpecs)+2 {
+		t.Errorf("wanted %d field specs, got %d", len(DefaultFieldSpecs)+2, len(fieldSpecs))
+	}
+	node, err := yaml.Parse(tektonTask)
+	if err != nil {
+		t.Fatalf("could not parse task: %v", err)
+	}
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithFieldSpecs(fieldSpecs)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+	assertContainer(t, node, "image0@sha256:07d7d43fe9dd151e40f0a8d54c5211a8601b04e4a8fa7ad57ea5e73e4ffa7e4a", "spec", "steps", "[name=step0]")
+	assertContainer(t, node, "image1@sha256:cc292b92ce7f10f2e4f727ecdf4b12528127c51b6ddf6058e213674603190d06", "spec", "steps", "[name=step1]")
+	assertContainer(t, node, "image2@sha256:5bb21ac469b5e7df4e17899d4aae0adfb430f0f0b336a2242ef1a22d25bd2e53", "spec", "sidecars", "[name=sidecar0]")
+}
+
+func Test_LoadFieldSpecs_Invalid(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "fieldspecs.yaml")
+	if err := os.WriteFile(filename, []byte(`fieldSpecs:
+- kind: Task
+  path: spec//image
+`), 0o600); err != nil {
+		t.Fatalf("could not write field specs file: %v", err)
+	}
+
+	if _, err := LoadFieldSpecs(filename); err == nil {
+		t.Errorf("wanted error for empty path element, got nil")
+	}
+}
+
+func Test_LoadFieldSpecs_UnknownField(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "fieldspecs.yaml")
+	if err := os.WriteFile(filename, []byte(`fieldSpecs:
+- kind: Task
+  pth: spec/steps[]/image
+`), 0o600); err != nil {
+		t.Fatalf("could not write field specs file: %v", err)
+	}
+
+	if _, err := LoadFieldSpecs(filename); err == nil || !strings.Contains(err.Error(), "pth") {
+		t.Errorf("wanted error for unknown field pth, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// LastKnownGood records the digests that image tags resolved to, so that
+// the digests can be used when the registries are unavailable. It uses the
+// lock file format for persistence. It is safe for concurrent use, and is
+// meant to be shared across requests.
+type LastKnownGood struct {
+	// MaxAge is the maximum age of digests that are used. Zero means no
+	// limit.
+	MaxAge time.Duration
+
+	lock    *Lock
+	changed atomic.Bool
+}
+
+// NewLastKnownGood creates an empty last-known-good store that uses digests
+// resolved at most maxAge ago. A maxAge of zero means no limit.
+func NewLastKnownGood(maxAge time.Duration) *LastKnownGood {
+	return &LastKnownGood{
+		MaxAge: maxAge,
+		lock:   NewLock(),
+	}
+}
+
+// WithLastKnownGood records the digests of the image tags that are resolved,
+// and uses the recorded digests when the registry of an image tag is
+// unavailable. A nil store disables this behavior.
+func WithLastKnownGood(lkg *LastKnownGood) Option {
+	return func(f *ImageTagFilter) {
+		f.LastKnownGood = lkg
+	}
+}
+
+// Load merges the entries of the serialized lock into the store. For image
+// references that are in both, the more recently resolved entry wins.
+func (s *LastKnownGood) Load(data []byte) error {
+	l, err := ParseLock(data)
+	if err != nil {
+		return err
+	}
+	for _, entry := range l.Entries() {
+		if existing, exists := s.lock.get(entry.Image, entry.Platform, entry.Credentials); exists && !existing.ResolvedAt.Before(entry.ResolvedAt) {
+			continue
+		}
+		s.lock.Set(entry)
+	}
+	return nil
+}
+
+// LoadFile merges the entries of the lock file into the store. A missing
+// file is not an error.
+func (s *LastKnownGood) LoadFile(filename string) error {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read last-known-good file %s: %w", filename, err)
+	}
+	if err := s.Load(data); err != nil {
+		return fmt.Errorf("could not parse last-known-good file %s: %w", filename, err)
+	}
+	return nil
+}
+
+// Marshal returns the entries of the store in the lock file format.
+func (s *LastKnownGood) Marshal() ([]byte, error) {
+	return s.lock.Marshal()
+}
+
+// SaveFile writes the entries of the store to the file in the lock file
+// format.
+func (s *LastKnownGood) SaveFile(filename string) error {
+	data, err := s.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		return fmt.Errorf("could not write last-known-good file %s: %w", filename, err)
+	}
+	return nil
+}
+
+// TakeChanged returns true if entries were recorded since the last call,
+// and resets the flag. It tells callers when to persist the store.
+func (s *LastKnownGood) TakeChanged() bool {
+	return s.changed.Swap(false)
+}
+
+// record stores the entry, unless the recorded entry has the same digest
+// and mirror, and is younger than a tenth of MaxAge. This keeps the store
+// mostly unchanged between writes when it is persisted.
+func (s *LastKnownGood) record(entry LockEntry) {
+	if existing, exists := s.lock.get(entry.Image, entry.Platform, entry.Credentials); exists &&
+		existing.Digest == entry.Digest &&
+		existing.Mirror == entry.Mirror &&
+		(s.MaxAge == 0 || entry.ResolvedAt.Sub(existing.ResolvedAt) < s.MaxAge/10) {
+		return
+	}
+	s.lock.Set(entry)
+	s.changed.Store(true)
+}
+
+// lookup returns the entry for the image reference, platform, and
+// credentials hash, if present and not older than MaxAge.
+func (s *LastKnownGood) lookup(image string, platform *v1.Platform, credentials string) (LockEntry, bool) {
+	entry, exists := s.lock.get(image, platformString(platform), credentials)
+	if !exists {
+		return LockEntry{}, false
+	}
+	if s.MaxAge > 0 && now().Sub(entry.ResolvedAt) > s.MaxAge {
+		return LockEntry{}, false
+	}
+	return entry, true
+}
+
+// resolveTagWithFallback resolves the tag, and records the digest in the
+// last-known-good store, if there is one, unless the digest is from the
+// cache, because the time when it was resolved is not known. If the registry
+// is unavailable, it returns the last-known-good digest instead, if present
+// for the same credentials, unless the resolution verifies a digest.
+func (f *ImageTagFilter) resolveTagWithFallback(image string) resolution {
+	res := f.resolveTagWithLock(image)
+	if f.LastKnownGood == nil || f.LockOnly {
+		return res
+	}
+	if res.err == nil {
+		if !res.cached {
+			if credentials, ok := f.lastKnownGoodCredentials(image); ok {
+				entry := f.newLockEntry(image, res.digest, res.served)
+				entry.Credentials = credentials
+				f.LastKnownGood.record(entry)
+			}
+		}
+		return res
+	}
+	err := res.err
+	if f.noFallback || !canFallBack(err) {
+		return resolution{err: err}
+	}
+	credentials, ok := f.lastKnownGoodCredentials(image)
+	if !ok {
+		return resolution{err: err}
+	}
+	entry, exists := f.LastKnownGood.lookup(image, f.Platform, credentials)
+	if !exists {
+		return resolution{err: err}
+	}
+	served := image
+	if entry.Mirror != "" {
+		served = entry.Mirror
+	}
+	return resolution{digest: entry.Digest, served: served, stale: &entry, staleErr: err}
+}
+
+// lastKnownGoodCredentials returns the hash of the credentials for the
+// repository of the image reference, or for the repository, as used in cache
+// keys, so that digests resolved with one set of credentials are not used
+// with another. It returns false if the credentials cannot be resolved, and
+// then the store is not used.
+func (f *ImageTagFilter) lastKnownGoodCredentials(image string) (string, bool) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", false
+	}
+	credentials, err := credentialsHash(ref.Context(), f.Keychain)
+	if err != nil {
+		f.Log.V(1).Info("not using last-known-good store", "image", image, "reason", err.Error())
+		return "", false
+	}
+	return credentials, true
+}
+
+// canFallBack returns true if a last-known-good digest can replace the failed
+// resolution, because the registry is unavailable, its circuit is open, or
+// resolving exceeded the deadline of the caller, such as the resolve timeout.
+func canFallBack(err error) bool {
+	return isUnavailable(err) || errors.Is(err, ErrCircuitOpen) || errors.Is(err, context.DeadlineExceeded)
+}
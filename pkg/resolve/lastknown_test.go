@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func Test_ImageTags_LastKnownGood(t *testing.T) {
+	origNow := now
+	defer func() { now = origNow }()
+	current := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return current }
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	origResolveTagFn := resolveTagFn
+	defer func() { resolveTagFn = origResolveTagFn }()
+	resolveTagFn = func(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error) {
+		if code := int(status.Load()); code != http.StatusOK {
+			return "", &transport.Error{StatusCode: code}
+		}
+		return origResolveTagFn(ctx, image, keychain, platform)
+	}
+	lkg := NewLastKnownGood(time.Hour)
+	resolveImage := func(image string) ([]Result, error) {
+		node, err := createPodNode([]string{image}, nil)
+		if err != nil {
+			t.Fatalf("could not create pod node: %v", err)
+		}
+		var results []Result
+		err = ImageTags(ctx, log, nil, node, []string{}, WithLastKnownGood(lkg), WithRetry(RetryPolicy{}), WithResults(&results))
+		return results, err
+	}
+
+	if _, err := resolveImage("image0"); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+	if !lkg.TakeChanged() {
+		t.Errorf("wanted changed store after resolving")
+	}
+
+	current = current.Add(30 * time.Minute)
+	status.Store(http.StatusServiceUnavailable)
+	results, err := resolveImage("image0")
+	if err != nil {
+		t.Fatalf("wanted last-known-good digest, got %v", err)
+	}
+	want := "sha256:" + sha256Hex("image0")
+	if len(results) != 1 || results[0].Status != StatusResolved || !results[0].Stale || results[0].Digest != want {
+		t.Fatalf("wanted stale result with digest %s, got %+v", want, results)
+	}
+	if !results[0].ResolvedAt.Equal(time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("wanted resolvedAt of first resolution, got %v", results[0].ResolvedAt)
+	}
+	var transportErr *transport.Error
+	if !errors.As(results[0].Err, &transportErr) || transportErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("wanted status 503 error in stale result, got %v", results[0].Err)
+	}
+	if lkg.TakeChanged() {
+		t.Errorf("wanted unchanged store after using last-known-good digest")
+	}
+
+	if _, err := resolveImage("image1"); err == nil {
+		t.Errorf("wanted error for image without last-known-good digest")
+	}
+
+	status.Store(http.StatusNotFound)
+	if _, err := resolveImage("image0"); err == nil {
+		t.Errorf("wanted no fallback for unknown tag")
+	}
+
+	current = current.Add(time.Hour)
+	status.Store(http.StatusServiceUnavailable)
+	if _, err := resolveImage("image0"); err == nil {
+		t.Errorf("wanted no fallback after max age")
+	}
+}
+
+func Test_ImageTags_LastKnownGood_NotUsedToVerify(t *testing.T) {
+	lkg := NewLastKnownGood(0)
+	image := "registry.example.com/repository/image:tag"
+	digest := "sha256:" + sha256Hex(image)
+	node, err := createPodNode([]string{image}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithLastKnownGood(lkg)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	stubStatusResolveTagFn(t, http.StatusServiceUnavailable)
+	node, err = createPodNode([]string{image + "@" + digest}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	var results []Result
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithLastKnownGood(lkg), WithVerifyDigests(true), WithContinueOnError(true), WithRetry(RetryPolicy{}), WithResults(&results)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+	if len(results) != 1 || results[0].Status != StatusFailed || results[0].Stale {
+		t.Errorf("wanted failed result instead of verification with last-known-good digest, got %+v", results)
+	}
+}
+
+func Test_LastKnownGood_Credentials(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	origResolveTagFn := resolveTagFn
+	defer func() { resolveTagFn = origResolveTagFn }()
+	resolveTagFn = func(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error) {
+		if code := int(status.Load()); code != http.StatusOK {
+			return "", &transport.Error{StatusCode: code}
+		}
+		return origResolveTagFn(ctx, image, keychain, platform)
+	}
+	lkg := NewLastKnownGood(0)
+	newFilter := func(username string) *ImageTagFilter {
+		return &ImageTagFilter{
+			Log:           log,
+			Keychain:      &basicKeychain{username: username},
+			LastKnownGood: lkg,
+			Retry:         &RetryPolicy{},
+		}
+	}
+	image := "registry.example.com/repository/image:tag"
+
+	if res := newFilter("tenant0").resolveTagWithFallback(image); res.err != nil {
+		t.Fatalf("problem resolving image tag: %v", res.err)
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+	if res := newFilter("tenant1").resolveTagWithFallback(image); res.err == nil || res.stale != nil {
+		t.Errorf("wanted no last-known-good digest for other credentials, got %+v", res)
+	}
+	if res := newFilter("tenant0").resolveTagWithFallback(image); res.err != nil || res.stale == nil {
+		t.Errorf("wanted last-known-good digest for same credentials, got %+v", res)
+	}
+}
+
+func Test_LastKnownGood_LoadFile(t *testing.T) {
+	older := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	lkg := NewLastKnownGood(0)
+	lkg.lock.Set(LockEntry{Image: "image0", Digest: "sha256:new", ResolvedAt: newer})
+	lkg.lock.Set(LockEntry{Image: "image1", Digest: "sha256:old", ResolvedAt: older})
+
+	other := NewLock()
+	other.Set(LockEntry{Image: "image0", Digest: "sha256:old", ResolvedAt: older})
+	other.Set(LockEntry{Image: "image1", Digest: "sha256:new", ResolvedAt: newer})
+	other.Set(LockEntry{Image: "image2", Digest: "sha256:new", ResolvedAt: newer})
+	filename := filepath.Join(t.TempDir(), "last-known-good.yaml")
+	if err := other.Save(filename); err != nil {
+		t.Fatalf("could not save lock: %v", err)
+	}
+	if err := lkg.LoadFile(filename); err != nil {
+		t.Fatalf("could not load last-known-good file: %v", err)
+	}
+	for _, image := range []string{"image0", "image1", "image2"} {
+		if entry, exists := lkg.lookup(image, nil, ""); !exists || entry.Digest != "sha256:new" {
+			t.Errorf("wanted newer digest for %s, got %+v", image, entry)
+		}
+	}
+	if err := lkg.LoadFile(filepath.Join(t.TempDir(), "missing.yaml")); err != nil {
+		t.Errorf("wanted no error for missing file, got %v", err)
+	}
+}
+
+func Test_ImageTags_LastKnownGood_NotRecordedFromCache(t *testing.T) {
+	image := "registry.example.com/repository/image:tag"
+	key, err := cacheKey(image, &anonymousKeychain{}, nil)
+	if err != nil {
+		t.Fatalf("could not create cache key: %v", err)
+	}
+	cache := NewLRUCache(10, time.Minute)
+	cache.Set(key, "sha256:cached")
+	lkg := NewLastKnownGood(time.Hour)
+	node, err := createPodNode([]string{image}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithCache(cache), WithLastKnownGood(lkg)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	if _, exists := lkg.lookup(image, nil, ""); exists || lkg.TakeChanged() {
+		t.Errorf("wanted no last-known-good entry for digest from the cache")
+	}
+}
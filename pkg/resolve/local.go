@@ -0,0 +1,402 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// Annotations on the descriptors in the index.json of an OCI image layout
+// that contain the image reference. Docker sets the containerd annotation to
+// the full image reference, and the OCI annotation to the tag only. Tools
+// such as oras and skopeo only set the OCI annotation, often to the tag only.
+const (
+	annotationRefName        = "org.opencontainers.image.ref.name"
+	annotationContainerdName = "io.containerd.image.name"
+)
+
+// maxManifestSize is the maximum size of a manifest or index blob that is
+// read from a tarball.
+const maxManifestSize = 4 << 20
+
+// ErrImageNotFound is returned by local resolvers when the image reference is
+// not in any of the local images.
+var ErrImageNotFound = errors.New("image not found in local images")
+
+// Resolver resolves an image tag to a digest.
+// Implementations must be safe for concurrent use.
+type Resolver interface {
+	// Resolve returns the digest of the image reference. If platform is not
+	// nil and the image is a multi-platform image, it returns the digest of
+	// the image manifest for the platform.
+	Resolve(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error)
+}
+
+// TagLister lists the tags of a repository, for resolving version ranges.
+// Resolvers that do not implement TagLister, such as resolvers for local
+// images, cannot resolve version ranges.
+type TagLister interface {
+	ListTags(ctx context.Context, repository string, keychain authn.Keychain) ([]string, error)
+}
+
+// ErrListTagsUnsupported is returned when resolving a version range, if the
+// Resolver cannot list the tags of repositories.
+var ErrListTagsUnsupported = errors.New("version ranges require a registry, local images cannot list tags")
+
+// RegistryResolver resolves image tags using the registry. It is the default
+// Resolver.
+var RegistryResolver Resolver = registryResolver{}
+
+type registryResolver struct{}
+
+func (registryResolver) Resolve(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error) {
+	return resolveTagFn(ctx, image, keychain, platform)
+}
+
+func (registryResolver) ListTags(ctx context.Context, repository string, keychain authn.Keychain) ([]string, error) {
+	return listTagsFn(ctx, repository, keychain)
+}
+
+// ChainResolvers creates a Resolver that tries the resolvers in order, and
+// returns the first digest. If all resolvers fail, it returns the errors of
+// all resolvers.
+func ChainResolvers(resolvers ...Resolver) Resolver {
+	return chainResolver(resolvers)
+}
+
+type chainResolver []Resolver
+
+func (c chainResolver) Resolve(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error) {
+	var errs []error
+	for _, r := range c {
+		digest, err := r.Resolve(ctx, image, keychain, platform)
+		if err == nil {
+			return digest, nil
+		}
+		errs = append(errs, err)
+	}
+	return "", errors.Join(errs...)
+}
+
+// ListTags lists the tags using the first resolver that implements
+// TagLister.
+func (c chainResolver) ListTags(ctx context.Context, repository string, keychain authn.Keychain) ([]string, error) {
+	for _, r := range c {
+		if lister, ok := r.(TagLister); ok {
+			return lister.ListTags(ctx, repository, keychain)
+		}
+	}
+	return nil, ErrListTagsUnsupported
+}
+
+// WithResolver resolves image tags using the resolver, instead of the
+// registry.
+func WithResolver(resolver Resolver) Option {
+	return func(f *ImageTagFilter) {
+		f.Resolver = resolver
+	}
+}
+
+// localResolver resolves image tags using the index.json of OCI image
+// layouts on disk, and the manifest.json of `docker save` tarballs.
+type localResolver struct {
+	images map[string]localImage // key is the normalized image reference
+	tags   map[string]localImage // images that are only identified by a tag
+}
+
+type localImage struct {
+	source    string
+	digest    string
+	manifests []v1.Descriptor // platform-specific manifests, if an index
+}
+
+// NewLocalResolver creates a Resolver that looks up image tags in local
+// images. Every path is either an OCI image layout directory, a tarball that
+// contains an OCI image layout, such as the output of `docker save` with
+// Docker 25 or later, a tarball from `docker save` with earlier Docker
+// versions, or a directory that contains such directories and tarballs
+// (`*.tar`). If several local images have the same image reference, the
+// first one is used. Images in OCI image layouts that are only identified by
+// a tag match image references with that tag in any repository, unless
+// another local image has the full image reference.
+func NewLocalResolver(paths []string) (Resolver, error) {
+	r := &localResolver{images: map[string]localImage{}, tags: map[string]localImage{}}
+	for _, p := range paths {
+		if err := r.addPath(p); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *localResolver) Resolve(_ context.Context, image string, _ authn.Keychain, platform *v1.Platform) (string, error) {
+	local, exists := r.lookup(image)
+	if !exists {
+		return "", fmt.Errorf("%w: %s", ErrImageNotFound, image)
+	}
+	if platform == nil || len(local.manifests) == 0 {
+		return local.digest, nil
+	}
+	for _, manifest := range local.manifests {
+		if manifest.Platform != nil && manifest.Platform.Satisfies(*platform) {
+			return manifest.Digest.String(), nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s has no manifest for platform %s in %s", ErrImageNotFound, image, platform, local.source)
+}
+
+// lookup returns the local image with the image reference, or else the local
+// image that is only identified by the tag of the image reference.
+func (r *localResolver) lookup(image string) (localImage, bool) {
+	if local, exists := r.images[normalizeReference(image)]; exists {
+		return local, true
+	}
+	tag, err := name.NewTag(image)
+	if err != nil {
+		return localImage{}, false
+	}
+	local, exists := r.tags[tag.TagStr()]
+	return local, exists
+}
+
+// add adds the local image for the image reference, unless another local
+// image has the same image reference.
+func (r *localResolver) add(ref string, local localImage) {
+	key := normalizeReference(ref)
+	if _, exists := r.images[key]; !exists {
+		r.images[key] = local
+	}
+}
+
+// addPath adds the images in the path.
+func (r *localResolver) addPath(p string) error {
+	info, err := os.Stat(p)
+	if err != nil {
+		return fmt.Errorf("could not read local images: %w", err)
+	}
+	if !info.IsDir() {
+		return r.addTarball(p)
+	}
+	if _, err := os.Stat(filepath.Join(p, "index.json")); err == nil {
+		return r.addLayoutDir(p)
+	}
+	entries, err := os.ReadDir(p)
+	if err != nil {
+		return fmt.Errorf("could not read local images: %w", err)
+	}
+	for _, entry := range entries {
+		entryPath := filepath.Join(p, entry.Name())
+		switch {
+		case entry.IsDir():
+			if _, err := os.Stat(filepath.Join(entryPath, "index.json")); err == nil {
+				if err := r.addLayoutDir(entryPath); err != nil {
+					return err
+				}
+			}
+		case strings.HasSuffix(entry.Name(), ".tar"):
+			if err := r.addTarball(entryPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addLayoutDir adds the images in the OCI image layout directory.
+func (r *localResolver) addLayoutDir(dir string) error {
+	indexJSON, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		return fmt.Errorf("could not read OCI image layout %s: %w", dir, err)
+	}
+	readBlob := func(h v1.Hash) ([]byte, error) {
+		return os.ReadFile(filepath.Join(dir, "blobs", h.Algorithm, h.Hex))
+	}
+	if err := r.addLayout(dir, indexJSON, readBlob); err != nil {
+		return fmt.Errorf("could not read OCI image layout %s: %w", dir, err)
+	}
+	return nil
+}
+
+// addTarball adds the images in the tarball, which must contain an OCI
+// image layout or a `docker save` manifest.json. Layers are not read, unless
+// the tarball only contains a manifest.json, see addDockerTarball.
+func (r *localResolver) addTarball(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not read image tarball %s: %w", filename, err)
+	}
+	defer f.Close()
+	var indexJSON []byte
+	hasManifestJSON := false
+	blobs := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not read image tarball %s: %w", filename, err)
+		}
+		entryName := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if entryName == "manifest.json" {
+			hasManifestJSON = true
+		}
+		if header.Typeflag != tar.TypeReg || (entryName != "index.json" && !strings.HasPrefix(entryName, "blobs/")) || header.Size > maxManifestSize {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("could not read %s in image tarball %s: %w", entryName, filename, err)
+		}
+		if entryName == "index.json" {
+			indexJSON = data
+		} else {
+			blobs[entryName] = data
+		}
+	}
+	if indexJSON == nil && hasManifestJSON {
+		return r.addDockerTarball(filename)
+	}
+	if indexJSON == nil {
+		return fmt.Errorf("image tarball %s does not contain an OCI image layout or a `docker save` manifest.json", filename)
+	}
+	readBlob := func(h v1.Hash) ([]byte, error) {
+		data, exists := blobs[path.Join("blobs", h.Algorithm, h.Hex)]
+		if !exists {
+			return nil, fmt.Errorf("blob %s not found", h)
+		}
+		return data, nil
+	}
+	if err := r.addLayout(filename, indexJSON, readBlob); err != nil {
+		return fmt.Errorf("could not read image tarball %s: %w", filename, err)
+	}
+	return nil
+}
+
+// addDockerTarball adds the images in a tarball from `docker save` that does
+// not contain an OCI image layout, such as from Docker before version 25.
+// These tarballs do not contain image manifests, so the digest is the digest
+// of the manifest that go-containerregistry creates for the image, which is
+// the digest after pushing the tarball with crane. This requires compressing
+// the layers. Pushing the image with Docker can result in another digest.
+func (r *localResolver) addDockerTarball(filename string) error {
+	opener := func() (io.ReadCloser, error) {
+		return os.Open(filename)
+	}
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return fmt.Errorf("could not read image tarball %s: %w", filename, err)
+	}
+	for _, desc := range manifest {
+		if len(desc.RepoTags) == 0 {
+			continue
+		}
+		tag, err := name.NewTag(desc.RepoTags[0])
+		if err != nil {
+			return fmt.Errorf("could not parse tag %s in image tarball %s: %w", desc.RepoTags[0], filename, err)
+		}
+		img, err := tarball.Image(opener, &tag)
+		if err != nil {
+			return fmt.Errorf("could not read image %s in image tarball %s: %w", tag, filename, err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			return fmt.Errorf("could not compute digest of image %s in image tarball %s: %w", tag, filename, err)
+		}
+		local := localImage{source: filename, digest: digest.String()}
+		for _, ref := range desc.RepoTags {
+			r.add(ref, local)
+		}
+	}
+	return nil
+}
+
+// addLayout adds the images in the index.json of an OCI image layout. For
+// image indexes, it also reads the platform-specific manifests.
+func (r *localResolver) addLayout(source string, indexJSON []byte, readBlob func(v1.Hash) ([]byte, error)) error {
+	index, err := v1.ParseIndexManifest(bytes.NewReader(indexJSON))
+	if err != nil {
+		return fmt.Errorf("could not parse index.json: %w", err)
+	}
+	for _, desc := range index.Manifests {
+		refs, tag := imageReferences(desc.Annotations)
+		if len(refs) == 0 && tag == "" {
+			continue
+		}
+		local := localImage{source: source, digest: desc.Digest.String()}
+		if desc.MediaType.IsIndex() {
+			data, err := readBlob(desc.Digest)
+			if err != nil {
+				return fmt.Errorf("could not read image index %s: %w", desc.Digest, err)
+			}
+			child, err := v1.ParseIndexManifest(bytes.NewReader(data))
+			if err != nil {
+				return fmt.Errorf("could not parse image index %s: %w", desc.Digest, err)
+			}
+			local.manifests = child.Manifests
+		}
+		for _, ref := range refs {
+			r.add(ref, local)
+		}
+		if _, exists := r.tags[tag]; tag != "" && !exists {
+			r.tags[tag] = local
+		}
+	}
+	return nil
+}
+
+// imageReferences returns the full image references in the annotations. If
+// there are none, it returns the tag in the OCI annotation instead, which
+// matches image references with the tag in any repository. Tags are ignored
+// if there are full image references, because Docker also sets the OCI
+// annotation to the tag of the full image reference.
+func imageReferences(annotations map[string]string) ([]string, string) {
+	var refs []string
+	for _, key := range []string{annotationContainerdName, annotationRefName} {
+		if ref := annotations[key]; strings.ContainsAny(ref, "/:@") {
+			refs = append(refs, ref)
+		}
+	}
+	if len(refs) > 0 {
+		return refs, ""
+	}
+	return nil, annotations[annotationRefName]
+}
+
+// normalizeReference returns the fully qualified form of the image
+// reference, e.g., `index.docker.io/library/nginx:latest` for `nginx`, so that
+// equivalent references match.
+func normalizeReference(image string) string {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return image
+	}
+	return ref.Name()
+}
@@ -0,0 +1,256 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func Test_LocalResolver_Layout(t *testing.T) {
+	dir := t.TempDir()
+	want := writeTestLayout(t, dir)
+	resolver, err := NewLocalResolver([]string{dir})
+	if err != nil {
+		t.Fatalf("could not create local resolver: %v", err)
+	}
+	assertLocalDigests(t, resolver, want)
+}
+
+func Test_LocalResolver_TarballDirectory(t *testing.T) {
+	layoutDir := t.TempDir()
+	want := writeTestLayout(t, layoutDir)
+	tarballDir := t.TempDir()
+	writeTestTarball(t, layoutDir, filepath.Join(tarballDir, "images.tar"))
+	resolver, err := NewLocalResolver([]string{tarballDir})
+	if err != nil {
+		t.Fatalf("could not create local resolver: %v", err)
+	}
+	assertLocalDigests(t, resolver, want)
+}
+
+func Test_LocalResolver_DockerTarball(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "legacy.tar")
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("could not create image: %v", err)
+	}
+	tag, err := name.NewTag("gcr.io/project/app:1.0")
+	if err != nil {
+		t.Fatalf("could not parse tag: %v", err)
+	}
+	// Writes a manifest.json with RepoTags, and no OCI image layout.
+	if err := tarball.WriteToFile(filename, tag, img); err != nil {
+		t.Fatalf("could not write tarball: %v", err)
+	}
+
+	resolver, err := NewLocalResolver([]string{filename})
+	if err != nil {
+		t.Fatalf("could not create local resolver: %v", err)
+	}
+
+	want := digestOf(t, img)
+	if digest, err := resolver.Resolve(context.Background(), "gcr.io/project/app:1.0", authn.DefaultKeychain, nil); err != nil || digest != want {
+		t.Errorf("wanted %s, got %s (error %v)", want, digest, err)
+	}
+}
+
+func Test_LocalResolver_TarballWithoutImages(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "other.tar")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("could not create tarball: %v", err)
+	}
+	tw := tar.NewWriter(f)
+	data := []byte("not an image")
+	if err := tw.WriteHeader(&tar.Header{Name: "README", Mode: 0o644, Size: int64(len(data))}); err != nil {
+		t.Fatalf("could not write tarball: %v", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatalf("could not write tarball: %v", err)
+	}
+	tw.Close()
+	f.Close()
+
+	if _, err := NewLocalResolver([]string{filename}); err == nil {
+		t.Errorf("wanted error for tarball without OCI image layout or manifest.json")
+	}
+}
+
+func Test_LocalResolver_TagOnlyRefName(t *testing.T) {
+	dir := t.TempDir()
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatalf("could not create OCI image layout: %v", err)
+	}
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("could not create image: %v", err)
+	}
+	// Like `oras copy --to-oci-layout` and `skopeo copy` to oci:dir:v1.
+	if err := p.AppendImage(img, layout.WithAnnotations(map[string]string{annotationRefName: "v1"})); err != nil {
+		t.Fatalf("could not append image: %v", err)
+	}
+	dockerDir := t.TempDir()
+	writeTestLayout(t, dockerDir)
+	resolver, err := NewLocalResolver([]string{dir, dockerDir})
+	if err != nil {
+		t.Fatalf("could not create local resolver: %v", err)
+	}
+
+	ctx := context.Background()
+	wantDigest := digestOf(t, img)
+	for _, image := range []string{"registry.example.com/app:v1", "app:v1"} {
+		if digest, err := resolver.Resolve(ctx, image, authn.DefaultKeychain, nil); err != nil || digest != wantDigest {
+			t.Errorf("%s: wanted %s, got %s (error %v)", image, wantDigest, digest, err)
+		}
+	}
+	if _, err := resolver.Resolve(ctx, "registry.example.com/app:v2", authn.DefaultKeychain, nil); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("wanted ErrImageNotFound for other tag, got %v", err)
+	}
+	// The tag annotation of an image with a full image reference only
+	// matches that image reference.
+	if _, err := resolver.Resolve(ctx, "registry.example.com/app:1.25", authn.DefaultKeychain, nil); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("wanted ErrImageNotFound for tag of other repository, got %v", err)
+	}
+}
+
+func Test_ChainResolvers_Fallback(t *testing.T) {
+	dir := t.TempDir()
+	want := writeTestLayout(t, dir)
+	local, err := NewLocalResolver([]string{dir})
+	if err != nil {
+		t.Fatalf("could not create local resolver: %v", err)
+	}
+	resolver := ChainResolvers(local, RegistryResolver)
+
+	node, err := createPodNode([]string{"gcr.io/project/app:1.0", "image1"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithResolver(resolver)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+	assertContainer(t, node, "gcr.io/project/app:1.0@"+want["gcr.io/project/app:1.0"], "spec", "containers", "[name=container0]")
+	assertContainer(t, node, "image1@sha256:"+sha256Hex("image1"), "spec", "containers", "[name=container1]")
+
+	node, err = createPodNode([]string{"error"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	err = ImageTags(ctx, log, nil, node, []string{}, WithResolver(resolver))
+	if !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("wanted errors of all resolvers, got %v", err)
+	}
+}
+
+// writeTestLayout writes an OCI image layout with an image and a
+// multi-platform image, and returns the expected digests by image reference
+// and platform.
+func writeTestLayout(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatalf("could not create OCI image layout: %v", err)
+	}
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("could not create image: %v", err)
+	}
+	if err := p.AppendImage(img, layout.WithAnnotations(map[string]string{
+		annotationRefName: "gcr.io/project/app:1.0",
+	})); err != nil {
+		t.Fatalf("could not append image: %v", err)
+	}
+	amd64, _ := random.Image(64, 1)
+	arm64, _ := random.Image(64, 1)
+	idx := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: amd64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+		mutate.IndexAddendum{Add: arm64, Descriptor: v1.Descriptor{Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}}},
+	)
+	if err := p.AppendIndex(idx, layout.WithAnnotations(map[string]string{
+		annotationContainerdName: "docker.io/library/nginx:1.25",
+		annotationRefName:        "1.25",
+	})); err != nil {
+		t.Fatalf("could not append index: %v", err)
+	}
+	return map[string]string{
+		"gcr.io/project/app:1.0": digestOf(t, img),
+		"nginx:1.25":             digestOf(t, idx),
+		"nginx:1.25 linux/arm64": digestOf(t, arm64),
+	}
+}
+
+func assertLocalDigests(t *testing.T, resolver Resolver, want map[string]string) {
+	t.Helper()
+	ctx := context.Background()
+	for image, wantDigest := range map[string]string{
+		"gcr.io/project/app:1.0":             want["gcr.io/project/app:1.0"],
+		"nginx:1.25":                         want["nginx:1.25"],
+		"index.docker.io/library/nginx:1.25": want["nginx:1.25"],
+	} {
+		digest, err := resolver.Resolve(ctx, image, authn.DefaultKeychain, nil)
+		if err != nil || digest != wantDigest {
+			t.Errorf("%s: wanted %s, got %s (error %v)", image, wantDigest, digest, err)
+		}
+	}
+	digest, err := resolver.Resolve(ctx, "nginx:1.25", authn.DefaultKeychain, &v1.Platform{OS: "linux", Architecture: "arm64"})
+	if err != nil || digest != want["nginx:1.25 linux/arm64"] {
+		t.Errorf("wanted arm64 digest %s, got %s (error %v)", want["nginx:1.25 linux/arm64"], digest, err)
+	}
+	if _, err := resolver.Resolve(ctx, "nginx:1.24", authn.DefaultKeychain, nil); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("wanted ErrImageNotFound, got %v", err)
+	}
+	if _, err := resolver.Resolve(ctx, "1.25", authn.DefaultKeychain, nil); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("wanted ErrImageNotFound for tag-only reference, got %v", err)
+	}
+}
+
+// writeTestTarball writes the files in the directory to a tarball.
+func writeTestTarball(t *testing.T, dir string, filename string) {
+	t.Helper()
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("could not create tarball: %v", err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	defer tw.Close()
+	if err := tw.AddFS(os.DirFS(dir)); err != nil {
+		t.Fatalf("could not write tarball: %v", err)
+	}
+}
+
+func digestOf(t *testing.T, artifact interface{ Digest() (v1.Hash, error) }) string {
+	t.Helper()
+	h, err := artifact.Digest()
+	if err != nil {
+		t.Fatalf("could not get digest: %v", err)
+	}
+	return h.String()
+}
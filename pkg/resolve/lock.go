@@ -0,0 +1,253 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// API version and kind of lock files.
+const (
+	LockAPIVersion = "digester.k8s.io/v1alpha1"
+	LockKind       = "ImageLock"
+)
+
+// ErrNotLocked is returned when resolving only from a lock, and the lock
+// does not contain the image reference.
+var ErrNotLocked = errors.New("image is not in the lock file")
+
+// LockEntry records the digest that an image reference resolved to.
+type LockEntry struct {
+	Image    string `yaml:"image"`
+	Digest   string `yaml:"digest"`
+	Registry string `yaml:"registry,omitempty"`
+	// Platform is the target platform, if the image reference was resolved
+	// for a platform.
+	Platform string `yaml:"platform,omitempty"`
+	// Mirror is the image reference that resolved the tag, if it was
+	// resolved using a registry mirror.
+	Mirror string `yaml:"mirror,omitempty"`
+	// Credentials is a hash of the registry credentials that resolved the
+	// tag. The last-known-good store sets it, so that digests are only used
+	// with the same credentials. It is empty in lock files.
+	Credentials string    `yaml:"credentials,omitempty"`
+	ResolvedAt  time.Time `yaml:"resolvedAt"`
+}
+
+// lockFile is the serialized form of a Lock.
+type lockFile struct {
+	APIVersion string      `yaml:"apiVersion"`
+	Kind       string      `yaml:"kind"`
+	Images     []LockEntry `yaml:"images"`
+}
+
+// Lock maps image references and target platforms to digests. It is safe
+// for concurrent use.
+type Lock struct {
+	mu      sync.Mutex
+	entries map[lockKey]LockEntry
+}
+
+type lockKey struct {
+	image       string
+	platform    string
+	credentials string
+}
+
+// NewLock creates an empty Lock.
+func NewLock() *Lock {
+	return &Lock{entries: map[lockKey]LockEntry{}}
+}
+
+// LoadLock reads a Lock from the file. If the file does not exist and
+// mustExist is false, the Lock is empty.
+func LoadLock(filename string, mustExist bool) (*Lock, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) && !mustExist {
+		return NewLock(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read lock file %s: %w", filename, err)
+	}
+	l, err := ParseLock(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse lock file %s: %w", filename, err)
+	}
+	return l, nil
+}
+
+// ParseLock reads a Lock from the serialized form.
+func ParseLock(data []byte) (*Lock, error) {
+	var file lockFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if file.APIVersion != LockAPIVersion || file.Kind != LockKind {
+		return nil, fmt.Errorf("must have apiVersion %s and kind %s", LockAPIVersion, LockKind)
+	}
+	l := NewLock()
+	for _, entry := range file.Images {
+		l.Set(entry)
+	}
+	return l, nil
+}
+
+// Save writes the Lock to the file, with the entries sorted by image
+// reference and platform, so that the file is stable.
+func (l *Lock) Save(filename string) error {
+	data, err := l.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, data, 0o644); err != nil {
+		return fmt.Errorf("could not write lock file %s: %w", filename, err)
+	}
+	return nil
+}
+
+// Marshal returns the serialized form of the Lock, with the entries sorted
+// by image reference and platform.
+func (l *Lock) Marshal() ([]byte, error) {
+	data, err := yaml.Marshal(lockFile{
+		APIVersion: LockAPIVersion,
+		Kind:       LockKind,
+		Images:     l.Entries(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not serialize lock file: %w", err)
+	}
+	return data, nil
+}
+
+// Get returns the entry for the image reference and platform, if present.
+func (l *Lock) Get(image string, platform *v1.Platform) (LockEntry, bool) {
+	return l.get(image, platformString(platform), "")
+}
+
+func (l *Lock) get(image string, platform string, credentials string) (LockEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, exists := l.entries[lockKey{image: image, platform: platform, credentials: credentials}]
+	return entry, exists
+}
+
+// Set adds or replaces the entry for the image reference, platform, and
+// credentials.
+func (l *Lock) Set(entry LockEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[lockKey{image: entry.Image, platform: entry.Platform, credentials: entry.Credentials}] = entry
+}
+
+// Entries returns the entries sorted by image reference and platform.
+func (l *Lock) Entries() []LockEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]LockEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Image != entries[j].Image {
+			return entries[i].Image < entries[j].Image
+		}
+		if entries[i].Platform != entries[j].Platform {
+			return entries[i].Platform < entries[j].Platform
+		}
+		return entries[i].Credentials < entries[j].Credentials
+	})
+	return entries
+}
+
+// WithLock records the digests of the image tags that are resolved in the
+// lock. With lockOnly, image tags are resolved exclusively from the lock,
+// without using the cache or registries, and image tags that are not in
+// the lock fail with ErrNotLocked.
+func WithLock(lock *Lock, lockOnly bool) Option {
+	return func(f *ImageTagFilter) {
+		f.Lock = lock
+		f.LockOnly = lockOnly
+	}
+}
+
+// resolveTagWithLock resolves the tag from the lock, if resolving only from
+// the lock. Otherwise, it resolves the tag, and records the digest in the
+// lock, if there is one. The resolution also contains the image reference
+// that resolved the tag, which differs from the image if a registry mirror
+// resolved it.
+func (f *ImageTagFilter) resolveTagWithLock(image string) resolution {
+	if f.Lock == nil {
+		return f.resolveTagWithMirrors(image)
+	}
+	if f.LockOnly {
+		entry, exists := f.Lock.Get(image, f.Platform)
+		if !exists {
+			return resolution{err: ErrNotLocked}
+		}
+		f.Log.V(1).Info("found digest in lock", "image", image, "digest", entry.Digest)
+		if entry.Mirror != "" {
+			return resolution{digest: entry.Digest, served: entry.Mirror}
+		}
+		return resolution{digest: entry.Digest, served: image}
+	}
+	res := f.resolveTagWithMirrors(image)
+	if res.err != nil {
+		return res
+	}
+	f.Lock.Set(f.newLockEntry(image, res.digest, res.served))
+	return res
+}
+
+// newLockEntry records that the image reference resolved to the digest
+// now, using the served image reference.
+func (f *ImageTagFilter) newLockEntry(image string, digest string, served string) LockEntry {
+	entry := LockEntry{
+		Image:      image,
+		Digest:     digest,
+		Registry:   registryOf(served),
+		Platform:   platformString(f.Platform),
+		ResolvedAt: now().UTC().Truncate(time.Second),
+	}
+	if served != image {
+		entry.Mirror = served
+	}
+	return entry
+}
+
+// registryOf returns the registry host of the image reference, or "unknown"
+// if the image reference cannot be parsed.
+func registryOf(image string) string {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "unknown"
+	}
+	return ref.Context().RegistryStr()
+}
+
+func platformString(platform *v1.Platform) string {
+	if platform == nil {
+		return ""
+	}
+	return platform.String()
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func Test_ImageTags_WithLock_RecordsAndSaves(t *testing.T) {
+	origNow := now
+	defer func() { now = origNow }()
+	now = func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }
+	node, err := createPodNode([]string{"gcr.io/project/image1:tag", "image0"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	lock := NewLock()
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithLock(lock, false)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "digester.lock.yaml")
+	if err := lock.Save(filename); err != nil {
+		t.Fatalf("could not save lock: %v", err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("could not read lock file: %v", err)
+	}
+	want := `apiVersion: digester.k8s.io/v1alpha1
+kind: ImageLock
+images:
+- image: gcr.io/project/image1:tag
+  digest: sha256:` + sha256Hex("gcr.io/project/image1:tag") + `
+  registry: gcr.io
+  resolvedAt: 2021-06-01T12:00:00Z
+- image: image0
+  digest: sha256:` + sha256Hex("image0") + `
+  registry: index.docker.io
+  resolvedAt: 2021-06-01T12:00:00Z
+`
+	if string(data) != want {
+		t.Errorf("wanted lock file:\n%s\ngot:\n%s", want, string(data))
+	}
+
+	loaded, err := LoadLock(filename, true)
+	if err != nil {
+		t.Fatalf("could not load lock: %v", err)
+	}
+	if len(loaded.Entries()) != 2 {
+		t.Errorf("wanted 2 entries, got %+v", loaded.Entries())
+	}
+}
+
+func Test_ImageTags_WithLockOnly(t *testing.T) {
+	origResolveTagFn := resolveTagFn
+	defer func() { resolveTagFn = origResolveTagFn }()
+	resolveTagFn = nil // the registry must not be used
+	platform := &v1.Platform{OS: "linux", Architecture: "arm64"}
+	lock := NewLock()
+	lock.Set(LockEntry{Image: "image0", Digest: "sha256:index"})
+	lock.Set(LockEntry{Image: "image0", Digest: "sha256:arm64", Platform: "linux/arm64"})
+
+	node, err := createPodNode([]string{"image0"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithLock(lock, true), WithPlatform(platform)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+	assertContainer(t, node, "image0@sha256:arm64", "spec", "containers", "[name=container0]")
+
+	node, err = createPodNode([]string{"image1"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	err = ImageTags(ctx, log, nil, node, []string{}, WithLock(lock, true))
+	var resolveErr *ResolveError
+	if !errors.Is(err, ErrNotLocked) || !errors.As(err, &resolveErr) || resolveErr.Image != "image1" {
+		t.Errorf("wanted ErrNotLocked for image1, got %v", err)
+	}
+}
+
+func Test_LoadLock(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.yaml")
+	if lock, err := LoadLock(missing, false); err != nil || len(lock.Entries()) != 0 {
+		t.Errorf("wanted empty lock for missing file, got %v, %v", lock, err)
+	}
+	if _, err := LoadLock(missing, true); err == nil {
+		t.Errorf("wanted error for missing file")
+	}
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(invalid, []byte("apiVersion: v1\nkind: ConfigMap\n"), 0o644); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+	if _, err := LoadLock(invalid, false); err == nil || !strings.Contains(err.Error(), "must have apiVersion") {
+		t.Errorf("wanted error for wrong kind, got %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Mirror configures mirror endpoints for image references in a source
+// registry or repository prefix.
+type Mirror struct {
+	// Source is a registry host, e.g., `docker.io`, or a repository prefix,
+	// e.g., `gcr.io/my-project`.
+	Source string `json:"source" yaml:"source"`
+	// Mirrors are registry hosts or repository prefixes that replace the
+	// Source, in the order that they are tried.
+	Mirrors []string `json:"mirrors" yaml:"mirrors"`
+	// MirrorsOnly does not fall back to the Source if no mirror could
+	// resolve the tag.
+	MirrorsOnly bool `json:"mirrorsOnly,omitempty" yaml:"mirrorsOnly,omitempty"`
+}
+
+// MirrorList is the format of registry mirror configuration files.
+type MirrorList struct {
+	Mirrors []Mirror `json:"mirrors" yaml:"mirrors"`
+}
+
+// LoadMirrors reads registry mirrors from a YAML file containing a
+// `mirrors` list.
+func LoadMirrors(filename string) ([]Mirror, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read registry mirrors file %s: %w", filename, err)
+	}
+	var list MirrorList
+	if err := unmarshalStrict(b, &list); err != nil {
+		return nil, fmt.Errorf("could not parse registry mirrors file %s: %w", filename, err)
+	}
+	for _, mirror := range list.Mirrors {
+		if err := mirror.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid registry mirror in %s: %w", filename, err)
+		}
+	}
+	return list.Mirrors, nil
+}
+
+// Validate returns an error if the source or a mirror endpoint is not a
+// valid registry host or repository prefix, or if there are no mirrors.
+func (m Mirror) Validate() error {
+	if m.Source == "" {
+		return fmt.Errorf("source is required")
+	}
+	if _, err := normalizePrefix(m.Source); err != nil {
+		return fmt.Errorf("invalid source %s: %w", m.Source, err)
+	}
+	if len(m.Mirrors) == 0 {
+		return fmt.Errorf("source %s has no mirrors", m.Source)
+	}
+	for _, mirror := range m.Mirrors {
+		if _, err := normalizePrefix(mirror); err != nil {
+			return fmt.Errorf("invalid mirror %s for source %s: %w", mirror, m.Source, err)
+		}
+	}
+	return nil
+}
+
+// WithMirrors resolves image tags using the first mirror of the image's
+// registry or repository prefix that can resolve the tag. If a reference
+// matches the sources of several mirrors, the longest source wins.
+func WithMirrors(mirrors []Mirror) Option {
+	return func(f *ImageTagFilter) {
+		f.Mirrors = mirrors
+	}
+}
+
+// WithRewriteToMirror replaces the registry or repository prefix of
+// resolved image references with the mirror that resolved the tag, and keeps
+// the tag and the digest. Use with WithMirrors.
+func WithRewriteToMirror(rewrite bool) Option {
+	return func(f *ImageTagFilter) {
+		f.RewriteToMirror = rewrite
+	}
+}
+
+// resolveTagWithMirrors tries the mirrors for the image reference in order,
+// followed by the image reference itself unless the mirror is MirrorsOnly.
+// The resolution contains the digest and the image reference that resolved
+// the tag.
+func (f *ImageTagFilter) resolveTagWithMirrors(image string) resolution {
+	candidates := mirrorCandidates(f.Mirrors, image)
+	var errs []error
+	for _, candidate := range candidates {
+		digest, cached, err := f.resolveTag(candidate)
+		if err == nil {
+			return resolution{digest: digest, served: candidate, cached: cached}
+		}
+		if candidate != image {
+			f.Log.V(1).Info("could not resolve tag using mirror", "image", image, "mirror", candidate, "error", err.Error())
+			err = fmt.Errorf("mirror %s: %w", candidate, err)
+		}
+		errs = append(errs, err)
+	}
+	return resolution{err: errors.Join(errs...)}
+}
+
+// mirrorCandidates returns the image references to try for the image, in
+// order. Without a matching mirror, it returns only the image reference.
+func mirrorCandidates(mirrors []Mirror, image string) []string {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return []string{image}
+	}
+	tag, ok := ref.(name.Tag)
+	if !ok {
+		return []string{image}
+	}
+	mirrorRepos, mirrorsOnly := mirrorRepositories(mirrors, tag.Context().Name())
+	var candidates []string
+	for _, mirrorRepo := range mirrorRepos {
+		candidates = append(candidates, mirrorRepo+":"+tag.TagStr())
+	}
+	if !mirrorsOnly {
+		candidates = append(candidates, image)
+	}
+	return candidates
+}
+
+// mirrorRepositoryCandidates returns the repositories to try for listing the
+// tags of the repository, in order. Without a matching mirror, it returns
+// only the repository.
+func mirrorRepositoryCandidates(mirrors []Mirror, repository string) []string {
+	repo, err := name.NewRepository(repository)
+	if err != nil {
+		return []string{repository}
+	}
+	candidates, mirrorsOnly := mirrorRepositories(mirrors, repo.Name())
+	if !mirrorsOnly {
+		candidates = append(candidates, repository)
+	}
+	return candidates
+}
+
+// mirrorRepositories returns the mirror repositories of the mirror with the
+// longest source that matches the fully qualified repository, in order, and
+// whether that mirror is MirrorsOnly. It returns nil and false if no mirror
+// matches.
+func mirrorRepositories(mirrors []Mirror, repo string) ([]string, bool) {
+	var match *Mirror
+	var matchSource string
+	for i := range mirrors {
+		source, err := normalizePrefix(mirrors[i].Source)
+		if err != nil || len(source) <= len(matchSource) {
+			continue
+		}
+		if repo == source || strings.HasPrefix(repo, source+"/") {
+			match, matchSource = &mirrors[i], source
+		}
+	}
+	if match == nil {
+		return nil, false
+	}
+	var repos []string
+	for _, mirror := range match.Mirrors {
+		repos = append(repos, strings.TrimSuffix(mirror, "/")+strings.TrimPrefix(repo, matchSource))
+	}
+	return repos, match.MirrorsOnly
+}
+
+// normalizePrefix returns the registry host or repository prefix with the
+// registry host in the form that go-containerregistry uses, e.g.,
+// `index.docker.io` for `docker.io`.
+func normalizePrefix(prefix string) (string, error) {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if strings.Contains(prefix, "://") {
+		return "", fmt.Errorf("must not contain a scheme")
+	}
+	host, path, _ := strings.Cut(prefix, "/")
+	registry, err := name.NewRegistry(host)
+	if err != nil {
+		return "", err
+	}
+	if path == "" {
+		return registry.Name(), nil
+	}
+	return registry.Name() + "/" + path, nil
+}
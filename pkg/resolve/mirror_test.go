@@ -0,0 +1,191 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// stubMirrorResolveTagFn records the image references that it resolves, and
+// fails for image references in the unavailable registries.
+func stubMirrorResolveTagFn(t *testing.T, unavailable ...string) *[]string {
+	var mu sync.Mutex
+	var calls []string
+	origResolveTagFn := resolveTagFn
+	t.Cleanup(func() { resolveTagFn = origResolveTagFn })
+	resolveTagFn = func(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error) {
+		mu.Lock()
+		calls = append(calls, image)
+		mu.Unlock()
+		for _, registry := range unavailable {
+			if strings.HasPrefix(image, registry+"/") {
+				return "", fmt.Errorf("registry %s is unavailable", registry)
+			}
+		}
+		return origResolveTagFn(ctx, image, keychain, platform)
+	}
+	return &calls
+}
+
+func Test_mirrorCandidates(t *testing.T) {
+	mirrors := []Mirror{
+		{Source: "docker.io", Mirrors: []string{"mirror.gcr.io", "registry.example.com/dockerhub/"}},
+		{Source: "gcr.io/project", Mirrors: []string{"registry.example.com/gcr"}, MirrorsOnly: true},
+		{Source: "gcr.io/project/team", Mirrors: []string{"registry.example.com/team"}, MirrorsOnly: true},
+	}
+	tests := []struct {
+		image string
+		want  []string
+	}{
+		{"nginx:1.25", []string{"mirror.gcr.io/library/nginx:1.25", "registry.example.com/dockerhub/library/nginx:1.25", "nginx:1.25"}},
+		{"docker.io/library/nginx", []string{"mirror.gcr.io/library/nginx:latest", "registry.example.com/dockerhub/library/nginx:latest", "docker.io/library/nginx"}},
+		{"gcr.io/project/app:v1", []string{"registry.example.com/gcr/app:v1"}},
+		{"gcr.io/project/team/app:v1", []string{"registry.example.com/team/app:v1"}},
+		{"gcr.io/projectx/app:v1", []string{"gcr.io/projectx/app:v1"}},
+		{"quay.io/app:v1", []string{"quay.io/app:v1"}},
+	}
+	for _, test := range tests {
+		if got := mirrorCandidates(mirrors, test.image); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("mirrorCandidates(%s): wanted %v, got %v", test.image, test.want, got)
+		}
+	}
+}
+
+func Test_ImageTags_WithMirrors_FallbackOrder(t *testing.T) {
+	calls := stubMirrorResolveTagFn(t, "mirror.gcr.io")
+	node, err := createPodNode([]string{"nginx:1.25"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	mirrors := []Mirror{{Source: "docker.io", Mirrors: []string{"mirror.gcr.io", "registry.example.com"}}}
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithMirrors(mirrors)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	wantCalls := []string{"mirror.gcr.io/library/nginx:1.25", "registry.example.com/library/nginx:1.25"}
+	if !reflect.DeepEqual(*calls, wantCalls) {
+		t.Errorf("wanted calls %v, got %v", wantCalls, *calls)
+	}
+	assertContainer(t, node, "nginx:1.25@sha256:"+sha256Hex("registry.example.com/library/nginx:1.25"), "spec", "containers", "[name=container0]")
+}
+
+func Test_ImageTags_WithMirrors_FallbackToSource(t *testing.T) {
+	stubMirrorResolveTagFn(t, "mirror.gcr.io")
+	mirrors := []Mirror{{Source: "docker.io", Mirrors: []string{"mirror.gcr.io"}}}
+	node, err := createPodNode([]string{"nginx:1.25"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithMirrors(mirrors), WithRewriteToMirror(true)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+	assertContainer(t, node, "nginx:1.25@sha256:"+sha256Hex("nginx:1.25"), "spec", "containers", "[name=container0]")
+
+	mirrors[0].MirrorsOnly = true
+	node, err = createPodNode([]string{"nginx:1.25"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	err = ImageTags(ctx, log, nil, node, []string{}, WithMirrors(mirrors))
+	if err == nil || !strings.Contains(err.Error(), "mirror mirror.gcr.io/library/nginx:1.25: registry mirror.gcr.io is unavailable") {
+		t.Errorf("wanted mirror error, got %v", err)
+	}
+}
+
+func Test_ImageTags_WithRewriteToMirror(t *testing.T) {
+	stubMirrorResolveTagFn(t)
+	mirrors := []Mirror{{Source: "gcr.io/project", Mirrors: []string{"registry.example.com/gcr"}}}
+	node, err := createPodNode([]string{"gcr.io/project/app:v1", "quay.io/app:v1"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	var results []Result
+	lock := NewLock()
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithMirrors(mirrors), WithRewriteToMirror(true), WithResults(&results), WithLock(lock, false)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	mirrorDigest := "sha256:" + sha256Hex("registry.example.com/gcr/app:v1")
+	assertContainer(t, node, "registry.example.com/gcr/app:v1@"+mirrorDigest, "spec", "containers", "[name=container0]")
+	assertContainer(t, node, "quay.io/app:v1@sha256:"+sha256Hex("quay.io/app:v1"), "spec", "containers", "[name=container1]")
+	if results[0].Image != "gcr.io/project/app:v1" || results[0].Digest != mirrorDigest || results[0].Resolved != "registry.example.com/gcr/app:v1@"+mirrorDigest {
+		t.Errorf("wanted result for the original image reference, got %+v", results[0])
+	}
+	entry, _ := lock.Get("gcr.io/project/app:v1", nil)
+	if entry.Mirror != "registry.example.com/gcr/app:v1" || entry.Registry != "registry.example.com" {
+		t.Errorf("wanted lock entry with mirror, got %+v", entry)
+	}
+
+	// Resolving from the lock rewrites to the same mirror.
+	resolveTagFn = nil
+	node, err = createPodNode([]string{"gcr.io/project/app:v1"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithMirrors(mirrors), WithRewriteToMirror(true), WithLock(lock, true)); err != nil {
+		t.Fatalf("problem resolving image tags from lock: %v", err)
+	}
+	assertContainer(t, node, "registry.example.com/gcr/app:v1@"+mirrorDigest, "spec", "containers", "[name=container0]")
+}
+
+func Test_LoadMirrors(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "mirrors.yaml")
+	if err := os.WriteFile(valid, []byte(`mirrors:
+- source: docker.io
+  mirrors:
+  - mirror.gcr.io
+  - registry.example.com/dockerhub
+  mirrorsOnly: true
+`), 0o644); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+	mirrors, err := LoadMirrors(valid)
+	if err != nil {
+		t.Fatalf("could not load mirrors: %v", err)
+	}
+	want := []Mirror{{Source: "docker.io", Mirrors: []string{"mirror.gcr.io", "registry.example.com/dockerhub"}, MirrorsOnly: true}}
+	if !reflect.DeepEqual(mirrors, want) {
+		t.Errorf("wanted %+v, got %+v", want, mirrors)
+	}
+
+	invalid := filepath.Join(dir, "invalid.yaml")
+	if err := os.WriteFile(invalid, []byte("mirrors:\n- source: docker.io\n"), 0o644); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+	if _, err := LoadMirrors(invalid); err == nil || !strings.Contains(err.Error(), "has no mirrors") {
+		t.Errorf("wanted error for source without mirrors, got %v", err)
+	}
+
+	misspelled := filepath.Join(dir, "misspelled.yaml")
+	if err := os.WriteFile(misspelled, []byte("mirrors:\n- source: docker.io\n  mirrors:\n  - mirror.gcr.io\n  mirrorOnly: true\n"), 0o644); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+	if _, err := LoadMirrors(misspelled); err == nil || !strings.Contains(err.Error(), "mirrorOnly") {
+		t.Errorf("wanted error for unknown field mirrorOnly, got %v", err)
+	}
+}
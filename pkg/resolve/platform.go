@@ -0,0 +1,154 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	// ResolutionModeIndex resolves tags of multi-platform images to the
+	// digest of the image index.
+	ResolutionModeIndex = "index"
+	// ResolutionModePlatform resolves tags of multi-platform images to the
+	// digest of the image manifest for the target platform.
+	ResolutionModePlatform = "platform"
+
+	archLabel = "kubernetes.io/arch"
+	osLabel   = "kubernetes.io/os"
+)
+
+// podSpecPaths are the locations of Pod specs used to derive the platform.
+var podSpecPaths = [][]string{
+	{"spec"},
+	{"spec", "template", "spec"},
+	{"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// TargetPlatform returns the platform to use for the resolution mode. It
+// returns nil for ResolutionModeIndex.
+func TargetPlatform(mode string, platform string) (*v1.Platform, error) {
+	switch mode {
+	case "", ResolutionModeIndex:
+		return nil, nil
+	case ResolutionModePlatform:
+		if platform == "" {
+			return nil, fmt.Errorf("resolution mode %s requires a platform", ResolutionModePlatform)
+		}
+		p, err := v1.ParsePlatform(platform)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse platform %s: %w", platform, err)
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unknown resolution mode %s, must be one of %s or %s", mode, ResolutionModeIndex, ResolutionModePlatform)
+	}
+}
+
+// PodPlatform derives the platform from the `kubernetes.io/os` and
+// `kubernetes.io/arch` labels in the nodeSelector or in the required node
+// affinity of the Pod spec in the resource. Values that cannot be derived
+// are taken from the fallback platform.
+func PodPlatform(n *yaml.RNode, fallback *v1.Platform) *v1.Platform {
+	platform := *fallback
+	for _, path := range podSpecPaths {
+		podSpec, err := n.Pipe(yaml.Lookup(path...))
+		if err != nil || podSpec == nil {
+			continue
+		}
+		if os := nodeLabelValue(podSpec, osLabel); os != "" {
+			platform.OS = os
+		}
+		if arch := nodeLabelValue(podSpec, archLabel); arch != "" {
+			platform.Architecture = arch
+			platform.Variant = ""
+		}
+	}
+	return &platform
+}
+
+// nodeLabelValue returns the value of the label from the nodeSelector of the
+// Pod spec. If the nodeSelector does not contain the label, it returns the
+// value from the required node affinity, but only if every node selector
+// term allows exactly one value for the label, and it is the same value,
+// because the terms are ORed.
+func nodeLabelValue(podSpec *yaml.RNode, label string) string {
+	nodeSelectorValue, err := podSpec.Pipe(yaml.Lookup("nodeSelector", label))
+	if err == nil && nodeSelectorValue != nil {
+		return yaml.GetValue(nodeSelectorValue)
+	}
+	terms, err := lookupAll(podSpec, []string{
+		"affinity", "nodeAffinity", "requiredDuringSchedulingIgnoredDuringExecution",
+		"nodeSelectorTerms", "[]",
+	})
+	if err != nil {
+		return ""
+	}
+	var value string
+	for i, term := range terms {
+		termValue := termLabelValue(term, label)
+		if termValue == "" || (i > 0 && termValue != value) {
+			return ""
+		}
+		value = termValue
+	}
+	return value
+}
+
+// termLabelValue returns the value of the label from the `In` match
+// expressions of the node selector term, but only if the expressions, which
+// are ANDed, allow exactly one value for the label.
+func termLabelValue(term *yaml.RNode, label string) string {
+	expressions, err := lookupAll(term, []string{"matchExpressions", "[]"})
+	if err != nil {
+		return ""
+	}
+	var allowed map[string]bool
+	for _, expression := range expressions {
+		key, err := expression.Pipe(yaml.Lookup("key"))
+		if err != nil || yaml.GetValue(key) != label {
+			continue
+		}
+		operator, err := expression.Pipe(yaml.Lookup("operator"))
+		if err != nil || yaml.GetValue(operator) != "In" {
+			continue
+		}
+		valuesNode, err := expression.Pipe(yaml.Lookup("values"))
+		if err != nil || valuesNode == nil {
+			continue
+		}
+		elements, err := valuesNode.Elements()
+		if err != nil {
+			continue
+		}
+		values := map[string]bool{}
+		for _, element := range elements {
+			if value := yaml.GetValue(element); allowed == nil || allowed[value] {
+				values[value] = true
+			}
+		}
+		allowed = values
+	}
+	if len(allowed) != 1 {
+		return ""
+	}
+	for value := range allowed {
+		return value
+	}
+	return ""
+}
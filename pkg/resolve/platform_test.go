@@ -0,0 +1,199 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+var linuxAmd64 = &v1.Platform{OS: "linux", Architecture: "amd64"}
+
+func Test_TargetPlatform(t *testing.T) {
+	tests := []struct {
+		mode     string
+		platform string
+		want     string
+		wantErr  bool
+	}{
+		{mode: "", platform: "linux/arm64", want: ""},
+		{mode: ResolutionModeIndex, platform: "linux/arm64", want: ""},
+		{mode: ResolutionModePlatform, platform: "linux/arm64/v8", want: "linux/arm64/v8"},
+		{mode: ResolutionModePlatform, platform: "", wantErr: true},
+		{mode: "manifest", platform: "linux/arm64", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := TargetPlatform(test.mode, test.platform)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s %s: wanted error, got nil", test.mode, test.platform)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: unexpected error: %v", test.mode, test.platform, err)
+			continue
+		}
+		var gotPlatform string
+		if got != nil {
+			gotPlatform = got.String()
+		}
+		if gotPlatform != test.want {
+			t.Errorf("%s %s: wanted [%s], got [%s]", test.mode, test.platform, test.want, gotPlatform)
+		}
+	}
+}
+
+func Test_PodPlatform(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource string
+		want     string
+	}{
+		{
+			name: "nodeSelector",
+			resource: `kind: Pod
+spec:
+  nodeSelector:
+    kubernetes.io/arch: arm64
+`,
+			want: "linux/arm64",
+		},
+		{
+			name: "pod template node affinity",
+			resource: `kind: Deployment
+spec:
+  template:
+    spec:
+      affinity:
+        nodeAffinity:
+          requiredDuringSchedulingIgnoredDuringExecution:
+            nodeSelectorTerms:
+            - matchExpressions:
+              - key: kubernetes.io/arch
+                operator: In
+                values:
+                - arm64
+`,
+			want: "linux/arm64",
+		},
+		{
+			name: "node affinity with multiple values",
+			resource: `kind: Pod
+spec:
+  affinity:
+    nodeAffinity:
+      requiredDuringSchedulingIgnoredDuringExecution:
+        nodeSelectorTerms:
+        - matchExpressions:
+          - key: kubernetes.io/arch
+            operator: In
+            values:
+            - amd64
+            - arm64
+`,
+			want: "linux/amd64",
+		},
+		{
+			name: "node affinity with a term that does not constrain the architecture",
+			resource: `kind: Pod
+spec:
+  affinity:
+    nodeAffinity:
+      requiredDuringSchedulingIgnoredDuringExecution:
+        nodeSelectorTerms:
+        - matchExpressions:
+          - key: kubernetes.io/arch
+            operator: In
+            values:
+            - arm64
+        - matchExpressions:
+          - key: topology.kubernetes.io/zone
+            operator: In
+            values:
+            - us-central1-a
+`,
+			want: "linux/amd64",
+		},
+		{
+			name: "node affinity with terms that allow the same value",
+			resource: `kind: Pod
+spec:
+  affinity:
+    nodeAffinity:
+      requiredDuringSchedulingIgnoredDuringExecution:
+        nodeSelectorTerms:
+        - matchExpressions:
+          - key: kubernetes.io/arch
+            operator: In
+            values:
+            - arm64
+        - matchExpressions:
+          - key: kubernetes.io/arch
+            operator: In
+            values:
+            - arm64
+          - key: topology.kubernetes.io/zone
+            operator: In
+            values:
+            - us-central1-a
+`,
+			want: "linux/arm64",
+		},
+		{
+			name: "no nodeSelector",
+			resource: `kind: Pod
+spec:
+  containers: []
+`,
+			want: "linux/amd64",
+		},
+	}
+	for _, test := range tests {
+		node, err := yaml.Parse(test.resource)
+		if err != nil {
+			t.Fatalf("%s: could not parse resource: %v", test.name, err)
+		}
+		if got := PodPlatform(node, linuxAmd64).String(); got != test.want {
+			t.Errorf("%s: wanted [%s], got [%s]", test.name, test.want, got)
+		}
+	}
+}
+
+func Test_ImageTags_Platform(t *testing.T) {
+	node, err := createPodNode([]string{"image0"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	var gotPlatform *v1.Platform
+	origResolveTagFn := resolveTagFn
+	defer func() { resolveTagFn = origResolveTagFn }()
+	resolveTagFn = func(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error) {
+		gotPlatform = platform
+		return origResolveTagFn(ctx, image, keychain, platform)
+	}
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithPlatform(linuxAmd64)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	if gotPlatform == nil || gotPlatform.String() != "linux/amd64" {
+		t.Errorf("wanted platform linux/amd64, got %v", gotPlatform)
+	}
+}
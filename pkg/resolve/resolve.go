@@ -19,60 +19,129 @@ package resolve
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/client-go/rest"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 
 	"github.com/google/k8s-digester/pkg/keychain"
+	"github.com/google/k8s-digester/pkg/metrics"
+	"github.com/google/k8s-digester/pkg/tracing"
 	"github.com/google/k8s-digester/pkg/version"
 )
 
 var resolveTagFn = resolveTag // override for unit testing
 
-// ImageTags looks up the digest and adds it to the image field
-// for containers and initContainers in pods and pod template specs.
-//
-// It looks for image fields with tags in these sequence nodes:
-// - `spec.containers`
-// - `spec.initContainers`
-// - `spec.template.spec.containers`
-// - `spec.template.spec.initContainers`
-// - `spec.jobTemplate.spec.template.spec.containers`
-// - `spec.jobTemplate.spec.template.spec.initContainers`
+// ImageTags looks up the digest and adds it to the image references
+// in the fields identified by field specs. Unless the WithFieldSpecs option
+// is provided, it uses DefaultFieldSpecs, which cover these fields of pod
+// specs:
+// - `containers[].image`
+// - `initContainers[].image`
+// - `ephemeralContainers[].image`
+// - `volumes[].image.reference`
+// The pod spec can be located at `spec` (e.g., Pod), `spec.template.spec`
+// (e.g., Deployment), or `spec.jobTemplate.spec.template.spec` (CronJob).
+// All image references in the resource are collected and de-duplicated
+// before they are resolved, so each tag is only resolved once.
 // The `config` input parameter can be null. In this case, the function
 // will not attempt to retrieve imagePullSecrets from the cluster.
-func ImageTags(ctx context.Context, log logr.Logger, config *rest.Config, n *yaml.RNode, skipPrefixes []string) error {
+func ImageTags(ctx context.Context, log logr.Logger, config *rest.Config, n *yaml.RNode, skipPrefixes []string, opts ...Option) error {
+	imageTagFilter := &ImageTagFilter{
+		Log:          log,
+		SkipPrefixes: &skipPrefixes,
+	}
+	for _, opt := range opts {
+		opt(imageTagFilter)
+	}
+	ctx, cancel := withOptionalTimeout(ctx, imageTagFilter.Timeout)
+	defer cancel()
+	imageTagFilter.ctx = ctx
+	start := time.Now()
 	kc, err := keychain.Create(ctx, log, config, n)
+	metrics.KeychainLatency.Observe(time.Since(start).Seconds())
 	if err != nil {
 		return fmt.Errorf("could not create keychain: %w", err)
 	}
-	imageTagFilter := &ImageTagFilter{
-		Log:          log,
-		Keychain:     kc,
-		SkipPrefixes: &skipPrefixes,
+	imageTagFilter.Keychain = kc
+	images, err := findImages(n, imageTagFilter.FieldSpecs)
+	if err != nil {
+		return err
+	}
+	results, err := imageTagFilter.filterImages(images)
+	if err != nil {
+		return err
+	}
+	if imageTagFilter.Annotations {
+		if err := annotate(n, results); err != nil {
+			return err
+		}
+	}
+	imageTagFilter.report(results)
+	return nil
+}
+
+// Option configures optional behavior of ImageTags.
+type Option func(*ImageTagFilter)
+
+// WithCache looks up digests in the provided cache before contacting the
+// registry, and stores resolved digests in the cache. A nil cache disables
+// caching.
+func WithCache(cache Cache) Option {
+	return func(f *ImageTagFilter) {
+		f.Cache = cache
+	}
+}
+
+// WithConcurrency sets the maximum number of tags resolved in parallel.
+func WithConcurrency(concurrency int) Option {
+	return func(f *ImageTagFilter) {
+		f.Concurrency = concurrency
+	}
+}
+
+// WithFieldSpecs sets the locations of image references in resources.
+// A nil value means DefaultFieldSpecs.
+func WithFieldSpecs(fieldSpecs []FieldSpec) Option {
+	return func(f *ImageTagFilter) {
+		f.FieldSpecs = fieldSpecs
+	}
+}
+
+// WithSkipContainers excludes the images of containers, init containers, and
+// ephemeral containers with the provided names from digest resolution.
+func WithSkipContainers(names []string) Option {
+	return func(f *ImageTagFilter) {
+		f.SkipContainers = names
+	}
+}
+
+// WithResolveSkippedContainers resolves the tags of the images of skipped
+// containers, so that resolution failures are reported for them, without
+// modifying their image references.
+func WithResolveSkippedContainers(resolve bool) Option {
+	return func(f *ImageTagFilter) {
+		f.ResolveSkippedContainers = resolve
+	}
+}
+
+// WithPlatform resolves tags of multi-platform images to the digest of the
+// image manifest for the platform, instead of the digest of the image index.
+// A nil platform means the digest of the image index.
+func WithPlatform(platform *v1.Platform) Option {
+	return func(f *ImageTagFilter) {
+		f.Platform = platform
 	}
-	// if input is a CronJob, we need to look up the image tags in the
-	// `spec.jobTemplate.spec.template.spec` path as well
-	if n.GetKind() == "CronJob" {
-		return n.PipeE(
-			yaml.Lookup("spec", "jobTemplate", "spec", "template", "spec"),
-			yaml.Tee(yaml.Lookup("containers"), imageTagFilter),
-			yaml.Tee(yaml.Lookup("initContainers"), imageTagFilter),
-		)
-	}
-	// otherwise, we look up the image tags in the `spec.template.spec` path
-	return n.PipeE(
-		yaml.Lookup("spec"),
-		yaml.Tee(yaml.Lookup("containers"), imageTagFilter),
-		yaml.Tee(yaml.Lookup("initContainers"), imageTagFilter),
-		yaml.Lookup("template", "spec"),
-		yaml.Tee(yaml.Lookup("containers"), imageTagFilter),
-		yaml.Tee(yaml.Lookup("initContainers"), imageTagFilter),
-	)
 }
 
 // ImageTagFilter resolves image tags to digests
@@ -80,46 +149,358 @@ type ImageTagFilter struct {
 	Log          logr.Logger
 	Keychain     authn.Keychain
 	SkipPrefixes *[]string
+	Cache        Cache        // optional
+	Concurrency  int          // values less than 1 mean sequential resolution
+	FieldSpecs   []FieldSpec  // used by ImageTags, nil means DefaultFieldSpecs
+	Platform     *v1.Platform // optional, target platform for multi-platform images
+	// Results optionally receives a Result for every image reference.
+	Results *[]Result
+	// VerifyDigests resolves tags of image references that have digests.
+	VerifyDigests bool
+	// Annotations records the original image references and the resolution
+	// time as annotations on the resource. Used by ImageTags.
+	Annotations bool
+	// SkipContainers are names of containers whose images are not resolved.
+	// With ResolveSkippedContainers, their tags are resolved, but their
+	// image references are not modified.
+	SkipContainers           []string
+	ResolveSkippedContainers bool
+	// ContinueOnError resolves the remaining tags if resolving a tag fails,
+	// and reports StatusFailed for the image references with that tag,
+	// instead of returning an error.
+	ContinueOnError bool
+	// CheckOnly does not resolve or modify image references without a
+	// digest, and reports StatusUnpinned for them instead.
+	CheckOnly bool
+	// Lock optionally records the resolved digests. With LockOnly, tags are
+	// resolved exclusively from the Lock.
+	Lock     *Lock
+	LockOnly bool
+	// Resolver resolves image tags. Nil means RegistryResolver.
+	Resolver Resolver
+	// Mirrors are tried before the registries of matching image references.
+	// With RewriteToMirror, resolved image references point to the mirror
+	// that resolved the tag.
+	Mirrors         []Mirror
+	RewriteToMirror bool
+	// Retry configures retries of registry requests. Nil means
+	// DefaultRetryPolicy.
+	Retry *RetryPolicy
+	// Timeout limits the total time of ImageTags. RegistryTimeout limits
+	// every attempt to resolve a tag using a registry, unless the registry
+	// host has a timeout in RegistryTimeouts. Zero means no limit.
+	Timeout          time.Duration
+	RegistryTimeout  time.Duration
+	RegistryTimeouts map[string]time.Duration
+	// CircuitBreaker optionally fails fast for unavailable registries.
+	CircuitBreaker *CircuitBreaker
+	// LastKnownGood optionally records resolved digests, and provides them
+	// when registries are unavailable.
+	LastKnownGood *LastKnownGood
+	// VersionRanges resolves image references with semantic version ranges
+	// as tags to the highest matching tag.
+	VersionRanges bool
+
+	ctx        context.Context // set by ImageTags, for tracing and cancellation
+	noFallback bool            // set when verifying digests, see forVerification
 }
 
 var _ yaml.Filter = &ImageTagFilter{}
 
 // Filter to resolve image tags to digests for a list of containers
 func (f *ImageTagFilter) Filter(n *yaml.RNode) (*yaml.RNode, error) {
-	if err := n.VisitElements(f.filterImage); err != nil {
+	images, err := lookupFields(n, []string{"[]", "image"}, imageField{})
+	if err != nil {
+		return nil, err
+	}
+	results, err := f.filterImages(images)
+	if err != nil {
 		return nil, err
 	}
+	f.report(results)
 	return n, nil
 }
 
 func (f *ImageTagFilter) filterImage(n *yaml.RNode) error {
-	imageNode, err := n.Pipe(yaml.Lookup("image"))
+	images, err := lookupFields(n, []string{"image"}, imageField{})
 	if err != nil {
 		s, _ := n.String()
 		return fmt.Errorf("could not lookup image in node %v: %w", s, err)
 	}
-	image := yaml.GetValue(imageNode)
+	results, err := f.filterImages(images)
+	if err != nil {
+		return err
+	}
+	f.report(results)
+	return nil
+}
+
+// filterImages resolves the distinct image tags concurrently, and then adds
+// the digests to the image reference nodes. It returns a Result for every
+// image reference.
+func (f *ImageTagFilter) filterImages(images []imageField) ([]Result, error) {
+	var tags []string
+	seen := map[string]bool{}
+	verifying := map[string]bool{}
+	for _, field := range images {
+		tag, digest := splitDigest(yaml.GetValue(field.node))
+		if f.skipResolution(field, tag) || (digest == "" && f.CheckOnly) || (digest != "" && !(f.VerifyDigests && hasTag(tag))) {
+			continue
+		}
+		if digest != "" {
+			// Cached and last-known-good digests can be outdated, so they
+			// cannot verify existing digests.
+			verifying[tag] = true
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	resolutions := f.resolveTags(tags, verifying)
+	if !f.ContinueOnError {
+		for _, tag := range tags {
+			if err := resolutions[tag].err; err != nil {
+				return nil, err
+			}
+		}
+	}
+	results := make([]Result, 0, len(images))
+	for _, field := range images {
+		image := yaml.GetValue(field.node)
+		tag, pinnedDigest := splitDigest(image)
+		resolution := resolutions[tag]
+		result := Result{
+			Field: field.path,
+			List:  field.list,
+			Name:  field.name,
+			Image: image,
+			Line:  field.node.YNode().Line,
+		}
+		switch {
+		case f.skipField(field, tag):
+			result.Status = StatusSkipped
+		case pinnedDigest == "" && f.CheckOnly:
+			result.Status = StatusUnpinned
+		case resolution.err != nil:
+			result.Status = StatusFailed
+			result.Err = resolution.err
+		case pinnedDigest == "":
+			result.Status = StatusResolved
+			result.Digest = resolution.digest
+			if resolution.stale != nil {
+				result.Stale = true
+				result.ResolvedAt = resolution.stale.ResolvedAt
+				result.Err = resolution.staleErr
+			}
+			result.Selected = resolution.selected
+			resolved := image
+			if resolution.selected != "" {
+				resolved = resolution.selected
+			}
+			if f.RewriteToMirror && resolution.served != "" {
+				resolved = resolution.served
+			}
+			result.Resolved = fmt.Sprintf("%s@%s", resolved, result.Digest)
+			field.node.YNode().Value = result.Resolved
+		case f.VerifyDigests && resolution.digest != "" && resolution.digest != pinnedDigest:
+			result.Status = StatusMismatch
+			result.Digest = resolution.digest
+		default:
+			result.Status = StatusPinned
+			result.Digest = pinnedDigest
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// report appends the results to f.Results, if set.
+func (f *ImageTagFilter) report(results []Result) {
+	if f.Results != nil {
+		*f.Results = append(*f.Results, results...)
+	}
+}
+
+// skipResolution returns true if the tag of the image reference field is
+// not resolved. This is the same as skipField, except that the tags of
+// skipped containers are resolved with ResolveSkippedContainers.
+func (f *ImageTagFilter) skipResolution(field imageField, image string) bool {
+	if f.ResolveSkippedContainers {
+		return f.skip(image)
+	}
+	return f.skipField(field, image)
+}
+
+// skipField returns true if the image reference field should be excluded
+// from digest resolution, either because of the image, or because of the
+// name of the container.
+func (f *ImageTagFilter) skipField(field imageField, image string) bool {
+	if f.skip(image) {
+		return true
+	}
+	return containerLists[field.list] && slices.Contains(f.SkipContainers, field.name)
+}
+
+// skip returns true if the image should be excluded from digest resolution.
+func (f *ImageTagFilter) skip(image string) bool {
 	for _, prefix := range *f.SkipPrefixes {
 		if strings.HasPrefix(image, prefix) {
-			// Image should be excluded from digest resolution
-			return nil
+			return true
+		}
+	}
+	return false
+}
+
+// resolution is the outcome of resolving an image tag.
+type resolution struct {
+	digest string
+	// served is the image reference that resolved the tag. It differs from
+	// the tag if a registry mirror resolved it.
+	served string
+	// cached means that the digest is from the cache, so the time when it
+	// was resolved is not known.
+	cached bool
+	err    error
+	// stale is the last-known-good entry that was used, because resolving
+	// the tag failed with staleErr.
+	stale    *LockEntry
+	staleErr error
+	// selected is the image reference with the highest tag that matches
+	// the version range of the tag, if it has one.
+	selected string
+}
+
+// resolveTags resolves the tags using at most f.Concurrency goroutines, and
+// returns a map of image tag to resolution. Tags in verifying are resolved
+// without the cache and the last-known-good fallback. The errors of tags
+// that could not be resolved are *ResolveError.
+func (f *ImageTagFilter) resolveTags(tags []string, verifying map[string]bool) map[string]resolution {
+	concurrency := f.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	resolved := make([]resolution, len(tags))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, image := range tags {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, image string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			resolver := f
+			if verifying[image] {
+				resolver = f.forVerification()
+			}
+			resolved[i] = resolver.resolveTagWithVersionRange(image)
+		}(i, image)
+	}
+	wg.Wait()
+	resolutions := make(map[string]resolution, len(tags))
+	for i, image := range tags {
+		r := resolved[i]
+		switch {
+		case r.err != nil:
+			r.err = &ResolveError{Image: image, Err: r.err}
+		case r.stale != nil:
+			r.staleErr = &ResolveError{Image: image, Err: r.staleErr}
+			f.Log.Info("using last-known-good digest", "image", image, "digest", r.digest, "resolvedAt", r.stale.ResolvedAt, "error", r.staleErr.Error())
+		default:
+			f.Log.V(1).Info("resolved tag to digest", "image", image, "digest", r.digest, "selected", r.selected)
 		}
+		resolutions[image] = r
 	}
-	if strings.Contains(image, "@") {
-		return nil // already has digest, skip
+	return resolutions
+}
+
+// forVerification returns a copy of the filter that does not use the cache,
+// and does not fall back to last-known-good digests, but still records them.
+func (f *ImageTagFilter) forVerification() *ImageTagFilter {
+	c := *f
+	c.Cache = nil
+	c.noFallback = true
+	return &c
+}
+
+// resolveTag looks up the digest in the cache, if there is one, before
+// resolving the tag using the registry. It returns true if the digest is
+// from the cache.
+func (f *ImageTagFilter) resolveTag(image string) (string, bool, error) {
+	if f.Cache == nil {
+		digest, err := f.resolveTagFromRegistry(image)
+		return digest, false, err
 	}
-	digest, err := resolveTagFn(image, f.Keychain)
+	key, err := cacheKey(image, f.Keychain, f.Platform)
 	if err != nil {
-		return fmt.Errorf("could not get digest for %s: %w", image, err)
+		f.Log.V(1).Info("not using cache", "image", image, "reason", err.Error())
+		digest, err := f.resolveTagFromRegistry(image)
+		return digest, false, err
 	}
-	f.Log.V(1).Info("resolved tag to digest", "image", image, "digest", digest)
-	imageWithDigest := fmt.Sprintf("%s@%s", image, digest)
-	n.Pipe(yaml.Lookup("image"), yaml.Set(yaml.NewStringRNode(imageWithDigest)))
-	return nil
+	if digest, exists := f.Cache.Get(key); exists {
+		f.Log.V(1).Info("found digest in cache", "image", image, "digest", digest)
+		metrics.CacheRequests.WithLabelValues(metrics.ResultHit).Inc()
+		return digest, true, nil
+	}
+	metrics.CacheRequests.WithLabelValues(metrics.ResultMiss).Inc()
+	digest, err := f.resolveTagFromRegistry(image)
+	if err != nil {
+		return "", false, err
+	}
+	f.Cache.Set(key, digest)
+	return digest, false, nil
 }
 
-func resolveTag(image string, keychain authn.Keychain) (string, error) {
-	return crane.Digest(image,
+// resolveTagFromRegistry resolves the tag using the Resolver, by default the
+// registry, and records the outcome and the duration in the metrics.
+func (f *ImageTagFilter) resolveTagFromRegistry(image string) (string, error) {
+	registry := registryOf(image)
+	if err := f.CircuitBreaker.allow(registry); err != nil {
+		metrics.Resolutions.WithLabelValues(registry, metrics.ResultCircuitOpen).Inc()
+		return "", err
+	}
+	ctx := f.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := tracing.Start(ctx, "resolveTag", trace.WithAttributes(
+		attribute.String("image", image),
+		attribute.String("registry", registry),
+	))
+	start := time.Now()
+	resolver := f.Resolver
+	if resolver == nil {
+		resolver = RegistryResolver
+	}
+	digest, err := f.resolveWithRetry(ctx, image, registry, func(ctx context.Context) (string, error) {
+		return resolver.Resolve(ctx, image, f.Keychain, f.Platform)
+	})
+	metrics.RegistryLatency.WithLabelValues(registry).Observe(time.Since(start).Seconds())
+	f.CircuitBreaker.record(registry, err)
+	span.SetAttributes(attribute.String("digest", digest))
+	tracing.End(span, err)
+	result := metrics.ResultSuccess
+	if err != nil {
+		result = metrics.ResultError
+	}
+	metrics.Resolutions.WithLabelValues(registry, result).Inc()
+	return digest, err
+}
+
+func resolveTag(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error) {
+	opts := []crane.Option{
+		crane.WithContext(ctx),
+		crane.WithTransport(tracing.Transport(&retryAfterTransport{inner: remote.DefaultTransport})),
 		crane.WithAuthFromKeychain(keychain),
-		crane.WithUserAgent(fmt.Sprintf("cloud-solutions/%s-%s", "k8s-digester", version.Version)))
+		crane.WithUserAgent(fmt.Sprintf("cloud-solutions/%s-%s", "k8s-digester", version.Version)),
+	}
+	if platform != nil {
+		opts = append(opts, crane.WithPlatform(platform))
+	}
+	// Retries of HTTP status codes are handled by resolveWithRetry, which
+	// respects Retry-After headers.
+	opts = append(opts, func(o *crane.Options) {
+		o.Remote = append(o.Remote, remote.WithRetryStatusCodes())
+	})
+	return crane.Digest(image, opts...)
 }
@@ -15,6 +15,8 @@
 package resolve
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 
 	"sigs.k8s.io/kustomize/kyaml/yaml"
@@ -127,3 +129,10 @@ func createDeploymentNode(containerImages []string, initContainerImages []string
 	}
 	return node, nil
 }
+
+// sha256Hex returns the digest that the stub resolveTagFn returns for the
+// image, without the algorithm prefix.
+func sha256Hex(image string) string {
+	sum := sha256.Sum256([]byte(image))
+	return hex.EncodeToString(sum[:])
+}
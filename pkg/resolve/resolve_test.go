@@ -18,11 +18,15 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 
 	"github.com/google/k8s-digester/pkg/logging"
@@ -52,7 +56,7 @@ func init() {
 	// Implementation of resolveTagFn that computes the SHA-256 sum of the
 	// image name. We could make this simpler since it's just for testing, but
 	// it means the digest values have the same 'shape' as real values.
-	resolveTagFn = func(image string, _ authn.Keychain) (string, error) {
+	resolveTagFn = func(_ context.Context, image string, _ authn.Keychain, _ *v1.Platform) (string, error) {
 		if image == "" || image == "error" {
 			return "", fmt.Errorf("intentional error resolving image [%s]", image)
 		}
@@ -95,6 +99,31 @@ func Test_ImageTagFilter_filterImage_Container(t *testing.T) {
 	}
 }
 
+func Test_ImageTagFilter_Filter_Containers(t *testing.T) {
+	node, err := yaml.Parse(`- name: container0
+  image: image0
+- name: container1
+  image: image1
+`)
+	if err != nil {
+		t.Fatalf("could not parse containers: %v", err)
+	}
+
+	if _, err := filter.Filter(node); err != nil {
+		t.Fatalf("unexpected Filter error: %v", err)
+	}
+
+	for i, image := range []string{"image0", "image1"} {
+		imageNode, err := node.Pipe(yaml.Lookup(fmt.Sprintf("[name=container%d]", i), "image"))
+		if err != nil {
+			t.Fatalf("could not get image field from node: %s: %v", node.MustString(), err)
+		}
+		if want, got := image+"@sha256:"+sha256Hex(image), yaml.GetValue(imageNode); want != got {
+			t.Errorf("wanted [%s], got [%s]", want, got)
+		}
+	}
+}
+
 func Test_ImageTags_Pod(t *testing.T) {
 	node, err := createPodNode([]string{"image0", "image1"}, []string{"image2", "image3"})
 	if err != nil {
@@ -163,6 +192,205 @@ func Test_ImageTags_Deployment(t *testing.T) {
 	assertContainer(t, node, "image3@sha256:b0542da3f90bad69318e16ec7fcb6b13b089971886999e08bec91cea34891f0f", "spec", "template", "spec", "initContainers", "[name=initcontainer1]")
 }
 
+func Test_ImageTags_Pod_EphemeralContainersAndImageVolumes(t *testing.T) {
+	node, err := yaml.Parse(`apiVersion: v1
+kind: Pod
+metadata:
+  name: test-pod
+spec:
+  containers:
+  - name: container0
+    image: image0
+  ephemeralContainers:
+  - name: debugger
+    image: image1
+  volumes:
+  - name: volume0
+    image:
+      reference: image2
+  - name: volume1
+    emptyDir: {}
+`)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+
+	if err := ImageTags(ctx, log, nil, node, []string{}); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+	t.Log(node.MustString())
+
+	assertContainer(t, node, "image0@sha256:07d7d43fe9dd151e40f0a8d54c5211a8601b04e4a8fa7ad57ea5e73e4ffa7e4a", "spec", "containers", "[name=container0]")
+	assertContainer(t, node, "image1@sha256:cc292b92ce7f10f2e4f727ecdf4b12528127c51b6ddf6058e213674603190d06", "spec", "ephemeralContainers", "[name=debugger]")
+	volumeImage, err := node.Pipe(yaml.Lookup("spec", "volumes", "[name=volume0]", "image", "reference"))
+	if err != nil {
+		t.Fatalf("could not find volume0 image reference: %v", err)
+	}
+	wantVolumeImage := "image2@sha256:5bb21ac469b5e7df4e17899d4aae0adfb430f0f0b336a2242ef1a22d25bd2e53"
+	if got := yaml.GetValue(volumeImage); got != wantVolumeImage {
+		t.Errorf("wanted [%s], got [%s]", wantVolumeImage, got)
+	}
+	if _, err := node.Pipe(yaml.Lookup("spec", "volumes", "[name=volume1]", "image")); err != nil {
+		t.Errorf("unexpected error looking up volume1: %v", err)
+	}
+}
+
+func Test_ImageTags_Concurrency(t *testing.T) {
+	node, err := createPodNode([]string{"image0", "image1", "image0", "image2"}, []string{"image1", "image3"})
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	var mu sync.Mutex
+	calls := map[string]int{}
+	inFlight, maxInFlight := 0, 0
+	origResolveTagFn := resolveTagFn
+	defer func() { resolveTagFn = origResolveTagFn }()
+	resolveTagFn = func(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error) {
+		mu.Lock()
+		calls[image]++
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return origResolveTagFn(ctx, image, keychain, platform)
+	}
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithConcurrency(2)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	for image, count := range calls {
+		if count != 1 {
+			t.Errorf("wanted 1 resolution of %s, got %d", image, count)
+		}
+	}
+	if len(calls) != 4 {
+		t.Errorf("wanted 4 distinct images resolved, got %d", len(calls))
+	}
+	if maxInFlight > 2 {
+		t.Errorf("wanted at most 2 concurrent resolutions, got %d", maxInFlight)
+	}
+	assertContainer(t, node, "image0@sha256:07d7d43fe9dd151e40f0a8d54c5211a8601b04e4a8fa7ad57ea5e73e4ffa7e4a", "spec", "containers", "[name=container2]")
+	assertContainer(t, node, "image1@sha256:cc292b92ce7f10f2e4f727ecdf4b12528127c51b6ddf6058e213674603190d06", "spec", "initContainers", "[name=initcontainer0]")
+}
+
+func Test_ImageTags_Error(t *testing.T) {
+	node, err := createPodNode([]string{"image0", "error"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+
+	err = ImageTags(ctx, log, nil, node, []string{}, WithConcurrency(4))
+
+	if err == nil {
+		t.Fatalf("wanted error, got nil")
+	}
+	assertContainer(t, node, "image0", "spec", "containers", "[name=container0]")
+}
+
+func Test_ImageTags_ResultsVerifyDigests(t *testing.T) {
+	node, err := createPodNode([]string{"image0", "image1:tag@sha256:stale", "image2@sha256:pinned", "skip/image3"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	var results []Result
+
+	if err := ImageTags(ctx, log, nil, node, []string{"skip/"}, WithResults(&results), WithVerifyDigests(true)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	wantStatus := map[string]Status{
+		"image0":                  StatusResolved,
+		"image1:tag@sha256:stale": StatusMismatch,
+		"image2@sha256:pinned":    StatusPinned,
+		"skip/image3":             StatusSkipped,
+	}
+	if len(results) != len(wantStatus) {
+		t.Fatalf("wanted %d results, got %d: %+v", len(wantStatus), len(results), results)
+	}
+	for _, result := range results {
+		if result.Status != wantStatus[result.Image] {
+			t.Errorf("wanted status %s for %s, got %s", wantStatus[result.Image], result.Image, result.Status)
+		}
+		if result.List != "containers" || !strings.HasPrefix(result.Field, "spec.containers[name=") {
+			t.Errorf("wanted field in spec.containers, got %s (list %s)", result.Field, result.List)
+		}
+	}
+	assertContainer(t, node, "image1:tag@sha256:stale", "spec", "containers", "[name=container1]")
+}
+
+func Test_ImageTags_ContinueOnError(t *testing.T) {
+	node, err := createPodNode([]string{"error", "image1"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	var results []Result
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithResults(&results), WithContinueOnError(true)); err != nil {
+		t.Fatalf("wanted no error when continuing on error, got: %v", err)
+	}
+
+	if len(results) != 2 {
+		t.Fatalf("wanted 2 results, got %d: %+v", len(results), results)
+	}
+	var resolveErr *ResolveError
+	if results[0].Status != StatusFailed || !errors.As(results[0].Err, &resolveErr) || resolveErr.Image != "error" {
+		t.Errorf("wanted failed result with ResolveError for image error, got %+v", results[0])
+	}
+	if results[1].Status != StatusResolved {
+		t.Errorf("wanted resolved result for image1, got %+v", results[1])
+	}
+	assertContainer(t, node, "error", "spec", "containers", "[name=container0]")
+	assertContainer(t, node, "image1@sha256:cc292b92ce7f10f2e4f727ecdf4b12528127c51b6ddf6058e213674603190d06", "spec", "containers", "[name=container1]")
+}
+
+func Test_ImageTags_CheckOnly(t *testing.T) {
+	node, err := createPodNode([]string{"image0", "image1:tag@sha256:stale", "skip/image2"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	var results []Result
+
+	if err := ImageTags(ctx, log, nil, node, []string{"skip/"}, WithResults(&results), WithCheckOnly(true), WithVerifyDigests(true)); err != nil {
+		t.Fatalf("problem checking image tags: %v", err)
+	}
+
+	wantStatus := map[string]Status{
+		"image0":                  StatusUnpinned,
+		"image1:tag@sha256:stale": StatusMismatch,
+		"skip/image2":             StatusSkipped,
+	}
+	if len(results) != len(wantStatus) {
+		t.Fatalf("wanted %d results, got %d: %+v", len(wantStatus), len(results), results)
+	}
+	for _, result := range results {
+		if result.Status != wantStatus[result.Image] {
+			t.Errorf("wanted status %s for %s, got %s", wantStatus[result.Image], result.Image, result.Status)
+		}
+	}
+	assertContainer(t, node, "image0", "spec", "containers", "[name=container0]")
+}
+
+func Test_ImageTags_SkipContainers(t *testing.T) {
+	node, err := createPodNode([]string{"image0", "image1"}, []string{"image2"})
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithSkipContainers([]string{"container1", "initcontainer0"})); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	assertContainer(t, node, "image0@sha256:07d7d43fe9dd151e40f0a8d54c5211a8601b04e4a8fa7ad57ea5e73e4ffa7e4a", "spec", "containers", "[name=container0]")
+	assertContainer(t, node, "image1", "spec", "containers", "[name=container1]")
+	assertContainer(t, node, "image2", "spec", "initContainers", "[name=initcontainer0]")
+}
+
 func assertContainer(t *testing.T, n *yaml.RNode, imageWithDigest string, path ...string) {
 	container, err := n.Pipe(yaml.Lookup(path...), yaml.Get("image"))
 	if err != nil {
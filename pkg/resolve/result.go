@@ -0,0 +1,145 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Status is the outcome of resolving one image reference.
+type Status string
+
+const (
+	// StatusResolved means that the tag was resolved and the digest was added.
+	StatusResolved Status = "Resolved"
+	// StatusPinned means that the image reference already had a digest.
+	StatusPinned Status = "Pinned"
+	// StatusMismatch means that the image reference already had a digest,
+	// but that the tag resolves to a different digest. Only reported when
+	// verifying digests.
+	StatusMismatch Status = "Mismatch"
+	// StatusSkipped means that the image reference matched a skip prefix.
+	StatusSkipped Status = "Skipped"
+	// StatusFailed means that the tag could not be resolved. Only reported
+	// when continuing on errors.
+	StatusFailed Status = "Failed"
+	// StatusUnpinned means that the image reference does not have a digest.
+	// Only reported when checking.
+	StatusUnpinned Status = "Unpinned"
+)
+
+// Result describes the outcome of resolving one image reference in a
+// resource.
+type Result struct {
+	// Field is the path to the image reference field, e.g.,
+	// `spec.containers[name=app].image`.
+	Field string
+	// List is the name of the list that contains the image reference, e.g.,
+	// `containers`, and Name is the name of the list element, e.g., the
+	// container name. Name is the index of the element if it has no name.
+	List string
+	Name string
+	// Image is the image reference before resolution.
+	Image string
+	// Line is the line number of the image reference in the input, or 0 if
+	// it is not known.
+	Line int
+	// Digest is the digest that the tag resolved to, or the existing digest
+	// for StatusPinned. Empty for StatusSkipped.
+	Digest string
+	Status Status
+	// Err is the *ResolveError for StatusFailed, and for StatusResolved with
+	// a stale digest.
+	Err error
+	// Stale means that the tag could not be resolved, and that Digest is the
+	// last-known-good digest of the tag, resolved at ResolvedAt.
+	Stale      bool
+	ResolvedAt time.Time
+	// Selected is the image reference with the highest tag that matches the
+	// version range of the tag in Image, for StatusResolved with version
+	// ranges.
+	Selected string
+	// Resolved is the image reference with digest that replaced Image, for
+	// StatusResolved. It points to the mirror that resolved the tag when
+	// rewriting to mirrors.
+	Resolved string
+}
+
+// ResolveError is returned when the tag of an image reference could not be
+// resolved to a digest.
+type ResolveError struct {
+	Image string
+	Err   error
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("could not get digest for %s: %v", e.Image, e.Err)
+}
+
+func (e *ResolveError) Unwrap() error {
+	return e.Err
+}
+
+// WithResults appends a Result for every image reference to the slice.
+func WithResults(results *[]Result) Option {
+	return func(f *ImageTagFilter) {
+		f.Results = results
+	}
+}
+
+// WithVerifyDigests resolves the tags of image references that already have
+// a digest, and reports StatusMismatch if the digests differ. These tags are
+// resolved without the cache. Image references that have a digest are not
+// modified.
+func WithVerifyDigests(verify bool) Option {
+	return func(f *ImageTagFilter) {
+		f.VerifyDigests = verify
+	}
+}
+
+// WithContinueOnError resolves as many tags as possible, and reports
+// StatusFailed for image references whose tags could not be resolved,
+// instead of returning the first error. Use with WithResults.
+func WithContinueOnError(continueOnError bool) Option {
+	return func(f *ImageTagFilter) {
+		f.ContinueOnError = continueOnError
+	}
+}
+
+// WithCheckOnly reports StatusUnpinned for image references without a
+// digest, instead of resolving their tags. Together with WithVerifyDigests,
+// image references with a digest are still verified. Image references are
+// not modified.
+func WithCheckOnly(checkOnly bool) Option {
+	return func(f *ImageTagFilter) {
+		f.CheckOnly = checkOnly
+	}
+}
+
+// splitDigest splits an image reference into the part before the digest, and
+// the digest. The digest is empty if the image reference does not have one.
+func splitDigest(image string) (string, string) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[:i], image[i+1:]
+	}
+	return image, ""
+}
+
+// hasTag returns true if the image reference, without digest, has a tag.
+func hasTag(image string) bool {
+	return strings.LastIndex(image, ":") > strings.LastIndex(image, "/")
+}
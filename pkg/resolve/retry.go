@@ -0,0 +1,275 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/google/k8s-digester/pkg/metrics"
+)
+
+// RetryPolicy configures retries of registry requests that fail with HTTP
+// status 408, 429, or 5xx. The backoff starts at InitialBackoff, doubles for
+// every retry, and is capped at MaxBackoff. If the registry responds with a
+// Retry-After header, the retry waits at least that long, but at most
+// MaxBackoff.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt. Zero
+	// disables retries.
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// errRegistryTimeout wraps the errors of attempts that exceeded the registry
+// timeout, to tell them apart from the deadline of the caller.
+var errRegistryTimeout = errors.New("registry timeout")
+
+// DefaultRetryPolicy is used if no retry policy is configured.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:     3,
+	InitialBackoff: 250 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+}
+
+// WithRetry configures retries of registry requests. Without this option,
+// DefaultRetryPolicy applies.
+func WithRetry(policy RetryPolicy) Option {
+	return func(f *ImageTagFilter) {
+		f.Retry = &policy
+	}
+}
+
+// WithTimeout limits the total time that ImageTags spends resolving the
+// image tags in the resource. The deadline of the context passed to
+// ImageTags, for instance the admission request context, also applies.
+// Zero means no limit.
+func WithTimeout(timeout time.Duration) Option {
+	return func(f *ImageTagFilter) {
+		f.Timeout = timeout
+	}
+}
+
+// WithRegistryTimeouts limits the time of every attempt to resolve an image
+// tag using a registry. The timeouts map registry hosts to timeouts, and
+// registries that are not in the map use the default timeout. Zero means no
+// limit.
+func WithRegistryTimeouts(defaultTimeout time.Duration, timeouts map[string]time.Duration) Option {
+	return func(f *ImageTagFilter) {
+		f.RegistryTimeout = defaultTimeout
+		f.RegistryTimeouts = timeouts
+	}
+}
+
+// ParseRegistryTimeouts parses a comma-separated list of registry host and
+// timeout pairs, e.g., `gcr.io=5s,docker.io=10s`. Registry hosts are
+// normalized, so `docker.io` is the same as `index.docker.io`.
+func ParseRegistryTimeouts(value string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		host, durationValue, found := strings.Cut(pair, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid registry timeout %s, must be host=duration", pair)
+		}
+		registry, err := name.NewRegistry(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry host in registry timeout %s: %w", pair, err)
+		}
+		timeout, err := time.ParseDuration(durationValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration in registry timeout %s: %w", pair, err)
+		}
+		timeouts[registry.Name()] = timeout
+	}
+	return timeouts, nil
+}
+
+// registryTimeout returns the timeout for attempts to resolve image tags
+// using the registry.
+func (f *ImageTagFilter) registryTimeout(registry string) time.Duration {
+	if timeout, exists := f.RegistryTimeouts[registry]; exists {
+		return timeout
+	}
+	return f.RegistryTimeout
+}
+
+// retryPolicy returns the configured retry policy, or DefaultRetryPolicy.
+func (f *ImageTagFilter) retryPolicy() RetryPolicy {
+	if f.Retry == nil {
+		return DefaultRetryPolicy
+	}
+	return *f.Retry
+}
+
+// resolveWithRetry calls resolve with a context that has the registry
+// timeout, and retries if resolve fails with a retryable HTTP status. It
+// stops retrying if the context is done, or if the backoff would exceed the
+// deadline of the context.
+func (f *ImageTagFilter) resolveWithRetry(ctx context.Context, image, registry string, resolve func(context.Context) (string, error)) (string, error) {
+	policy := f.retryPolicy()
+	backoff := policy.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		retryAfter := &retryAfterHolder{}
+		attemptCtx, cancel := withOptionalTimeout(withRetryAfterHolder(ctx, retryAfter), f.registryTimeout(registry))
+		digest, err := resolve(attemptCtx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+			err = fmt.Errorf("%w: %w", errRegistryTimeout, err)
+		}
+		if err == nil || attempt >= policy.MaxRetries || !isRetryable(err) {
+			return digest, err
+		}
+		wait := backoff
+		if after := retryAfter.get(); after > wait {
+			wait = after
+		}
+		if policy.MaxBackoff > 0 && wait > policy.MaxBackoff {
+			// A large Retry-After could otherwise block without a deadline.
+			wait = policy.MaxBackoff
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return "", fmt.Errorf("not retrying, backoff of %v exceeds deadline: %w", wait, err)
+		}
+		f.Log.V(1).Info("retrying", "image", image, "attempt", attempt+1, "backoff", wait, "error", err.Error())
+		metrics.Retries.WithLabelValues(registry).Inc()
+		if sleepErr := sleep(ctx, jitter(wait)); sleepErr != nil {
+			return "", fmt.Errorf("interrupted while waiting to retry after %v: %w", err, sleepErr)
+		}
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// isRetryable returns true if the error is a registry response with HTTP
+// status 408, 429, or 5xx.
+func isRetryable(err error) bool {
+	var transportErr *transport.Error
+	if !errors.As(err, &transportErr) {
+		return false
+	}
+	code := transportErr.StatusCode
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// retryAfterHolder records the largest Retry-After value of the responses
+// to the requests of one attempt.
+type retryAfterHolder struct {
+	mu    sync.Mutex
+	value time.Duration
+}
+
+func (h *retryAfterHolder) set(value time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if value > h.value {
+		h.value = value
+	}
+}
+
+func (h *retryAfterHolder) get() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.value
+}
+
+type retryAfterKey struct{}
+
+func withRetryAfterHolder(ctx context.Context, holder *retryAfterHolder) context.Context {
+	return context.WithValue(ctx, retryAfterKey{}, holder)
+}
+
+// retryAfterTransport records the Retry-After header of responses in the
+// retryAfterHolder of the request context, if there is one.
+type retryAfterTransport struct {
+	inner http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if holder, ok := req.Context().Value(retryAfterKey{}).(*retryAfterHolder); ok {
+		if value, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now()); ok {
+			holder.set(value)
+		}
+	}
+	return resp, nil
+}
+
+// parseRetryAfter parses a Retry-After header value, which is either a
+// number of seconds, or an HTTP date.
+func parseRetryAfter(value string, at time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := date.Sub(at); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// withOptionalTimeout returns a context with the timeout, or the context if
+// the timeout is zero.
+func withOptionalTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// sleep waits for the duration, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// jitter adds up to 10% to the duration, so that concurrent retries spread
+// out. Override for unit testing.
+var jitter = func(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/10+1))
+}
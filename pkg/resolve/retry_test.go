@@ -0,0 +1,250 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"context"
+	"errors"
+	"io"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+var fastRetry = RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+// stubStatusResolveTagFn fails with the HTTP status codes in order, and then
+// resolves the tag. It returns the number of calls.
+func stubStatusResolveTagFn(t *testing.T, codes ...int) *int32 {
+	var calls int32
+	origResolveTagFn := resolveTagFn
+	t.Cleanup(func() { resolveTagFn = origResolveTagFn })
+	resolveTagFn = func(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error) {
+		call := atomic.AddInt32(&calls, 1)
+		if int(call) <= len(codes) {
+			return "", &transport.Error{StatusCode: codes[call-1]}
+		}
+		return origResolveTagFn(ctx, image, keychain, platform)
+	}
+	return &calls
+}
+
+func Test_ImageTags_Retry(t *testing.T) {
+	calls := stubStatusResolveTagFn(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	node, err := createPodNode([]string{"image0"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithRetry(fastRetry)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+	if *calls != 3 {
+		t.Errorf("wanted 3 calls, got %d", *calls)
+	}
+	assertContainer(t, node, "image0@sha256:"+sha256Hex("image0"), "spec", "containers", "[name=container0]")
+}
+
+func Test_ImageTags_Retry_Exhausted(t *testing.T) {
+	calls := stubStatusResolveTagFn(t, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	node, err := createPodNode([]string{"image0"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	err = ImageTags(ctx, log, nil, node, []string{}, WithRetry(fastRetry))
+	var transportErr *transport.Error
+	if !errors.As(err, &transportErr) || transportErr.StatusCode != http.StatusBadGateway {
+		t.Errorf("wanted status 502 error, got %v", err)
+	}
+	if *calls != 3 {
+		t.Errorf("wanted 3 calls, got %d", *calls)
+	}
+}
+
+func Test_ImageTags_Retry_NotRetryable(t *testing.T) {
+	calls := stubStatusResolveTagFn(t, http.StatusNotFound)
+	node, err := createPodNode([]string{"image0"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithRetry(fastRetry)); err == nil {
+		t.Errorf("wanted error for status 404")
+	}
+	if *calls != 1 {
+		t.Errorf("wanted 1 call, got %d", *calls)
+	}
+}
+
+func Test_ImageTags_Timeouts(t *testing.T) {
+	origResolveTagFn := resolveTagFn
+	defer func() { resolveTagFn = origResolveTagFn }()
+	resolveTagFn = func(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error) {
+		if strings.HasPrefix(image, "slow.example.com/") {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+		return origResolveTagFn(ctx, image, keychain, platform)
+	}
+	node, err := createPodNode([]string{"slow.example.com/image0"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+
+	err = ImageTags(ctx, log, nil, node, []string{}, WithTimeout(20*time.Millisecond))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wanted deadline exceeded for request timeout, got %v", err)
+	}
+
+	timeouts, err := ParseRegistryTimeouts("slow.example.com=20ms")
+	if err != nil {
+		t.Fatalf("could not parse registry timeouts: %v", err)
+	}
+	err = ImageTags(ctx, log, nil, node, []string{}, WithRegistryTimeouts(time.Minute, timeouts))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wanted deadline exceeded for registry timeout, got %v", err)
+	}
+}
+
+func Test_resolveTag_RetryAfter(t *testing.T) {
+	var throttle atomic.Bool
+	var attempts int32
+	registryHandler := registry.New(registry.Logger(stdlog.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !throttle.Load() || !strings.Contains(r.URL.Path, "/manifests/") {
+			registryHandler.ServeHTTP(w, r)
+			return
+		}
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		registryHandler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	image := strings.TrimPrefix(server.URL, "http://") + "/app:v1"
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatalf("could not create image: %v", err)
+	}
+	if err := crane.Push(img, image); err != nil {
+		t.Fatalf("could not push image: %v", err)
+	}
+	throttle.Store(true)
+	want, err := img.Digest()
+	if err != nil {
+		t.Fatalf("could not get digest: %v", err)
+	}
+	f := &ImageTagFilter{Log: log, Keychain: authn.DefaultKeychain, Resolver: resolverFunc(resolveTag), Retry: &fastRetry}
+
+	digest, err := f.resolveTagFromRegistry(image)
+	if err != nil {
+		t.Fatalf("could not resolve tag: %v", err)
+	}
+	if digest != want.String() || atomic.LoadInt32(&attempts) != 2 {
+		t.Errorf("wanted digest %s after 2 attempts, got %s after %d attempts", want, digest, attempts)
+	}
+}
+
+func Test_resolveWithRetry_RetryAfterExceedsDeadline(t *testing.T) {
+	f := &ImageTagFilter{Log: log, Retry: &RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Hour}}
+	deadlineCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	calls := 0
+	_, err := f.resolveWithRetry(deadlineCtx, "image0", "index.docker.io", func(ctx context.Context) (string, error) {
+		calls++
+		ctx.Value(retryAfterKey{}).(*retryAfterHolder).set(time.Minute)
+		return "", &transport.Error{StatusCode: http.StatusTooManyRequests}
+	})
+	if err == nil || !strings.Contains(err.Error(), "exceeds deadline") || calls != 1 {
+		t.Errorf("wanted error without retry after %d calls, got %v", calls, err)
+	}
+}
+
+func Test_resolveWithRetry_RetryAfterCappedAtMaxBackoff(t *testing.T) {
+	f := &ImageTagFilter{Log: log, Retry: &fastRetry}
+	calls := 0
+	done := make(chan error, 1)
+	go func() {
+		_, err := f.resolveWithRetry(ctx, "image0", "index.docker.io", func(ctx context.Context) (string, error) {
+			calls++
+			if calls == 1 {
+				ctx.Value(retryAfterKey{}).(*retryAfterHolder).set(24 * time.Hour)
+				return "", &transport.Error{StatusCode: http.StatusTooManyRequests}
+			}
+			return "sha256:digest", nil
+		})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil || calls != 2 {
+			t.Errorf("wanted success after %d calls, got %v", calls, err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("wanted wait capped at max backoff, still waiting")
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	at := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"Tue, 01 Jun 2021 12:00:30 GMT", 30 * time.Second, true},
+		{"Tue, 01 Jun 2021 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := parseRetryAfter(test.value, at)
+		if got != test.want || ok != test.wantOK {
+			t.Errorf("parseRetryAfter(%q): wanted %v, %v, got %v, %v", test.value, test.want, test.wantOK, got, ok)
+		}
+	}
+}
+
+func Test_ParseRegistryTimeouts(t *testing.T) {
+	timeouts, err := ParseRegistryTimeouts("gcr.io=5s, docker.io=10s")
+	if err != nil {
+		t.Fatalf("could not parse registry timeouts: %v", err)
+	}
+	if timeouts["gcr.io"] != 5*time.Second || timeouts["index.docker.io"] != 10*time.Second {
+		t.Errorf("wanted normalized registry timeouts, got %v", timeouts)
+	}
+	if _, err := ParseRegistryTimeouts("gcr.io"); err == nil {
+		t.Errorf("wanted error for missing duration")
+	}
+}
+
+// resolverFunc adapts a function to the Resolver interface.
+type resolverFunc func(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error)
+
+func (r resolverFunc) Resolve(ctx context.Context, image string, keychain authn.Keychain, platform *v1.Platform) (string, error) {
+	return r(ctx, image, keychain, platform)
+}
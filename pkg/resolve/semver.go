@@ -0,0 +1,316 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/google/k8s-digester/pkg/tracing"
+	"github.com/google/k8s-digester/pkg/version"
+)
+
+var listTagsFn = listTags // override for unit testing
+
+// semVersion is a semantic version without pre-release and build metadata.
+type semVersion struct {
+	major, minor, patch int
+}
+
+func (v semVersion) less(o semVersion) bool {
+	if v.major != o.major {
+		return v.major < o.major
+	}
+	if v.minor != o.minor {
+		return v.minor < o.minor
+	}
+	return v.patch < o.patch
+}
+
+// versionRange matches the versions from lower, inclusive, to upper,
+// exclusive.
+type versionRange struct {
+	lower, upper semVersion
+}
+
+func (r versionRange) matches(v semVersion) bool {
+	return !v.less(r.lower) && v.less(r.upper)
+}
+
+// WithVersionRanges resolves image references with semantic version ranges
+// as tags, such as `myapp:~1.4` or `myapp:^2`, to the highest tag of the
+// repository that matches the range. The tag replaces the range in the
+// resolved image reference.
+func WithVersionRanges(enabled bool) Option {
+	return func(f *ImageTagFilter) {
+		f.VersionRanges = enabled
+	}
+}
+
+// SplitVersionRange returns the repository and the version range of the
+// image reference without digest, if the tag is a version range. The tag is
+// a version range if it starts with `~` or `^`. Such image references are
+// not valid references for name.ParseReference.
+func SplitVersionRange(image string) (string, string, bool) {
+	i := strings.LastIndex(image, ":")
+	if i <= strings.LastIndex(image, "/") || i == len(image)-1 {
+		return "", "", false
+	}
+	if tag := image[i+1:]; tag[0] == '~' || tag[0] == '^' {
+		return image[:i], tag, true
+	}
+	return "", "", false
+}
+
+// parseVersionRange parses a version range. The tilde range `~1.4.2`
+// matches versions from 1.4.2 to before 1.5.0, and `~1` matches versions
+// from 1.0.0 to before 2.0.0. The caret range `^1.4.2` matches versions from
+// 1.4.2 to before 2.0.0, and does not change the left-most non-zero
+// component, so `^0.4.2` matches versions from 0.4.2 to before 0.5.0.
+// Missing minor and patch versions are zero.
+func parseVersionRange(s string) (versionRange, error) {
+	if s == "" || (s[0] != '~' && s[0] != '^') {
+		return versionRange{}, fmt.Errorf("version range %s must start with ~ or ^", s)
+	}
+	v, components, ok := parseVersion(s[1:])
+	if !ok {
+		return versionRange{}, fmt.Errorf("version range %s must have the format ~MAJOR[.MINOR[.PATCH]] or ^MAJOR[.MINOR[.PATCH]]", s)
+	}
+	r := versionRange{lower: v}
+	switch {
+	case s[0] == '~' && components == 1:
+		r.upper = semVersion{major: v.major + 1}
+	case s[0] == '~':
+		r.upper = semVersion{major: v.major, minor: v.minor + 1}
+	case v.major > 0 || components == 1:
+		r.upper = semVersion{major: v.major + 1}
+	case v.minor > 0 || components == 2:
+		r.upper = semVersion{minor: v.minor + 1}
+	default:
+		r.upper = semVersion{patch: v.patch + 1}
+	}
+	return r, nil
+}
+
+// parseVersion parses a version with one to three numeric components and an
+// optional `v` prefix. It returns the version, and the number of components.
+func parseVersion(s string) (semVersion, int, bool) {
+	parts := strings.Split(strings.TrimPrefix(s, "v"), ".")
+	if len(parts) > 3 {
+		return semVersion{}, 0, false
+	}
+	var numbers [3]int
+	for i, part := range parts {
+		// Rejects signs and leading zeros.
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || strconv.Itoa(n) != part {
+			return semVersion{}, 0, false
+		}
+		numbers[i] = n
+	}
+	return semVersion{major: numbers[0], minor: numbers[1], patch: numbers[2]}, len(parts), true
+}
+
+// selectTag returns the tag with the highest version that matches the
+// range. Only tags with all three version components are candidates,
+// because tags such as `1.4` usually move between patch versions. If two
+// tags have the same version, for instance `1.4.7` and `v1.4.7`, the tag
+// without the `v` prefix wins.
+func selectTag(r versionRange, tags []string) (string, bool) {
+	var selected string
+	var highest semVersion
+	for _, tag := range tags {
+		v, components, ok := parseVersion(tag)
+		if !ok || components != 3 || !r.matches(v) {
+			continue
+		}
+		if selected == "" || highest.less(v) || (v == highest && tag < selected) {
+			selected = tag
+			highest = v
+		}
+	}
+	return selected, selected != ""
+}
+
+// resolveTagWithVersionRange selects the highest tag that matches the
+// version range of the image reference, if it has one and version ranges
+// are enabled, and resolves the image reference with that tag.
+func (f *ImageTagFilter) resolveTagWithVersionRange(image string) resolution {
+	repository, rangeTag, isRange := SplitVersionRange(image)
+	if !f.VersionRanges || !isRange {
+		return f.resolveTagWithFallback(image)
+	}
+	r, err := parseVersionRange(rangeTag)
+	if err != nil {
+		return resolution{err: err}
+	}
+	tags, err := f.listTags(repository)
+	if err != nil {
+		return resolution{err: err}
+	}
+	tag, ok := selectTag(r, tags)
+	if !ok {
+		return resolution{err: fmt.Errorf("no tag of %s matches the version range %s", repository, rangeTag)}
+	}
+	selected := repository + ":" + tag
+	f.Log.V(1).Info("selected tag for version range", "image", image, "selected", selected)
+	res := f.resolveTagWithFallback(selected)
+	res.selected = selected
+	return res
+}
+
+// listTags returns the tags of the repository. When resolving only from the
+// lock, the tags are the tags of the repository in the lock. Otherwise, the
+// tags are listed using the mirrors of the repository, if any, and the
+// repository itself, unless the mirror is MirrorsOnly. If the registries are
+// unavailable, the tags are the tags of the repository in the last-known-good
+// store, if there is one, unless verifying digests.
+func (f *ImageTagFilter) listTags(repository string) ([]string, error) {
+	if f.Lock != nil && f.LockOnly {
+		return lockTags(f.Lock, repository, ""), nil
+	}
+	tags, err := f.listTagsWithMirrors(repository)
+	if err != nil && f.LastKnownGood != nil && !f.noFallback && canFallBack(err) {
+		if credentials, ok := f.lastKnownGoodCredentials(repository); ok {
+			if tags := lockTags(f.LastKnownGood.lock, repository, credentials); len(tags) > 0 {
+				f.Log.Info("using last-known-good tags", "repository", repository, "error", err.Error())
+				return tags, nil
+			}
+		}
+	}
+	return tags, err
+}
+
+// listTagsWithMirrors lists the tags using the first candidate repository
+// that can list them, in the order of mirrorRepositoryCandidates.
+func (f *ImageTagFilter) listTagsWithMirrors(repository string) ([]string, error) {
+	var errs []error
+	for _, candidate := range mirrorRepositoryCandidates(f.Mirrors, repository) {
+		tags, err := f.listTagsWithCache(candidate)
+		if err == nil {
+			return tags, nil
+		}
+		if candidate != repository {
+			f.Log.V(1).Info("could not list tags using mirror", "repository", repository, "mirror", candidate, "error", err.Error())
+			err = fmt.Errorf("mirror %s: %w", candidate, err)
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// listTagsWithCache looks up the tags of the repository in the cache, if
+// there is one, before listing them using the registry. The cache entries
+// have the same time-to-live as the digests, so that resolving a version
+// range does not list all tags of the repository on every request.
+func (f *ImageTagFilter) listTagsWithCache(repository string) ([]string, error) {
+	if f.Cache == nil {
+		return f.listTagsFromRegistry(repository)
+	}
+	key, err := tagsCacheKey(repository, f.Keychain)
+	if err != nil {
+		f.Log.V(1).Info("not using cache", "repository", repository, "reason", err.Error())
+		return f.listTagsFromRegistry(repository)
+	}
+	if joined, exists := f.Cache.Get(key); exists {
+		f.Log.V(1).Info("found tags in cache", "repository", repository)
+		if joined == "" {
+			return nil, nil
+		}
+		return strings.Split(joined, "\n"), nil
+	}
+	tags, err := f.listTagsFromRegistry(repository)
+	if err != nil {
+		return nil, err
+	}
+	// Tags cannot contain newlines.
+	f.Cache.Set(key, strings.Join(tags, "\n"))
+	return tags, nil
+}
+
+// listTagsFromRegistry lists the tags of the repository using the Resolver,
+// by default the registry, with the retries, timeouts, and circuit breaker
+// of resolving tags. It fails with ErrListTagsUnsupported if the Resolver
+// cannot list tags.
+func (f *ImageTagFilter) listTagsFromRegistry(repository string) ([]string, error) {
+	resolver := f.Resolver
+	if resolver == nil {
+		resolver = RegistryResolver
+	}
+	lister, ok := resolver.(TagLister)
+	if !ok {
+		return nil, fmt.Errorf("could not list tags of %s: %w", repository, ErrListTagsUnsupported)
+	}
+	registry := registryOf(repository)
+	if err := f.CircuitBreaker.allow(registry); err != nil {
+		return nil, err
+	}
+	ctx := f.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := tracing.Start(ctx, "listTags", trace.WithAttributes(
+		attribute.String("repository", repository),
+		attribute.String("registry", registry),
+	))
+	var tags []string
+	_, err := f.resolveWithRetry(ctx, repository, registry, func(ctx context.Context) (string, error) {
+		var err error
+		tags, err = lister.ListTags(ctx, repository, f.Keychain)
+		return "", err
+	})
+	f.CircuitBreaker.record(registry, err)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("could not list tags of %s: %w", repository, err)
+	}
+	return tags, nil
+}
+
+func listTags(ctx context.Context, repository string, keychain authn.Keychain) ([]string, error) {
+	return crane.ListTags(repository,
+		crane.WithContext(ctx),
+		crane.WithTransport(tracing.Transport(&retryAfterTransport{inner: remote.DefaultTransport})),
+		crane.WithAuthFromKeychain(keychain),
+		crane.WithUserAgent(fmt.Sprintf("cloud-solutions/%s-%s", "k8s-digester", version.Version)),
+		func(o *crane.Options) {
+			o.Remote = append(o.Remote, remote.WithRetryStatusCodes())
+		},
+	)
+}
+
+// lockTags returns the tags of the repository in the lock, of the entries
+// with the credentials hash.
+func lockTags(lock *Lock, repository string, credentials string) []string {
+	var tags []string
+	for _, entry := range lock.Entries() {
+		if entry.Credentials != credentials {
+			continue
+		}
+		if tag, found := strings.CutPrefix(entry.Image, repository+":"); found && !strings.Contains(tag, "/") {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
@@ -0,0 +1,264 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package resolve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+var testTags = []string{"latest", "1.3.9", "1.4", "1.4.0", "1.4.7", "v1.4.7", "1.5.0", "1.10.2", "2.0.0-rc.1", "2.1.0", "v2.3.1", "0.3.1", "0.3.4", "0.4.0", "01.9.9"}
+
+// stubListTagsFn returns testTags for all repositories.
+func stubListTagsFn(t *testing.T) {
+	origListTagsFn := listTagsFn
+	t.Cleanup(func() { listTagsFn = origListTagsFn })
+	listTagsFn = func(_ context.Context, _ string, _ authn.Keychain) ([]string, error) {
+		return testTags, nil
+	}
+}
+
+func Test_selectTag(t *testing.T) {
+	tests := []struct {
+		versionRange string
+		want         string
+	}{
+		{"~1.4", "1.4.7"},
+		{"~1.4.8", ""},
+		{"~1", "1.10.2"},
+		{"^1", "1.10.2"},
+		{"^1.4.7", "1.10.2"},
+		{"^2", "v2.3.1"},
+		{"^v2.2", "v2.3.1"},
+		{"^0.3", "0.3.4"},
+		{"^0.3.1", "0.3.4"},
+		{"^0.0.3", ""},
+		{"~0", "0.4.0"},
+		{"^3", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.versionRange, func(t *testing.T) {
+			r, err := parseVersionRange(test.versionRange)
+			if err != nil {
+				t.Fatalf("could not parse version range: %v", err)
+			}
+			if got, _ := selectTag(r, testTags); got != test.want {
+				t.Errorf("wanted %q, got %q", test.want, got)
+			}
+		})
+	}
+}
+
+func Test_parseVersionRange_Invalid(t *testing.T) {
+	for _, s := range []string{"1.4", "~", "^1.4.7.1", "~1.x", "^-1", "~01"} {
+		if _, err := parseVersionRange(s); err == nil {
+			t.Errorf("wanted error for %s", s)
+		}
+	}
+}
+
+func Test_SplitVersionRange(t *testing.T) {
+	tests := []struct {
+		image      string
+		repository string
+		tag        string
+		isRange    bool
+	}{
+		{"myapp:~1.4", "myapp", "~1.4", true},
+		{"localhost:5000/myapp:^2", "localhost:5000/myapp", "^2", true},
+		{"localhost:5000/myapp", "", "", false},
+		{"myapp:1.4", "", "", false},
+		{"myapp:", "", "", false},
+	}
+	for _, test := range tests {
+		repository, tag, isRange := SplitVersionRange(test.image)
+		if repository != test.repository || tag != test.tag || isRange != test.isRange {
+			t.Errorf("%s: wanted (%q, %q, %v), got (%q, %q, %v)", test.image, test.repository, test.tag, test.isRange, repository, tag, isRange)
+		}
+	}
+}
+
+func Test_ImageTags_VersionRanges(t *testing.T) {
+	stubListTagsFn(t)
+	node, err := createPodNode([]string{"gcr.io/project/myapp:~1.4", "gcr.io/project/myapp:^3"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	var results []Result
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithVersionRanges(true), WithResults(&results), WithContinueOnError(true)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+
+	assertContainer(t, node, "gcr.io/project/myapp:1.4.7@sha256:"+sha256Hex("gcr.io/project/myapp:1.4.7"), "spec", "containers", "[name=container0]")
+	if len(results) != 2 {
+		t.Fatalf("wanted 2 results, got %+v", results)
+	}
+	if results[0].Status != StatusResolved || results[0].Image != "gcr.io/project/myapp:~1.4" || results[0].Selected != "gcr.io/project/myapp:1.4.7" {
+		t.Errorf("wanted resolved result with selected tag, got %+v", results[0])
+	}
+	if results[1].Status != StatusFailed || !strings.Contains(results[1].Err.Error(), "no tag of gcr.io/project/myapp matches the version range ^3") {
+		t.Errorf("wanted failed result without matching tag, got %+v", results[1])
+	}
+}
+
+func Test_ImageTags_VersionRanges_Cache(t *testing.T) {
+	origListTagsFn := listTagsFn
+	defer func() { listTagsFn = origListTagsFn }()
+	var calls int
+	listTagsFn = func(_ context.Context, _ string, _ authn.Keychain) ([]string, error) {
+		calls++
+		return testTags, nil
+	}
+	cache := NewLRUCache(10, time.Hour)
+	for i := 0; i < 2; i++ {
+		node, err := createPodNode([]string{"gcr.io/project/myapp:~1.4"}, nil)
+		if err != nil {
+			t.Fatalf("could not create pod node: %v", err)
+		}
+		if err := ImageTags(ctx, log, nil, node, []string{}, WithVersionRanges(true), WithCache(cache)); err != nil {
+			t.Fatalf("problem resolving image tags: %v", err)
+		}
+		assertContainer(t, node, "gcr.io/project/myapp:1.4.7@sha256:"+sha256Hex("gcr.io/project/myapp:1.4.7"), "spec", "containers", "[name=container0]")
+	}
+	if calls != 1 {
+		t.Errorf("wanted tags listed once, got %d", calls)
+	}
+}
+
+func Test_ImageTags_VersionRanges_Disabled(t *testing.T) {
+	stubListTagsFn(t)
+	node, err := createPodNode([]string{"myapp:~1.4"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	if err := ImageTags(ctx, log, nil, node, []string{}); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+	assertContainer(t, node, "myapp:~1.4@sha256:"+sha256Hex("myapp:~1.4"), "spec", "containers", "[name=container0]")
+}
+
+func Test_ImageTags_VersionRanges_LockOnly(t *testing.T) {
+	origListTagsFn := listTagsFn
+	defer func() { listTagsFn = origListTagsFn }()
+	listTagsFn = func(_ context.Context, repository string, _ authn.Keychain) ([]string, error) {
+		t.Errorf("wanted no registry request when resolving only from the lock, got %s", repository)
+		return nil, nil
+	}
+	lock := NewLock()
+	lock.Set(LockEntry{Image: "myapp:1.4.2", Digest: "sha256:old"})
+	lock.Set(LockEntry{Image: "myapp:1.4.3", Digest: "sha256:new"})
+	lock.Set(LockEntry{Image: "myapp:1.5.0", Digest: "sha256:other"})
+	node, err := createPodNode([]string{"myapp:~1.4"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithVersionRanges(true), WithLock(lock, true)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+	assertContainer(t, node, "myapp:1.4.3@sha256:new", "spec", "containers", "[name=container0]")
+}
+
+func Test_ImageTags_VersionRanges_LastKnownGoodTags(t *testing.T) {
+	origNow := now
+	defer func() { now = origNow }()
+	now = func() time.Time { return time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC) }
+	origListTagsFn := listTagsFn
+	defer func() { listTagsFn = origListTagsFn }()
+	listTagsFn = func(_ context.Context, _ string, _ authn.Keychain) ([]string, error) {
+		return nil, &transport.Error{StatusCode: http.StatusServiceUnavailable}
+	}
+	stubStatusResolveTagFn(t, http.StatusServiceUnavailable)
+	credentials, err := credentialsHash(name.MustParseReference("myapp").Context(), &anonymousKeychain{})
+	if err != nil {
+		t.Fatalf("could not hash credentials: %v", err)
+	}
+	lkg := NewLastKnownGood(0)
+	lkg.record(LockEntry{Image: "myapp:1.4.3", Digest: "sha256:lkg", Credentials: credentials, ResolvedAt: now()})
+	node, err := createPodNode([]string{"myapp:~1.4"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	var results []Result
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithVersionRanges(true), WithLastKnownGood(lkg), WithRetry(RetryPolicy{}), WithResults(&results)); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+	assertContainer(t, node, "myapp:1.4.3@sha256:lkg", "spec", "containers", "[name=container0]")
+	if len(results) != 1 || !results[0].Stale || results[0].Selected != "myapp:1.4.3" {
+		t.Errorf("wanted stale result with selected tag, got %+v", results)
+	}
+}
+
+func Test_ImageTags_VersionRanges_Mirrors(t *testing.T) {
+	origListTagsFn := listTagsFn
+	defer func() { listTagsFn = origListTagsFn }()
+	var repositories []string
+	listTagsFn = func(_ context.Context, repository string, _ authn.Keychain) ([]string, error) {
+		repositories = append(repositories, repository)
+		if strings.HasPrefix(repository, "mirror.gcr.io/") {
+			return nil, fmt.Errorf("mirror is unavailable")
+		}
+		return testTags, nil
+	}
+	mirrors := []Mirror{{Source: "docker.io", Mirrors: []string{"mirror.gcr.io", "registry.example.com/dockerhub"}, MirrorsOnly: true}}
+	node, err := createPodNode([]string{"myapp:~1.4"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithVersionRanges(true), WithMirrors(mirrors), WithRetry(RetryPolicy{})); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+	wantRepositories := []string{"mirror.gcr.io/library/myapp", "registry.example.com/dockerhub/library/myapp"}
+	if !reflect.DeepEqual(repositories, wantRepositories) {
+		t.Errorf("wanted tags listed using %v, got %v", wantRepositories, repositories)
+	}
+	assertContainer(t, node, "myapp:1.4.7@sha256:"+sha256Hex("mirror.gcr.io/library/myapp:1.4.7"), "spec", "containers", "[name=container0]")
+}
+
+func Test_ImageTags_VersionRanges_LocalImagesOnly(t *testing.T) {
+	stubListTagsFn(t)
+	dir := t.TempDir()
+	writeTestLayout(t, dir)
+	resolver, err := NewLocalResolver([]string{dir})
+	if err != nil {
+		t.Fatalf("could not create local resolver: %v", err)
+	}
+	node, err := createPodNode([]string{"gcr.io/project/app:~1.0"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	err = ImageTags(ctx, log, nil, node, []string{}, WithVersionRanges(true), WithResolver(resolver))
+	if !errors.Is(err, ErrListTagsUnsupported) {
+		t.Errorf("wanted %v, got %v", ErrListTagsUnsupported, err)
+	}
+
+	node, err = createPodNode([]string{"gcr.io/project/app:~1.4"}, nil)
+	if err != nil {
+		t.Fatalf("could not create pod node: %v", err)
+	}
+	if err := ImageTags(ctx, log, nil, node, []string{}, WithVersionRanges(true), WithResolver(ChainResolvers(resolver, RegistryResolver))); err != nil {
+		t.Fatalf("problem resolving image tags: %v", err)
+	}
+	assertContainer(t, node, "gcr.io/project/app:1.4.7@sha256:"+sha256Hex("gcr.io/project/app:1.4.7"), "spec", "containers", "[name=container0]")
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing sets up OpenTelemetry tracing.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/google/k8s-digester/pkg/version"
+)
+
+// Supported values of the exporter argument of Setup.
+const (
+	ExporterNone = "none"
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+)
+
+const instrumentationName = "github.com/google/k8s-digester"
+
+// Setup configures the global tracer provider and propagator. The OTLP
+// exporter sends spans using HTTP, and it is configured using the standard
+// `OTEL_EXPORTER_OTLP_*` environment variables. The file exporter writes
+// spans as JSON to the file. The returned function flushes and stops the
+// exporter.
+func Setup(ctx context.Context, serviceName string, exporter string, filename string) (func(context.Context) error, error) {
+	var spanExporter sdktrace.SpanExporter
+	var closer io.Closer
+	switch exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		var err error
+		spanExporter, err = otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not create OTLP trace exporter: %w", err)
+		}
+	case ExporterFile:
+		if filename == "" {
+			return nil, fmt.Errorf("trace file is required for the %s exporter", ExporterFile)
+		}
+		file, err := os.Create(filename)
+		if err != nil {
+			return nil, fmt.Errorf("could not create trace file %s: %w", filename, err)
+		}
+		closer = file
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("could not create file trace exporter: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, must be one of %s, %s, or %s", exporter, ExporterNone, ExporterOTLP, ExporterFile)
+	}
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(serviceName),
+			semconv.ServiceVersion(version.Version),
+		)),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return func(ctx context.Context) error {
+		err := tracerProvider.Shutdown(ctx)
+		if closer != nil {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
+
+// Start creates a span using the global tracer provider.
+func Start(ctx context.Context, spanName string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, spanName, opts...)
+}
+
+// End records the error, if any, on the span, and ends the span.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Handler instruments the HTTP handler, and extracts the trace context
+// propagated by the caller, such as the API server.
+func Handler(handler http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(handler, operation)
+}
+
+// Transport instruments the HTTP transport, so that registry calls are
+// traced.
+func Transport(transport http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(transport)
+}
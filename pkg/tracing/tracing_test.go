@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func Test_Setup_FileExporter(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := Setup(ctx, "digester-test", ExporterFile, filename)
+	if err != nil {
+		t.Fatalf("could not set up tracing: %v", err)
+	}
+
+	var childSpanContext trace.SpanContext
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		_, span := Start(r.Context(), "child")
+		childSpanContext = span.SpanContext()
+		End(span, fmt.Errorf("intentional error"))
+	}), "test"))
+	defer server.Close()
+	parentCtx, parent := Start(ctx, "parent")
+	req, err := http.NewRequestWithContext(parentCtx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	resp, err := (&http.Client{Transport: Transport(http.DefaultTransport)}).Do(req)
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	resp.Body.Close()
+	End(parent, nil)
+	if err := shutdown(ctx); err != nil {
+		t.Fatalf("could not shut down tracing: %v", err)
+	}
+
+	if childSpanContext.TraceID() != parent.SpanContext().TraceID() {
+		t.Errorf("wanted trace context to be propagated, got trace IDs %s and %s", parent.SpanContext().TraceID(), childSpanContext.TraceID())
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("could not read trace file: %v", err)
+	}
+	for _, want := range []string{`"Name":"parent"`, `"Name":"child"`, "intentional error"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("wanted trace file to contain %s", want)
+		}
+	}
+}
+
+func Test_Setup_UnknownExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), "digester-test", "jaeger", ""); err == nil {
+		t.Errorf("wanted error for unknown exporter, got nil")
+	}
+}